@@ -0,0 +1,254 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth provides the Authorization header values of the load test calls
+// (http header and grpc metadata), possibly changing during the run: static
+// tokens, tokens read from a file (re-read when it changes) and OAuth2 client
+// credentials grant tokens (refreshed before they expire).
+package auth // import "fortio.org/fortio/auth"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+const (
+	filePrefix   = "file:"
+	oauth2Prefix = "oauth2:"
+	bearerPrefix = "bearer:"
+)
+
+var (
+	// FileCheckInterval is how often the token files are checked for changes.
+	FileCheckInterval = time.Second
+	// RefreshRatio is the fraction of the OAuth2 tokens lifetime after which they are refreshed.
+	RefreshRatio = 0.8
+	// RetryInterval is the delay before retrying a failed OAuth2 token refresh.
+	RetryInterval = 5 * time.Second
+)
+
+// Provider returns the current value of the Authorization header. It's called
+// for each request (by all the threads/goroutines) so must be fast and thread safe.
+type Provider interface {
+	// Authorization returns the header value (e.g. "Bearer xyz"), empty if none is available.
+	Authorization() string
+}
+
+// Parse returns the Provider described by spec, one of:
+// "file:path" for a token (or full header value) read from the file and re-read
+// when the file changes; "oauth2:token_url?client_id=x&client_secret=y[&scope=z]"
+// for OAuth2 client credentials grant tokens (the query params are sent as the
+// form of the token request); "bearer:token" or just the token for a static token.
+// Parse returns nil for an empty spec.
+func Parse(spec string) (Provider, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, filePrefix):
+		return NewFileProvider(strings.TrimPrefix(spec, filePrefix))
+	case strings.HasPrefix(spec, oauth2Prefix):
+		u, err := url.Parse(strings.TrimPrefix(spec, oauth2Prefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid oauth2 token url: %v", err)
+		}
+		form := u.Query()
+		u.RawQuery = ""
+		return NewOAuth2Provider(u.String(), form)
+	}
+	return Static(strings.TrimPrefix(spec, bearerPrefix)), nil
+}
+
+// headerValue returns the Authorization value for the token: as is when it
+// already includes a scheme (e.g. "Basic xyz"), prefixed by "Bearer " otherwise.
+func headerValue(token string) string {
+	token = strings.TrimSpace(token)
+	if token == "" || strings.Contains(token, " ") {
+		return token
+	}
+	return "Bearer " + token
+}
+
+type staticProvider string
+
+func (s staticProvider) Authorization() string {
+	return string(s)
+}
+
+// Static returns a Provider always returning the token (see Parse).
+func Static(token string) Provider {
+	return staticProvider(headerValue(token))
+}
+
+type fileProvider struct {
+	path    string
+	lock    sync.RWMutex
+	value   string
+	modTime time.Time // only used by read(), from the constructor then the watcher
+}
+
+// NewFileProvider returns a Provider using the content of the file, which is
+// checked for changes every FileCheckInterval, in the background (for tokens
+// rotated by an external agent).
+func NewFileProvider(path string) (Provider, error) {
+	p := &fileProvider{path: path}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	go p.watcher(FileCheckInterval)
+	return p, nil
+}
+
+// watcher re-reads the file when it changes, keeping the previous token on errors.
+func (p *fileProvider) watcher(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := p.read(); err != nil {
+			log.Errf("Unable to read authorization token from %s, keeping the previous one: %v", p.path, err)
+		}
+	}
+}
+
+func (p *fileProvider) read() error {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	p.modTime = fi.ModTime()
+	p.lock.Lock()
+	p.value = headerValue(string(data))
+	p.lock.Unlock()
+	log.Infof("Read new authorization token from %s", p.path)
+	return nil
+}
+
+// Authorization returns the current token (re-read in the background).
+func (p *fileProvider) Authorization() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.value
+}
+
+type oauth2Provider struct {
+	tokenURL  string
+	form      url.Values
+	client    *http.Client
+	lock      sync.Mutex
+	value     string
+	refreshAt time.Time // zero for tokens without expiry
+	retry     time.Duration
+}
+
+// NewOAuth2Provider returns a Provider getting tokens from tokenURL using the OAuth2
+// client credentials grant (form being client_id, client_secret, scope, etc...) and
+// refreshing them after RefreshRatio of their lifetime, in the background so the
+// token requests don't add to the latency of the calls. The first token is obtained
+// before returning.
+func NewOAuth2Provider(tokenURL string, form url.Values) (Provider, error) {
+	f := url.Values{}
+	for k, v := range form {
+		f[k] = v
+	}
+	if f.Get("grant_type") == "" {
+		f.Set("grant_type", "client_credentials")
+	}
+	p := &oauth2Provider{tokenURL: tokenURL, form: f, client: &http.Client{Timeout: 10 * time.Second}, retry: RetryInterval}
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	go p.refresher()
+	return p, nil
+}
+
+// refresher refreshes the token when due, until it doesn't expire anymore, retrying
+// every RetryInterval on errors (the previous token is kept meanwhile).
+func (p *oauth2Provider) refresher() {
+	for {
+		p.lock.Lock()
+		refreshAt := p.refreshAt
+		p.lock.Unlock()
+		if refreshAt.IsZero() {
+			return
+		}
+		time.Sleep(time.Until(refreshAt))
+		if err := p.refresh(); err != nil {
+			log.Errf("Unable to refresh the oauth2 token, keeping the previous one: %v", err)
+			p.lock.Lock()
+			p.refreshAt = time.Now().Add(p.retry)
+			p.lock.Unlock()
+		}
+	}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (p *oauth2Provider) refresh() error {
+	start := time.Now()
+	resp, err := p.client.PostForm(p.tokenURL, p.form)
+	if err != nil {
+		return fmt.Errorf("oauth2 token request to %s: %v", p.tokenURL, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("oauth2 token request to %s: %v", p.tokenURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth2 token request to %s: %s: %s", p.tokenURL, resp.Status, bytes.TrimSpace(data))
+	}
+	var t tokenResponse
+	if err = json.Unmarshal(data, &t); err != nil || t.AccessToken == "" {
+		return fmt.Errorf("oauth2 token request to %s: invalid reply %q: %v", p.tokenURL, data, err)
+	}
+	tokenType := "Bearer"
+	if t.TokenType != "" && !strings.EqualFold(t.TokenType, tokenType) {
+		tokenType = t.TokenType
+	}
+	p.lock.Lock()
+	p.value = tokenType + " " + t.AccessToken
+	p.refreshAt = time.Time{}
+	if t.ExpiresIn > 0 {
+		p.refreshAt = start.Add(time.Duration(RefreshRatio * float64(t.ExpiresIn) * float64(time.Second)))
+	}
+	p.lock.Unlock()
+	log.Infof("Got new oauth2 token from %s, expires in %ds", p.tokenURL, t.ExpiresIn)
+	return nil
+}
+
+// Authorization returns the current token (refreshed in the background).
+func (p *oauth2Provider) Authorization() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.value
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatic(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected string
+	}{
+		{"abc", "Bearer abc"},
+		{"bearer:abc", "Bearer abc"},
+		{"Basic Zm9vOmJhcg==", "Basic Zm9vOmJhcg=="},
+		{" xyz\n", "Bearer xyz"},
+	}
+	for _, tst := range tests {
+		p, err := Parse(tst.spec)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", tst.spec, err)
+		}
+		if v := p.Authorization(); v != tst.expected {
+			t.Errorf("Got %q for %q, expected %q", v, tst.spec, tst.expected)
+		}
+	}
+	if p, err := Parse(""); p != nil || err != nil {
+		t.Errorf("Expected nil provider for empty spec, got %v %v", p, err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	prev := FileCheckInterval
+	FileCheckInterval = 10 * time.Millisecond
+	defer func() { FileCheckInterval = prev }()
+	if _, err := Parse("file:/does/not/exist"); err == nil {
+		t.Errorf("Expected error for missing token file")
+	}
+	f, err := ioutil.TempFile("", "fortio-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("token1\n")
+	f.Close()
+	p, err := Parse("file:" + f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.Authorization(); v != "Bearer token1" {
+		t.Errorf("Got %q, expected first token", v)
+	}
+	if err = ioutil.WriteFile(f.Name(), []byte("token2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes even on coarse grained file systems
+	later := time.Now().Add(2 * time.Second)
+	_ = os.Chtimes(f.Name(), later, later)
+	for i := 0; i < 100 && p.Authorization() != "Bearer token2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := p.Authorization(); v != "Bearer token2" {
+		t.Errorf("Got %q, expected rotated token", v)
+	}
+	os.Remove(f.Name())
+	time.Sleep(50 * time.Millisecond)
+	if v := p.Authorization(); v != "Bearer token2" {
+		t.Errorf("Got %q, expected previous token to be kept when the file is missing", v)
+	}
+}
+
+func TestOAuth2Provider(t *testing.T) {
+	var lock sync.Mutex
+	count := 0
+	fail := false
+	var delay time.Duration
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_id") != "id1" ||
+			r.FormValue("client_secret") != "s3cr3t" || r.FormValue("scope") != "a b" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		d := delay
+		lock.Unlock()
+		time.Sleep(d)
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		count++
+		fmt.Fprintf(w, `{"access_token":"tok%d","token_type":"bearer","expires_in":1}`, count)
+	}))
+	defer srv.Close()
+	defer func(d time.Duration) { RetryInterval = d }(RetryInterval)
+	RetryInterval = 200 * time.Millisecond
+	if _, err := Parse("oauth2:" + srv.URL + "/token?client_id=id1&client_secret=wrong"); err == nil {
+		t.Errorf("Expected error for rejected credentials")
+	}
+	p, err := Parse("oauth2:" + srv.URL + "/token?client_id=id1&client_secret=s3cr3t&scope=a+b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.Authorization(); v != "Bearer tok1" {
+		t.Errorf("Got %q, expected first token", v)
+	}
+	time.Sleep(900 * time.Millisecond) // after 80% of the 1s lifetime
+	if v := p.Authorization(); v != "Bearer tok2" {
+		t.Errorf("Got %q, expected refreshed token", v)
+	}
+	lock.Lock()
+	fail = true
+	lock.Unlock()
+	time.Sleep(900 * time.Millisecond)
+	if v := p.Authorization(); v != "Bearer tok2" {
+		t.Errorf("Got %q, expected previous token to be kept on refresh failure", v)
+	}
+	// a slow token endpoint doesn't delay the callers:
+	lock.Lock()
+	fail = false
+	delay = 2 * time.Second
+	lock.Unlock()
+	start := time.Now()
+	for time.Since(start) < 4*time.Second {
+		before := time.Now()
+		v := p.Authorization()
+		if elapsed := time.Since(before); elapsed > 100*time.Millisecond {
+			t.Fatalf("Authorization() took %v, should not wait for the token refresh", elapsed)
+		}
+		if v == "Bearer tok3" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("Expected token refreshed in the background")
+}
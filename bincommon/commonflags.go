@@ -72,6 +72,13 @@ var (
 	followRedirectsFlag = flag.Bool("L", false, "Follow redirects (implies -std-client) - do not use for load test")
 	userCredentialsFlag = flag.String("user", "", "User credentials for basic authentication (for http). Input data format"+
 		" should be `user:password`")
+	// Resolution of the http url host to all its addresses:
+	dnsMethodFlag = flag.String("dns-method", "",
+		"How each new http connection picks among all the resolved addresses of the url host: `method` first, round-robin "+
+			"or random (e.g. for headless services), with the calls per address in the results. Default is the first "+
+			"address for the fast client and the go resolver for the std client")
+	dnsRefreshFlag = flag.Duration("dns-refresh", 0,
+		"Re-resolve the url host every `duration` during the run and reconnect when its addresses change (implies -dns-method)")
 	// QuietFlag is the value of -quiet.
 	QuietFlag       = flag.Bool("quiet", false, "Quiet mode: sets the loglevel to Error and reduces the output.")
 	contentTypeFlag = flag.String("content-type", "",
@@ -81,6 +88,10 @@ var (
 		" must be smaller than -maxpayloadsizekb. Setting this switches http to POST.")
 	// PayloadFlag is the value of -payload.
 	PayloadFlag = flag.String("payload", "", "Payload string to send along")
+	// PayloadRegenerateFlag is the value of -payload-regenerate.
+	PayloadRegenerateFlag = flag.Bool("payload-regenerate", false,
+		"Send new random content, of the size of the payload (e.g. -payload-size), with each http request "+
+			"instead of the same payload for all of them")
 	// PayloadFileFlag is the value of -paylaod-file.
 	PayloadFileFlag = flag.String("payload-file", "", "File `path` to be use as payload (POST for http), replaces -payload when set.")
 	// UnixDomainSocket to use instead of regular host:port.
@@ -96,6 +107,10 @@ var (
 	CACertFlag = flag.String("cacert", "",
 		"`Path` to a custom CA certificate file to be used for the TLS client connections, "+
 			"if empty, use https:// prefix for standard internet/system CAs")
+	// SNIFlag is the flag for the server name to use in the TLS client connections.
+	SNIFlag = flag.String("sni", "",
+		"Server `name` to send as SNI and to verify the server certificate against in TLS client connections, "+
+			"instead of the url's host (or the Host header)")
 	// LogErrorsFlag determines if the non ok http error codes get logged as they occur or not.
 	LogErrorsFlag = flag.Bool("log-errors", true, "Log http non 2xx/418 error codes as they occur")
 	// RunIDFlag is optional RunID to be present in json results (and default json result filename if not 0).
@@ -183,9 +198,12 @@ func SharedHTTPOptions() *fhttp.HTTPOptions {
 	httpOpts.HTTPReqTimeOut = *httpReqTimeoutFlag
 	httpOpts.Insecure = TLSInsecure()
 	httpOpts.Resolve = *resolve
+	httpOpts.DNSMethod = *dnsMethodFlag
+	httpOpts.DNSRefresh = *dnsRefreshFlag
 	httpOpts.UserCredentials = *userCredentialsFlag
 	httpOpts.ContentType = *contentTypeFlag
 	httpOpts.Payload = fnet.GeneratePayload(*PayloadFileFlag, *PayloadSizeFlag, *PayloadFlag)
+	httpOpts.RegeneratePayload = *PayloadRegenerateFlag
 	httpOpts.UnixDomainSocket = *unixDomainSocketFlag
 	if *followRedirectsFlag {
 		httpOpts.FollowRedirects = true
@@ -194,6 +212,7 @@ func SharedHTTPOptions() *fhttp.HTTPOptions {
 	httpOpts.CACert = *CACertFlag
 	httpOpts.Cert = *CertFlag
 	httpOpts.Key = *KeyFlag
+	httpOpts.ServerName = *SNIFlag
 	httpOpts.LogErrors = *LogErrorsFlag
 	httpOpts.SequentialWarmup = *warmupFlag
 	return &httpOpts
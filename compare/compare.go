@@ -0,0 +1,242 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compare computes the differences between two saved fortio results
+// (qps, latency percentiles, error rate) and checks them against regression
+// thresholds, for before/after comparisons (fortio diff and the browse UI).
+package compare // import "fortio.org/fortio/compare"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"fortio.org/fortio/periodic"
+)
+
+// DefaultPercentiles are the percentiles compared when none are specified.
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// Result is the part of the json results, of any runner type, which is compared.
+type Result struct {
+	periodic.RunnerResults
+	RetCodes           map[string]int64 // http codes or grpc, tcp, etc... statuses
+	ValidationFailures int64
+	Payload            []byte // of the http, tcp, udp and websocket runs, for the matrix payload size axis
+}
+
+// ErrorCount returns the number of calls which didn't get a 2xx (or 418, as for the http
+// runner) http code or an OK (or SERVING) status, plus the validation failures
+// (implements periodic.HasErrorCount).
+func (r *Result) ErrorCount() int64 {
+	n := r.ValidationFailures
+	for k, count := range r.RetCodes {
+		if code, err := strconv.Atoi(k); err == nil && ((code >= 200 && code <= 299) || code == http.StatusTeapot) {
+			continue
+		}
+		if k == "OK" || k == "SERVING" {
+			continue
+		}
+		n += count
+	}
+	return n
+}
+
+// ErrorRate returns the fraction of the calls which failed.
+func (r *Result) ErrorRate() float64 {
+	if r.DurationHistogram.Count == 0 {
+		return 0
+	}
+	return float64(r.ErrorCount()) / float64(r.DurationHistogram.Count)
+}
+
+// Parse returns the Result from the json data of a run.
+func Parse(data []byte) (*Result, error) {
+	r := &Result{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	if r.DurationHistogram == nil {
+		return nil, fmt.Errorf("not a fortio result (no DurationHistogram)")
+	}
+	return r, nil
+}
+
+// ReadFile returns the Result saved (e.g. with -json) in the file.
+func ReadFile(fname string) (*Result, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return r, nil
+}
+
+// Thresholds are the maximum regressions from A to B, all as fractions (0.1 for 10%).
+// Negative values are not checked.
+type Thresholds struct {
+	MaxQPSDecrease       float64 // relative decrease of the actual qps
+	MaxLatencyIncrease   float64 // relative increase of the average and of each compared percentile
+	MaxErrorRateIncrease float64 // absolute increase of the error rate (e.g. 0.001 for 0.1 more % of errors)
+}
+
+// NoThresholds is the Thresholds checking nothing.
+var NoThresholds = Thresholds{MaxQPSDecrease: -1, MaxLatencyIncrease: -1, MaxErrorRateIncrease: -1}
+
+// Delta is the difference of one metric between the 2 results.
+type Delta struct {
+	Metric     string
+	A          float64 // latencies are in seconds, error rates are fractions
+	B          float64
+	Change     float64 // B - A
+	Relative   float64 // Change / A, 0 when A is 0
+	Regression bool    // the change is above the threshold
+}
+
+// Diff is the comparison of result B against the reference result A.
+type Diff struct {
+	A           string // ID of the reference (before) result
+	B           string // ID of the compared (after) result
+	Deltas      []Delta
+	Regressions []string // description of the thresholds exceeded, empty if none
+}
+
+func (d *Diff) add(metric string, a, b float64) *Delta {
+	delta := Delta{Metric: metric, A: a, B: b, Change: b - a}
+	if a != 0 {
+		delta.Relative = delta.Change / a
+	}
+	d.Deltas = append(d.Deltas, delta)
+	return &d.Deltas[len(d.Deltas)-1]
+}
+
+func (d *Diff) regression(delta *Delta, format string, args ...interface{}) {
+	delta.Regression = true
+	d.Regressions = append(d.Regressions, fmt.Sprintf(format, args...))
+}
+
+// Compare returns the differences from a to b for the calls count, qps, average,
+// percentiles (DefaultPercentiles if empty), max latency and error rate and the
+// regressions exceeding the thresholds t.
+func Compare(a, b *Result, percentiles []float64, t Thresholds) *Diff {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	d := &Diff{A: a.ID(), B: b.ID()}
+	ha, hb := a.DurationHistogram, b.DurationHistogram
+	d.add("calls", float64(ha.Count), float64(hb.Count))
+	qps := d.add("qps", a.ActualQPS, b.ActualQPS)
+	if t.MaxQPSDecrease >= 0 && -qps.Relative > t.MaxQPSDecrease {
+		d.regression(qps, "qps decreased by %.3g%% (%.5g -> %.5g) > %.3g%%",
+			-100.*qps.Relative, qps.A, qps.B, 100.*t.MaxQPSDecrease)
+	}
+	latency := func(metric string, va, vb float64) {
+		l := d.add(metric, va, vb)
+		if t.MaxLatencyIncrease >= 0 && l.Relative > t.MaxLatencyIncrease {
+			d.regression(l, "%s latency increased by %.3g%% (%.3f ms -> %.3f ms) > %.3g%%",
+				metric, 100.*l.Relative, 1000.*l.A, 1000.*l.B, 100.*t.MaxLatencyIncrease)
+		}
+	}
+	latency("avg", ha.Avg, hb.Avg)
+	for _, p := range percentiles {
+		var pa, pb float64
+		if ha.Count > 0 {
+			pa = ha.CalcPercentile(p)
+		}
+		if hb.Count > 0 {
+			pb = hb.CalcPercentile(p)
+		}
+		latency("p"+periodic.PercentileString(p), pa, pb)
+	}
+	d.add("max", ha.Max, hb.Max)
+	errs := d.add("error rate", a.ErrorRate(), b.ErrorRate())
+	if t.MaxErrorRateIncrease >= 0 && errs.Change > t.MaxErrorRateIncrease {
+		d.regression(errs, "error rate increased by %.3g%% (%.3g%% -> %.3g%%) > %.3g%%",
+			100.*errs.Change, 100.*errs.A, 100.*errs.B, 100.*t.MaxErrorRateIncrease)
+	}
+	return d
+}
+
+func (d *Delta) format(v float64) string {
+	switch {
+	case d.Metric == "calls":
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	case d.Metric == "qps":
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	case d.Metric == "error rate":
+		return strconv.FormatFloat(100.*v, 'f', 3, 64) + " %"
+	}
+	return strconv.FormatFloat(1000.*v, 'f', 3, 64) + " ms"
+}
+
+// Print writes the differences as a table, the regressions being marked with a !,
+// followed by the list of regressions.
+func (d *Diff) Print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Comparing A: %s\n      to B: %s\n", d.A, d.B)
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(tw, "\tA\tB\tB-A\tchange\t\t")
+	for i := range d.Deltas {
+		delta := &d.Deltas[i]
+		change := "-"
+		if delta.A != 0 {
+			change = fmt.Sprintf("%+.1f %%", 100.*delta.Relative)
+		}
+		mark := ""
+		if delta.Regression {
+			mark = "!"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n", delta.Metric, delta.format(delta.A), delta.format(delta.B),
+			delta.format(delta.Change), change, mark)
+	}
+	_ = tw.Flush()
+	if len(d.Regressions) == 0 {
+		_, _ = fmt.Fprintln(out, "No regression")
+		return
+	}
+	_, _ = fmt.Fprintf(out, "%d regression(s):\n", len(d.Regressions))
+	for _, r := range d.Regressions {
+		_, _ = fmt.Fprintf(out, "  %s\n", r)
+	}
+}
+
+// ParseThreshold parses a threshold either as a fraction ("0.05") or a percentage
+// ("5%"), which unlike periodic.ParseRate can be above 100%. It returns -1 (not
+// checked) for an empty string.
+func ParseThreshold(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return -1, nil
+	}
+	div := 1.
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		div = 100.
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r < 0 {
+		return 0, fmt.Errorf("threshold %s should not be negative", s)
+	}
+	return r / div, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// result returns the json of an http like result with n calls of latency
+// seconds and errors 503s.
+func result(t *testing.T, n int, latency, qps float64, errors int64) []byte {
+	h := stats.NewHistogram(0, 0.0001)
+	for i := 0; i < n; i++ {
+		h.Record(latency)
+	}
+	r := struct {
+		periodic.RunnerResults
+		RetCodes map[int]int64
+	}{}
+	r.DurationHistogram = h.Export()
+	r.ActualQPS = qps
+	r.Labels = "test"
+	r.RetCodes = map[int]int64{200: int64(n) - errors, 503: errors}
+	data, err := json.Marshal(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestErrorCount(t *testing.T) {
+	r, err := Parse([]byte(`{"DurationHistogram":{"Count":10},"ValidationFailures":1,` +
+		`"RetCodes":{"200":3,"204":1,"418":1,"-1":1,"503":2,"OK":1,"SERVING":1,"Unavailable":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.ErrorCount(); n != 5 {
+		t.Errorf("Got %d errors, expected 5", n)
+	}
+	if rate := r.ErrorRate(); rate != 0.5 {
+		t.Errorf("Got %g error rate, expected 0.5", rate)
+	}
+	if _, err = Parse([]byte(`{"foo":42}`)); err == nil {
+		t.Errorf("Expected error for non fortio result")
+	}
+	if _, err = Parse([]byte(`not json`)); err == nil {
+		t.Errorf("Expected error for invalid json")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a, err := Parse(result(t, 100, 0.010, 100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse(result(t, 100, 0.012, 90, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Compare(a, b, nil, NoThresholds)
+	if len(d.Deltas) != 8 || len(d.Regressions) != 0 {
+		t.Errorf("Unexpected diff %+v", d)
+	}
+	qps := d.Deltas[1]
+	if qps.Metric != "qps" || qps.Change != -10 || qps.Relative != -0.1 {
+		t.Errorf("Unexpected qps delta %+v", qps)
+	}
+	p99 := d.Deltas[5]
+	if p99.Metric != "p99" || p99.Relative < 0.19 || p99.Relative > 0.21 {
+		t.Errorf("Unexpected p99 delta %+v", p99)
+	}
+	errs := d.Deltas[7]
+	if errs.Metric != "error rate" || errs.A != 0 || errs.B != 0.02 || errs.Relative != 0 {
+		t.Errorf("Unexpected error rate delta %+v", errs)
+	}
+	d = Compare(a, b, []float64{99.9}, Thresholds{MaxQPSDecrease: 0.05, MaxLatencyIncrease: 0.5, MaxErrorRateIncrease: 0.01})
+	if len(d.Regressions) != 2 || !d.Deltas[1].Regression || !d.Deltas[len(d.Deltas)-1].Regression {
+		t.Errorf("Expected qps and error rate regressions, got %+v", d)
+	}
+	d = Compare(a, b, nil, Thresholds{MaxQPSDecrease: -1, MaxLatencyIncrease: 0.1, MaxErrorRateIncrease: -1})
+	if len(d.Regressions) != 4 { // avg, p50, p90, p99
+		t.Errorf("Expected 4 latency regressions, got %v", d.Regressions)
+	}
+	var out bytes.Buffer
+	d.Print(&out)
+	if s := out.String(); !strings.Contains(s, "p99") || !strings.Contains(s, "12.000 ms") ||
+		!strings.Contains(s, "4 regression(s):\n  avg latency increased by 20%") {
+		t.Errorf("Unexpected diff table:\n%s", s)
+	}
+	d = Compare(b, b, nil, Thresholds{})
+	out.Reset()
+	d.Print(&out)
+	if !strings.Contains(out.String(), "No regression") {
+		t.Errorf("Expected no regression for identical results:\n%s", out.String())
+	}
+}
+
+func TestParseThreshold(t *testing.T) {
+	tests := []struct {
+		in  string
+		out float64
+		err bool
+	}{
+		{"", -1, false},
+		{"0.05", 0.05, false},
+		{"5%", 0.05, false},
+		{" 250% ", 2.5, false},
+		{"0", 0, false},
+		{"-1%", 0, true},
+		{"x", 0, true},
+	}
+	for _, tst := range tests {
+		r, err := ParseThreshold(tst.in)
+		if r != tst.out || (err != nil) != tst.err {
+			t.Errorf("ParseThreshold(%q) got %g, %v expected %g (error %v)", tst.in, r, err, tst.out, tst.err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in  string
+		out float64
+		err bool
+	}{
+		{"1024", 1024, false},
+		{"1k", 1024, false},
+		{"16KB", 16384, false},
+		{"2MiB", 2 << 20, false},
+		{" 0.5g ", 1 << 29, false},
+		{"k", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tst := range tests {
+		r, err := ParseSize(tst.in)
+		if r != tst.out || (err != nil) != tst.err {
+			t.Errorf("ParseSize(%q) got %g, %v expected %g (error %v)", tst.in, r, err, tst.out, tst.err)
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	mk := func(labels, requestedQPS string, actual, latency float64, payload int) *Result {
+		r, err := Parse(result(t, 10, latency, actual, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Labels = labels
+		r.RequestedQPS = requestedQPS
+		r.Payload = make([]byte, payload)
+		return r
+	}
+	names := []string{"a", "b", "c", "d", "e"}
+	results := []*Result{
+		mk("target=redis size=1k, host1", "200", 200, 0.002, 0),
+		mk("target=redis size=1k, host1", "100", 100, 0.001, 0),
+		mk("target=pg size=1k, host1", "100", 100, 0.003, 0),
+		mk("target=pg size=4k, host1", "max", 1234, 0.004, 10),
+		mk("no dimension", "100", 100, 0.001, 0),
+	}
+	m := NewMatrix(names, results, XQPS, nil, nil)
+	if len(m.Series) != 4 || m.Series[0].Group != "no dimension" || m.Series[3].Group != "target=redis size=1k host1" {
+		t.Fatalf("Unexpected qps series %+v", m.Series)
+	}
+	redis := m.Series[3].Points
+	if len(redis) != 2 || redis[0].Name != "b" || redis[0].X != 100 || redis[1].X != 200 ||
+		redis[1].Percentiles["p99"] < 0.0019 || redis[1].Percentiles["p99"] > 0.0021 {
+		t.Errorf("Unexpected redis points %+v", redis)
+	}
+	if p := m.Series[2].Points[0]; m.Series[2].Group != "target=pg size=4k host1" || p.X != 1234 {
+		t.Errorf("Expected actual qps x for max qps run, got %+v", m.Series[2])
+	}
+	m = NewMatrix(names, results, "size", []string{"target"}, []float64{50})
+	if len(m.Series) != 2 || m.Series[0].Group != "target=pg" || len(m.Series[0].Points) != 2 ||
+		m.Series[0].Points[1].X != 4096 || len(m.Skipped) != 1 || m.Skipped[0] != "e" ||
+		len(m.Series[0].Points[0].Percentiles) != 1 {
+		t.Errorf("Unexpected size series %+v", m)
+	}
+	m = NewMatrix(names, results, XPayload, []string{"target"}, nil)
+	if len(m.Series) != 3 || m.Series[1].Points[1].X != 10 {
+		t.Errorf("Unexpected payload series %+v", m)
+	}
+}
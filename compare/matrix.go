@@ -0,0 +1,187 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matrix x axes other than the labels keys.
+const (
+	XQPS     = "qps"     // requested qps (the actual one for max qps runs)
+	XPayload = "payload" // payload size: the "payload" label if set, else the size of the run's payload
+)
+
+// MatrixPoint is one run of a matrix Series.
+type MatrixPoint struct {
+	Name        string // of the saved result
+	X           float64
+	ActualQPS   float64
+	Avg         float64 // latencies are in seconds
+	Percentiles map[string]float64
+	ErrorRate   float64
+}
+
+// Series are the runs of a group (same labels other than the x axis) sorted by X.
+type Series struct {
+	Group  string // e.g. "capability=state target=redis"
+	Points []MatrixPoint
+}
+
+// Matrix is a campaign of runs (e.g. latency vs qps or payload size for several
+// targets, as told apart by their labels) grouped into series to be charted together.
+type Matrix struct {
+	X       string
+	GroupBy []string `json:",omitempty"` // the labels keys defining the groups, all of them when empty
+	Series  []Series
+	Skipped []string `json:",omitempty"` // results without an X value
+}
+
+// labelTokensRegex splits the labels on spaces and commas.
+var labelTokensRegex = regexp.MustCompile(`[\s,]+`)
+
+// ParseLabels returns the key=value dimensions of labels, e.g.
+// "capability=state target=redis size=1k". Free text tokens are returned with an
+// empty value.
+func ParseLabels(labels string) [][2]string {
+	var res [][2]string
+	for _, tok := range labelTokensRegex.Split(strings.TrimSpace(labels), -1) {
+		if tok == "" {
+			continue
+		}
+		if i := strings.IndexByte(tok, '='); i > 0 {
+			res = append(res, [2]string{tok[:i], tok[i+1:]})
+		} else {
+			res = append(res, [2]string{tok, ""})
+		}
+	}
+	return res
+}
+
+// ParseSize parses a (payload) size like "1024", "1k", "16KB" or "2MiB", the suffixes
+// being powers of 1024.
+func ParseSize(s string) (float64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b"), "i")
+	mult := 1.
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			v = v[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return f * mult, nil
+}
+
+// payloadLengthRegex finds the payload size in grpc run types.
+var payloadLengthRegex = regexp.MustCompile(`PayloadLength=(\d+)`)
+
+// xValue returns the x axis value of the run, false if it doesn't have one.
+func xValue(r *Result, x string, labels [][2]string) (float64, bool) {
+	for _, kv := range labels {
+		if kv[0] == x && kv[1] != "" {
+			v, err := ParseSize(kv[1])
+			return v, err == nil
+		}
+	}
+	switch x {
+	case XQPS:
+		if qps, err := strconv.ParseFloat(r.RequestedQPS, 64); err == nil && qps > 0 {
+			return qps, true
+		}
+		return r.ActualQPS, true
+	case XPayload:
+		if m := payloadLengthRegex.FindStringSubmatch(r.RunType); m != nil {
+			v, _ := strconv.ParseFloat(m[1], 64)
+			return v, true
+		}
+		return float64(len(r.Payload)), true
+	}
+	return 0, false
+}
+
+// NewMatrix groups the runs by their labels, other than the x axis, or only the
+// groupBy labels keys if set, and sorts each group by the x axis value: XQPS, XPayload
+// or a labels key with a numerical (size) value. The percentiles of each run are
+// computed from its histogram (DefaultPercentiles if empty).
+func NewMatrix(names []string, results []*Result, x string, groupBy []string, percentiles []float64) *Matrix {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	m := &Matrix{X: x, GroupBy: groupBy}
+	keep := make(map[string]bool, len(groupBy))
+	for _, k := range groupBy {
+		keep[k] = true
+	}
+	index := make(map[string]int)
+	for i, r := range results {
+		labels := ParseLabels(r.Labels)
+		xv, ok := xValue(r, x, labels)
+		if !ok {
+			m.Skipped = append(m.Skipped, names[i])
+			continue
+		}
+		var group []string
+		for _, kv := range labels {
+			if kv[0] == x || (len(keep) > 0 && !keep[kv[0]]) {
+				continue
+			}
+			if kv[1] == "" {
+				group = append(group, kv[0])
+			} else {
+				group = append(group, kv[0]+"="+kv[1])
+			}
+		}
+		g := strings.Join(group, " ")
+		idx, found := index[g]
+		if !found {
+			idx = len(m.Series)
+			index[g] = idx
+			m.Series = append(m.Series, Series{Group: g})
+		}
+		p := MatrixPoint{
+			Name:        names[i],
+			X:           xv,
+			ActualQPS:   r.ActualQPS,
+			Avg:         r.DurationHistogram.Avg,
+			Percentiles: make(map[string]float64, len(percentiles)),
+			ErrorRate:   r.ErrorRate(),
+		}
+		for _, pct := range percentiles {
+			p.Percentiles["p"+strconv.FormatFloat(pct, 'g', -1, 64)] = r.DurationHistogram.CalcPercentile(pct)
+		}
+		m.Series[idx].Points = append(m.Series[idx].Points, p)
+	}
+	sort.Slice(m.Series, func(i, j int) bool { return m.Series[i].Group < m.Series[j].Group })
+	for _, s := range m.Series {
+		pts := s.Points
+		sort.SliceStable(pts, func(i, j int) bool { return pts[i].X < pts[j].X })
+	}
+	return m
+}
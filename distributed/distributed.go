@@ -0,0 +1,302 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package distributed runs an http load test over several fortio workers
+// (fortio servers, using their REST api) and merges their results.
+package distributed // import "fortio.org/fortio/distributed"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+const (
+	// RESTWorkersURI is the path, relative to the ui path, of the coordinator's workers list.
+	RESTWorkersURI = "rest/workers"
+	restRunURI     = "rest/run"
+	// WorkerTTL is how long a worker stays in the registry after its last registration.
+	WorkerTTL = 2 * time.Minute
+	// RegisterInterval is how often workers re-register with their coordinator.
+	RegisterInterval = 30 * time.Second
+)
+
+// Workers is the format of the workers files and of the coordinator's workers list:
+// the base urls of the fortio workers ui (e.g. http://worker1:8080/fortio/).
+type Workers struct {
+	Workers []string
+}
+
+// ReadWorkers returns the workers from source, either a json (not yaml) file with a Workers
+// object or a plain list of urls, or the url of a coordinator (e.g. http://coordinator:8080/fortio/).
+func ReadWorkers(source string) ([]string, error) {
+	var data []byte
+	var err error
+	lc := strings.ToLower(source)
+	if strings.HasPrefix(lc, "http://") || strings.HasPrefix(lc, "https://") {
+		data, err = get(strings.TrimSuffix(source, "/") + "/" + RESTWorkersURI)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var w Workers
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &w.Workers)
+	} else {
+		err = json.Unmarshal(data, &w)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid workers list from %s (expecting json, yaml isn't supported): %v", source, err)
+	}
+	if len(w.Workers) == 0 {
+		return nil, fmt.Errorf("no workers found in %s", source)
+	}
+	return w.Workers, nil
+}
+
+func get(u string) ([]byte, error) {
+	resp, err := http.Get(u) // nolint: gosec,noctx // url from the command line
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s replied %s: %s", u, resp.Status, fhttp.DebugSummary(data, 256))
+	}
+	return data, nil
+}
+
+// WorkerResults is the summary of the part of the run done by one worker.
+type WorkerResults struct {
+	URL       string
+	Calls     int64
+	ActualQPS float64
+	Errors    int64
+	Self      *periodic.SelfStats `json:",omitempty"` // the worker's own resources usage
+}
+
+// Results are the merged results of a distributed run, with the per worker summaries.
+type Results struct {
+	fhttp.HTTPRunnerResults
+	Workers []WorkerResults
+}
+
+// Run starts the http run described by the REST api params on all the workers, each
+// doing its share of the total "qps" and "n" (the other params are used as is), waits
+// for them to complete and returns the merged results. offset and resolution must match
+// the histograms of the workers. When "n" is lower than the number of workers, only the
+// first n workers are used (as a 0 "n" would be a duration based run).
+func Run(workers []string, params url.Values, percentiles []float64, offset, resolution float64) (*Results, error) {
+	qps, _ := strconv.ParseFloat(params.Get("qps"), 64)
+	n, _ := strconv.ParseInt(params.Get("n"), 10, 64)
+	if n > 0 && n < int64(len(workers)) {
+		log.Warnf("Only %d calls for %d workers, using the first %d workers", n, len(workers), n)
+		workers = workers[:n]
+	}
+	results := make([]*fhttp.HTTPRunnerResults, len(workers))
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		if qps > 0 {
+			p.Set("qps", strconv.FormatFloat(qps/float64(len(workers)), 'g', -1, 64))
+		}
+		if n > 0 {
+			share := n / int64(len(workers))
+			if int64(i) < n%int64(len(workers)) {
+				share++
+			}
+			p.Set("n", strconv.FormatInt(share, 10))
+		}
+		u := strings.TrimSuffix(w, "/") + "/" + restRunURI + "?" + p.Encode()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			log.Infof("Starting run on worker %s", u)
+			data, err := get(u)
+			if err == nil {
+				results[i] = &fhttp.HTTPRunnerResults{}
+				err = json.Unmarshal(data, results[i])
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("worker %s: %v", workers[i], err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := Merge(results, percentiles, offset, resolution)
+	for i, r := range results {
+		res.Workers = append(res.Workers, WorkerResults{
+			URL:       workers[i],
+			Calls:     r.DurationHistogram.Count,
+			ActualQPS: r.ActualQPS,
+			Errors:    r.ErrorCount(),
+			Self:      r.Self,
+		})
+	}
+	return res, nil
+}
+
+// Merge merges the results of the workers' runs: the histograms are merged at the
+// bucket level (so offset and resolution must be the ones of the duration histograms),
+// the counts and qps are summed.
+func Merge(results []*fhttp.HTTPRunnerResults, percentiles []float64, offset, resolution float64) *Results {
+	total := &Results{}
+	t := &total.HTTPRunnerResults
+	first := results[0]
+	t.HTTPOptions = first.HTTPOptions
+	t.RunType = first.RunType
+	t.Labels = first.Labels
+	t.StartTime = first.StartTime
+	t.RequestedDuration = first.RequestedDuration
+	t.Version = first.Version
+	t.Jitter = first.Jitter
+	t.Uniform = first.Uniform
+	t.NoCatchUp = first.NoCatchUp
+	t.Expect = first.Expect
+	t.RetCodes = make(map[int]int64)
+	duration := stats.NewHistogram(offset, resolution)
+	sizes := stats.NewHistogram(0, 100) // same as in fhttp.RunHTTPTest
+	headerSizes := stats.NewHistogram(0, 5)
+	handshakes := stats.NewHistogram(offset, resolution)
+	requestedQPS := 0.
+	for _, r := range results {
+		if r.StartTime.Before(t.StartTime) {
+			t.StartTime = r.StartTime
+		}
+		if r.ActualDuration > t.ActualDuration {
+			t.ActualDuration = r.ActualDuration
+		}
+		if qps, err := strconv.ParseFloat(r.RequestedQPS, 64); err == nil {
+			requestedQPS += qps
+		}
+		t.ActualQPS += r.ActualQPS
+		t.NumThreads += r.NumThreads
+		t.Exactly += r.Exactly
+		t.WarmupCalls += r.WarmupCalls
+		t.SocketCount += r.SocketCount
+		t.ValidationFailures += r.ValidationFailures
+		for code, count := range r.RetCodes {
+			t.RetCodes[code] += count
+		}
+		if r.DurationHistogram != nil {
+			duration.MergeData(r.DurationHistogram)
+		}
+		if r.Sizes != nil {
+			sizes.MergeData(r.Sizes)
+		}
+		if r.HeaderSizes != nil {
+			headerSizes.MergeData(r.HeaderSizes)
+		}
+		if r.TLSHandshakes != nil {
+			handshakes.MergeData(r.TLSHandshakes)
+		}
+	}
+	t.RequestedQPS = first.RequestedQPS // "max"
+	if requestedQPS > 0 {
+		t.RequestedQPS = strconv.FormatFloat(requestedQPS, 'g', -1, 64)
+	}
+	t.RunType += fmt.Sprintf(" distributed over %d workers", len(results))
+	t.DurationHistogram = duration.Export().CalcPercentiles(percentiles)
+	t.Sizes = sizes.Export()
+	t.HeaderSizes = headerSizes.Export()
+	if handshakes.Count > 0 {
+		t.TLSHandshakes = handshakes.Export().CalcPercentiles(percentiles)
+	}
+	return total
+}
+
+// Registry is the coordinator's list of workers which registered recently.
+type Registry struct {
+	lock    sync.Mutex
+	workers map[string]time.Time // last registration
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{workers: make(map[string]time.Time)}
+}
+
+// Register adds or refreshes the worker.
+func (r *Registry) Register(worker string) {
+	r.lock.Lock()
+	if _, found := r.workers[worker]; !found {
+		log.Infof("New worker %s", worker)
+	}
+	r.workers[worker] = time.Now()
+	r.lock.Unlock()
+}
+
+// Workers returns the sorted list of the workers registered in the last WorkerTTL.
+func (r *Registry) Workers() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := []string{}
+	for w, last := range r.workers {
+		if time.Since(last) > WorkerTTL {
+			delete(r.workers, w)
+			continue
+		}
+		res = append(res, w)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// RegisterWith registers the worker (its advertised ui base url) with the
+// coordinator every RegisterInterval, forever.
+func RegisterWith(coordinator, worker string) {
+	u := strings.TrimSuffix(coordinator, "/") + "/" + RESTWorkersURI + "?url=" + url.QueryEscape(worker)
+	for {
+		resp, err := http.Post(u, "", nil) // nolint: gosec,noctx // url from the command line
+		if err != nil {
+			log.Warnf("Unable to register with coordinator %s: %v", coordinator, err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Warnf("Registration with coordinator %s failed: %s", coordinator, resp.Status)
+			} else {
+				log.LogVf("Registered %s with coordinator %s", worker, coordinator)
+			}
+		}
+		time.Sleep(RegisterInterval)
+	}
+}
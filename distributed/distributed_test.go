@@ -0,0 +1,145 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distributed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"fortio.org/fortio/fhttp"
+)
+
+// fakeWorker runs the http tests it's asked to through its "REST api" (only
+// handling the url, qps and n params).
+func fakeWorker(t *testing.T, lock *sync.Mutex, calls map[string]int64) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fortio/rest/run" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		o := fhttp.HTTPRunnerOptions{}
+		o.URL = r.FormValue("url")
+		o.QPS, _ = strconv.ParseFloat(r.FormValue("qps"), 64)
+		o.Exactly, _ = strconv.ParseInt(r.FormValue("n"), 10, 64)
+		o.NumThreads = 2
+		res, err := fhttp.RunHTTPTest(&o)
+		if err != nil {
+			t.Errorf("Worker run error: %v", err)
+			return
+		}
+		lock.Lock()
+		calls[srv.URL] = o.Exactly
+		lock.Unlock()
+		b, _ := json.Marshal(res)
+		_, _ = w.Write(b)
+	}))
+	return srv
+}
+
+func TestRun(t *testing.T) {
+	mux, addr := fhttp.DynamicHTTPServer(false)
+	mux.HandleFunc("/echo/", fhttp.EchoHandler)
+	var lock sync.Mutex
+	calls := make(map[string]int64)
+	w1 := fakeWorker(t, &lock, calls)
+	defer w1.Close()
+	w2 := fakeWorker(t, &lock, calls)
+	defer w2.Close()
+	workers := []string{w1.URL + "/fortio/", w2.URL + "/fortio"}
+	p := url.Values{}
+	p.Set("url", fmt.Sprintf("http://localhost:%d/echo/?status=503:10", addr.Port))
+	p.Set("qps", "200")
+	p.Set("n", "101")
+	res, err := Run(workers, p, []float64{50, 99}, 0, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls[w1.URL] != 51 || calls[w2.URL] != 50 {
+		t.Errorf("Expected the calls to be split 51/50, got %v", calls)
+	}
+	if res.DurationHistogram.Count != 101 || res.RetCodes[200]+res.RetCodes[503] != 101 || len(res.DurationHistogram.Percentiles) != 2 {
+		t.Errorf("Unexpected merged results %+v %v", res.DurationHistogram, res.RetCodes)
+	}
+	if res.RequestedQPS != "200" || res.NumThreads != 4 || res.Exactly != 101 || len(res.Workers) != 2 ||
+		res.Workers[0].Calls != 51 || res.Workers[0].Errors+res.Workers[1].Errors != res.RetCodes[503] {
+		t.Errorf("Unexpected merged results %+v", res)
+	}
+	if res.Sizes.Count != 101 || res.HeaderSizes.Count != 101 {
+		t.Errorf("Unexpected merged sizes %+v %+v", res.Sizes, res.HeaderSizes)
+	}
+	// fewer calls than workers: no worker gets a 0 (i.e timed run) share
+	w3 := fakeWorker(t, &lock, calls)
+	defer w3.Close()
+	lock.Lock()
+	for k := range calls {
+		delete(calls, k)
+	}
+	lock.Unlock()
+	p.Set("n", "2")
+	if res, err = Run(append(workers, w3.URL+"/fortio/"), p, nil, 0, 0.001); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[w1.URL] != 1 || calls[w2.URL] != 1 || res.DurationHistogram.Count != 2 || len(res.Workers) != 2 {
+		t.Errorf("Expected 1 call on each of the first 2 workers only, got %v %+v", calls, res.Workers)
+	}
+	if _, err = Run([]string{w1.URL + "/not-fortio/"}, p, nil, 0, 0.001); err == nil {
+		t.Errorf("Expected error for a failing worker")
+	}
+}
+
+func TestRegistryAndReadWorkers(t *testing.T) {
+	r := NewRegistry()
+	r.Register("http://b:8080/fortio/")
+	r.Register("http://a:8080/fortio/")
+	r.Register("http://b:8080/fortio/")
+	if w := r.Workers(); len(w) != 2 || w[0] != "http://a:8080/fortio/" {
+		t.Errorf("Unexpected workers %v", w)
+	}
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/fortio/"+RESTWorkersURI {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b, _ := json.Marshal(Workers{Workers: r.Workers()})
+		_, _ = w.Write(b)
+	}))
+	defer coordinator.Close()
+	w, err := ReadWorkers(coordinator.URL + "/fortio/")
+	if err != nil || len(w) != 2 {
+		t.Errorf("Unexpected workers from coordinator %v %v", w, err)
+	}
+	if _, err = ReadWorkers(coordinator.URL + "/other/"); err == nil {
+		t.Errorf("Expected error for bad coordinator url")
+	}
+	f, err := ioutil.TempFile("", "fortio-workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`["http://w1:8080/fortio/", "http://w2:8080/fortio/", "http://w3:8080/fortio/"]`)
+	f.Close()
+	if w, err = ReadWorkers(f.Name()); err != nil || len(w) != 3 {
+		t.Errorf("Unexpected workers from file %v %v", w, err)
+	}
+}
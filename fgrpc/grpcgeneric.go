@@ -0,0 +1,204 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"fortio.org/fortio/log"
+	protov1 "github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// genericMethod is a unary method of any service, resolved from descriptors
+// and called with dynamic messages.
+type genericMethod struct {
+	path string // as used on the wire: /package.Service/Method
+	desc protoreflect.MethodDescriptor
+}
+
+// splitMethod splits package.Service/Method (or package.Service.Method) into
+// the service full name and the method name.
+func splitMethod(method string) (string, string, error) {
+	method = strings.TrimPrefix(method, "/")
+	idx := strings.LastIndex(method, "/")
+	if idx < 0 {
+		idx = strings.LastIndex(method, ".")
+	}
+	if idx <= 0 || idx == len(method)-1 {
+		return "", "", fmt.Errorf("invalid grpc method %q, should be package.Service/Method", method)
+	}
+	return method[:idx], method[idx+1:], nil
+}
+
+// resolveMethod finds the descriptor of o.Method, either in the o.Proto file
+// or using server reflection on conn (with ctx, which can carry metadata).
+func resolveMethod(ctx context.Context, conn *grpc.ClientConn, o *GRPCRunnerOptions) (*genericMethod, error) {
+	svc, name, err := splitMethod(o.Method)
+	if err != nil {
+		return nil, err
+	}
+	var files *protoregistry.Files
+	if o.Proto != "" {
+		files, err = loadProto(o.Proto)
+	} else {
+		files, err = reflectDescriptors(ctx, conn, svc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(svc))
+	if err != nil {
+		return nil, fmt.Errorf("service %q not found: %v", svc, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a service", svc)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, fmt.Errorf("method %q not found in service %q", name, svc)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method %q is streaming, only unary methods are supported", o.Method)
+	}
+	return &genericMethod{path: "/" + svc + "/" + name, desc: md}, nil
+}
+
+// loadProto returns the descriptors of fname, a .proto file compiled using protoc (from
+// the PATH, with the file's directory as import path) or else a compiled descriptor set.
+func loadProto(fname string) (*protoregistry.Files, error) {
+	if !strings.HasSuffix(fname, ".proto") {
+		return loadDescriptorSet(fname)
+	}
+	protoc, err := exec.LookPath("protoc")
+	if err != nil {
+		return nil, fmt.Errorf("protoc is needed to compile %s (or use a descriptor set compiled elsewhere): %v", fname, err)
+	}
+	dir, err := ioutil.TempDir("", "fortio-proto")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "descriptor.protoset")
+	cmd := exec.Command(protoc, "--include_imports", "--descriptor_set_out="+out, "-I", filepath.Dir(fname), fname)
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("unable to compile %s with protoc: %v: %s", fname, err, strings.TrimSpace(string(b)))
+	}
+	log.LogVf("Compiled %s with %s", fname, protoc)
+	return loadDescriptorSet(out)
+}
+
+// loadDescriptorSet reads a compiled descriptor set, as produced by
+// protoc --include_imports --descriptor_set_out=file.
+func loadDescriptorSet(fname string) (*protoregistry.Files, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("%s isn't a descriptor set (nor a .proto file): %v", fname, err)
+	}
+	return protodesc.NewFiles(set)
+}
+
+// reflectDescriptors gets the file descriptor containing symbol, and all its dependencies,
+// from the server reflection service.
+func reflectDescriptors(ctx context.Context, conn *grpc.ClientConn, symbol string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("server reflection unavailable (use a .proto file or descriptor set instead): %v", err)
+	}
+	fds := make(map[string]*descriptorpb.FileDescriptorProto)
+	requested := make(map[string]bool)
+	req := &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	}
+	for req != nil {
+		if err = stream.Send(req); err != nil {
+			return nil, fmt.Errorf("server reflection unavailable (use a .proto file or descriptor set instead): %v", err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("server reflection unavailable (use a .proto file or descriptor set instead): %v", err)
+		}
+		if e := res.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("server reflection error for %v: %s", req.MessageRequest, e.ErrorMessage)
+		}
+		for _, b := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err = proto.Unmarshal(b, fd); err != nil {
+				return nil, err
+			}
+			log.LogVf("Got descriptor for %s from server reflection", fd.GetName())
+			fds[fd.GetName()] = fd
+		}
+		// Ask for the dependencies the server didn't already send, one at a time.
+		req = nil
+		for _, fd := range fds {
+			for _, dep := range fd.GetDependency() {
+				if _, found := fds[dep]; !found && !requested[dep] {
+					requested[dep] = true
+					req = &rpb.ServerReflectionRequest{
+						MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+					}
+					break
+				}
+			}
+			if req != nil {
+				break
+			}
+		}
+	}
+	_ = stream.CloseSend()
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range fds {
+		set.File = append(set.File, fd)
+	}
+	return protodesc.NewFiles(set)
+}
+
+// newRequest returns the request message, filled from the json data (if any).
+func (g *genericMethod) newRequest(data string) (protov1.Message, error) {
+	req := dynamicpb.NewMessage(g.desc.Input())
+	if data != "" {
+		if err := protojson.Unmarshal([]byte(data), req); err != nil {
+			return nil, fmt.Errorf("invalid json data for %s: %v", g.desc.Input().FullName(), err)
+		}
+	}
+	return protov1.MessageV1(req), nil
+}
+
+// newResponse returns an empty response message to unmarshal replies into.
+func (g *genericMethod) newResponse() protov1.Message {
+	return protov1.MessageV1(dynamicpb.NewMessage(g.desc.Output()))
+}
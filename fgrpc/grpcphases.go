@@ -0,0 +1,159 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/stats"
+	grpcstats "google.golang.org/grpc/stats"
+)
+
+// Phases of a unary grpc call, as observed from the client side, in order:
+// send is from the start of the call until the request is written (includes serialization),
+// wait is from the request being sent until the response headers arrive (network and server time),
+// receive is until the response payload is read and finish until the end of the call
+// (deserialization and trailers).
+const (
+	PhaseSend = iota
+	PhaseWait
+	PhaseReceive
+	PhaseFinish
+	numPhases
+)
+
+// PhaseNames are the names of the phases, indexed by the Phase* constants.
+var PhaseNames = [numPhases]string{"send", "wait", "receive", "finish"}
+
+// phaseTimer records the duration of each phase of the calls of one 'thread'. The
+// grpc stats callbacks run on the transport goroutines, hence the mutex.
+type phaseTimer struct {
+	mutex sync.Mutex
+	hists [numPhases]*stats.Histogram
+}
+
+func newPhaseTimer(offset, resolution float64) *phaseTimer {
+	pt := phaseTimer{}
+	for i := range pt.hists {
+		pt.hists[i] = stats.NewHistogram(offset, resolution)
+	}
+	return &pt
+}
+
+// reset clears the recorded phases.
+func (pt *phaseTimer) reset() {
+	pt.mutex.Lock()
+	for _, h := range pt.hists {
+		h.Reset()
+	}
+	pt.mutex.Unlock()
+}
+
+// transfer merges src into pt (and resets src).
+func (pt *phaseTimer) transfer(src *phaseTimer) {
+	src.mutex.Lock()
+	for i := range pt.hists {
+		pt.hists[i].Transfer(src.hists[i])
+	}
+	src.mutex.Unlock()
+}
+
+// phaseRPC is the state of one call, set in its context by TagRPC.
+type phaseRPC struct {
+	pt   *phaseTimer
+	last time.Time
+}
+
+// mark records the time elapsed since the previous event of the call as the given phase.
+// Phases which can't be observed (e.g. because of an error) are just skipped.
+func (p *phaseRPC) mark(phase int, t time.Time) {
+	p.pt.mutex.Lock()
+	defer p.pt.mutex.Unlock()
+	if p.last.IsZero() || t.IsZero() {
+		return
+	}
+	p.pt.hists[phase].Record(t.Sub(p.last).Seconds())
+	p.last = t
+}
+
+func (p *phaseRPC) begin(t time.Time) {
+	p.pt.mutex.Lock()
+	p.last = t
+	p.pt.mutex.Unlock()
+}
+
+type (
+	phaseCtxKey    struct{}
+	phaseRPCCtxKey struct{}
+)
+
+// phaseStatsHandler is the grpc stats.Handler feeding the phaseTimer found in the call's context.
+// It is stateless so it can be shared by all the streams of a connection: the per call
+// state is added to the context of each call by TagRPC.
+type phaseStatsHandler struct{}
+
+func (phaseStatsHandler) TagRPC(ctx context.Context, _ *grpcstats.RPCTagInfo) context.Context {
+	pt, ok := ctx.Value(phaseCtxKey{}).(*phaseTimer)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, phaseRPCCtxKey{}, &phaseRPC{pt: pt})
+}
+
+func (phaseStatsHandler) HandleRPC(ctx context.Context, s grpcstats.RPCStats) {
+	p, ok := ctx.Value(phaseRPCCtxKey{}).(*phaseRPC)
+	if !ok {
+		return
+	}
+	switch st := s.(type) {
+	case *grpcstats.Begin:
+		p.begin(st.BeginTime)
+	case *grpcstats.OutPayload:
+		p.mark(PhaseSend, st.SentTime)
+	case *grpcstats.InHeader:
+		p.mark(PhaseWait, time.Now())
+	case *grpcstats.InPayload:
+		p.mark(PhaseReceive, st.RecvTime)
+	case *grpcstats.End:
+		p.mark(PhaseFinish, st.EndTime)
+	}
+}
+
+func (phaseStatsHandler) TagConn(ctx context.Context, _ *grpcstats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (phaseStatsHandler) HandleConn(context.Context, grpcstats.ConnStats) {}
+
+// WritePhasesFolded writes the total time spent in each phase in the "folded stacks"
+// format (one `frame;frame value` line per phase, value in microseconds) which can be
+// aggregated and fed to flamegraph tools. Nothing is written if phases weren't recorded.
+func (grpcstate *GRPCRunnerResults) WritePhasesFolded(w io.Writer) error {
+	which := grpcstate.which()
+	for _, name := range PhaseNames {
+		h, found := grpcstate.Phases[name]
+		if !found {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "grpc;%s;%s %d\n", which, name, int64(h.Sum*1e6+0.5)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,22 +15,35 @@
 package fgrpc // import "fortio.org/fortio/fgrpc"
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"fortio.org/fortio/auth"
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+	"fortio.org/fortio/tracing"
+	protov1 "github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // Dial dials grpc using insecure or tls transport security when serverAddr
@@ -43,11 +56,19 @@ func Dial(o *GRPCRunnerOptions) (conn *grpc.ClientConn, err error) {
 		if err != nil {
 			return nil, err
 		}
-		tlsConfig.ServerName = o.CertOverride
+		if o.CertOverride != "" {
+			tlsConfig.ServerName = o.CertOverride
+		}
 		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
+	if o.RecordPhases {
+		opts = append(opts, grpc.WithStatsHandler(phaseStatsHandler{}))
+	}
+	if o.Auth != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(perRPCAuth{o.Auth}))
+	}
 	serverAddr := grpcDestination(o.Destination)
 	if o.UnixDomainSocket != "" {
 		log.Warnf("Using domain socket %v instead of %v for grpc connection", o.UnixDomainSocket, serverAddr)
@@ -72,10 +93,58 @@ type GRPCRunnerResults struct {
 	reqH        grpc_health_v1.HealthCheckRequest
 	clientP     PingServerClient
 	reqP        PingMessage
+	callOpts    []grpc.CallOption
+	metadata    metadata.MD
+	timeout     time.Duration
+	tracer      *tracing.Tracer
+	expect      *fhttp.Expectation
+	connIndex   int // index of the connection used by this 'thread' in Connections
+	peer        peer.Peer
+	phases      *phaseTimer
+	inflight    chan struct{} // client side limit of calls in flight on the connection shared by this 'thread'
+	queueWait   *stats.Histogram
+	stream      *streamState
+	conn        *grpc.ClientConn
+	generic     *genericMethod
+	reqG        protov1.Message
+	resG        protov1.Message
 	RetCodes    HealthResultMap
 	Destination string
 	Streams     int
 	Ping        bool
+	// Method is the generic method called, when set instead of ping or health.
+	Method string `json:",omitempty"`
+	// Peers is the count of calls per peer address, only set when CapturePeers is requested.
+	Peers HealthResultMap `json:",omitempty"`
+	// Phases has the client side per phase timing histograms (see PhaseNames), only set when RecordPhases is requested.
+	Phases map[string]*stats.HistogramData `json:",omitempty"`
+	// QueueWait is the histogram of time spent waiting for the per connection in flight limit, when set.
+	QueueWait *stats.HistogramData `json:",omitempty"`
+	// Connections is the distribution of clients ('threads') and calls over the grpc connections.
+	Connections []ConnectionStats `json:",omitempty"`
+	// MessageLatency is the histogram of per message latency, for streaming tests.
+	MessageLatency *stats.HistogramData `json:",omitempty"`
+	// Expect is the check of the (json form of the) responses, when set.
+	Expect string `json:",omitempty"`
+	// ValidationFailures is the number of successful calls whose response didn't match Expect.
+	ValidationFailures int64
+	// ServerTime has the server reported time and overhead histograms, when ServerTimeMetadata is set.
+	ServerTime    *fhttp.ServerTimeResults `json:",omitempty"`
+	serverTime    *fhttp.ServerTimeRecorder
+	serverTimeKey string
+	respHeader    metadata.MD
+	respTrailer   metadata.MD
+	// Retries has the first attempts latency and the retries counts, when a Retry policy is set.
+	Retries *periodic.RetryResults `json:",omitempty"`
+	retry   *periodic.RetryPolicy
+	retries *periodic.RetryRecorder
+	stop    chan struct{} // the run abort channel, to interrupt the retry backoffs
+}
+
+// ConnectionStats is the number of clients sharing a grpc connection and the calls they made.
+type ConnectionStats struct {
+	Clients int
+	Calls   int64
 }
 
 // Run exercises GRPC health check or ping at the target QPS.
@@ -84,26 +153,216 @@ func (grpcstate *GRPCRunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
 	var err error
 	var res interface{}
-	status := grpc_health_v1.HealthCheckResponse_SERVING
-	if grpcstate.Ping {
-		res, err = grpcstate.clientP.Ping(context.Background(), &grpcstate.reqP)
-	} else {
-		var r *grpc_health_v1.HealthCheckResponse
-		r, err = grpcstate.clientH.Check(context.Background(), &grpcstate.reqH)
-		if r != nil {
-			status = r.Status
-			res = r
-		}
+	ctx, cancel := grpcstate.callContext()
+	defer cancel()
+	if grpcstate.tracer != nil {
+		sc := grpcstate.tracer.NewSpanContext()
+		ctx = metadata.AppendToOutgoingContext(ctx, tracing.TraceparentHeader, sc.Traceparent())
+		start := time.Now()
+		defer func() {
+			grpcstate.tracer.End(&sc, "GRPC "+grpcstate.which(), start, time.Now(), err != nil,
+				tracing.Attribute{Key: "rpc.system", Value: "grpc"},
+				tracing.Attribute{Key: "net.peer.name", Value: grpcstate.Destination})
+		}()
+	}
+	if grpcstate.inflight != nil {
+		qStart := time.Now()
+		grpcstate.inflight <- struct{}{}
+		grpcstate.queueWait.Record(time.Since(qStart).Seconds())
+		defer func() { <-grpcstate.inflight }()
 	}
+	start := time.Now()
+	res, status, last, err := grpcstate.call(ctx, start)
 	log.Debugf("For %d (ping=%v) got %v %v", t, grpcstate.Ping, err, res)
+	if grpcstate.serverTime != nil && err == nil {
+		grpcstate.recordServerTime(last) // the server time is the one of the last attempt
+	}
+	if err == nil && grpcstate.expect != nil && !grpcstate.checkResponse(res) {
+		grpcstate.ValidationFailures++
+	}
+	if grpcstate.Peers != nil {
+		grpcstate.Peers[peerKey(&grpcstate.peer)]++
+		grpcstate.peer = peer.Peer{} // so a failed call doesn't get attributed to the previous peer
+	}
 	if err != nil {
 		log.Warnf("Error making grpc call: %v", err)
 		grpcstate.RetCodes[Error]++
+	} else if grpcstate.generic != nil {
+		grpcstate.RetCodes[codes.OK.String()]++
 	} else {
 		grpcstate.RetCodes[status.String()]++
 	}
 }
 
+// invoke makes one attempt of the call.
+func (grpcstate *GRPCRunnerResults) invoke(ctx context.Context) (interface{}, grpc_health_v1.HealthCheckResponse_ServingStatus, error) {
+	if grpcstate.generic != nil {
+		err := grpcstate.conn.Invoke(ctx, grpcstate.generic.path, grpcstate.reqG, grpcstate.resG, grpcstate.callOpts...)
+		return grpcstate.resG, grpc_health_v1.HealthCheckResponse_SERVING, err
+	}
+	if grpcstate.stream != nil {
+		return nil, grpc_health_v1.HealthCheckResponse_SERVING, grpcstate.runStream(ctx)
+	}
+	if grpcstate.Ping {
+		res, err := grpcstate.clientP.Ping(ctx, &grpcstate.reqP, grpcstate.callOpts...)
+		return res, grpc_health_v1.HealthCheckResponse_SERVING, err
+	}
+	r, err := grpcstate.clientH.Check(ctx, &grpcstate.reqH, grpcstate.callOpts...)
+	if r == nil {
+		return nil, grpc_health_v1.HealthCheckResponse_SERVING, err
+	}
+	return r, r.Status, err
+}
+
+// call makes the call, retrying the failed attempts as per the retry policy if set, and also
+// returns the duration of the last attempt. The retries share the call context, so the
+// CallTimeout deadline is for all the attempts.
+func (grpcstate *GRPCRunnerResults) call(ctx context.Context,
+	start time.Time) (interface{}, grpc_health_v1.HealthCheckResponse_ServingStatus, time.Duration, error) {
+	res, hs, err := grpcstate.invoke(ctx)
+	last := time.Since(start)
+	p := grpcstate.retry
+	if p == nil {
+		return res, hs, last, err
+	}
+	first := last
+	firstFailed := err != nil
+	retries := 0
+	for err != nil && retries+1 < p.MaxAttempts && ctx.Err() == nil {
+		code := status.Code(err)
+		if !p.ShouldRetry(code.String(), strconv.Itoa(int(code))) {
+			break
+		}
+		log.Debugf("Retrying grpc call which got %v", err)
+		w := p.Wait(retries)
+		grpcstate.retries.RecordWait(w)
+		select {
+		case <-ctx.Done(): // the call deadline, shared by the attempts, expired during the backoff
+		case <-grpcstate.stop: // aborted run
+		case <-time.After(w):
+			retries++
+			attemptStart := time.Now()
+			res, hs, err = grpcstate.invoke(ctx)
+			last = time.Since(attemptStart)
+			continue
+		}
+		break
+	}
+	grpcstate.retries.Record(first, firstFailed, retries, err == nil)
+	return res, hs, last, err
+}
+
+// recordServerTime records the server time found in the trailer, or in the header, of the call.
+func (grpcstate *GRPCRunnerResults) recordServerTime(d time.Duration) {
+	v := grpcstate.respTrailer.Get(grpcstate.serverTimeKey)
+	if len(v) == 0 {
+		v = grpcstate.respHeader.Get(grpcstate.serverTimeKey)
+	}
+	value := ""
+	if len(v) > 0 {
+		value = v[0]
+	}
+	grpcstate.serverTime.Record(value, d)
+	grpcstate.respHeader, grpcstate.respTrailer = nil, nil
+}
+
+// checkResponse returns true if the json form of the response matches the expectation.
+func (grpcstate *GRPCRunnerResults) checkResponse(res interface{}) bool {
+	m, ok := res.(protov1.Message)
+	if !ok {
+		return false
+	}
+	b, err := protojson.Marshal(protov1.MessageV2(m))
+	if err != nil {
+		log.Warnf("Unable to json serialize response: %v", err)
+		return false
+	}
+	// protojson output has random extra spaces, on purpose
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return false
+	}
+	if !grpcstate.expect.Check(buf.Bytes()) {
+		log.LogVf("Unexpected response %s", buf.Bytes())
+		return false
+	}
+	return true
+}
+
+// ResetStats clears the per call statistics, after the warmup (implements periodic.Resetter).
+func (grpcstate *GRPCRunnerResults) ResetStats() {
+	grpcstate.RetCodes = make(HealthResultMap)
+	grpcstate.ValidationFailures = 0
+	if grpcstate.Peers != nil {
+		grpcstate.Peers = make(HealthResultMap)
+	}
+	if grpcstate.phases != nil {
+		grpcstate.phases.reset()
+	}
+	if grpcstate.queueWait != nil {
+		grpcstate.queueWait.Reset()
+	}
+	if grpcstate.serverTime != nil {
+		grpcstate.serverTime.Reset()
+	}
+	if grpcstate.retries != nil {
+		grpcstate.retries.Reset()
+	}
+	if grpcstate.stream != nil {
+		grpcstate.stream.latency.Reset()
+	}
+}
+
+// ErrorCount returns the number of calls which failed, didn't get a SERVING
+// health status or got an unexpected response (implements periodic.HasErrorCount).
+func (grpcstate *GRPCRunnerResults) ErrorCount() int64 {
+	n := grpcstate.ValidationFailures
+	for k, count := range grpcstate.RetCodes {
+		if k != codes.OK.String() && k != grpc_health_v1.HealthCheckResponse_SERVING.String() {
+			n += count
+		}
+	}
+	return n
+}
+
+// ReturnCodes returns the number of calls by status (implements periodic.HasReturnCodes).
+func (grpcstate *GRPCRunnerResults) ReturnCodes() map[string]int64 {
+	return grpcstate.RetCodes
+}
+
+// callContext returns the context for a call, with the metadata, deadline and phase timer
+// when configured. The cancel function must be called when the call is done.
+func (grpcstate *GRPCRunnerResults) callContext() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if grpcstate.metadata != nil {
+		ctx = metadata.NewOutgoingContext(ctx, grpcstate.metadata)
+	}
+	if grpcstate.phases != nil {
+		ctx = context.WithValue(ctx, phaseCtxKey{}, grpcstate.phases)
+	}
+	if grpcstate.timeout > 0 {
+		return context.WithTimeout(ctx, grpcstate.timeout)
+	}
+	return ctx, func() {}
+}
+
+// parseMetadata parses the list of key:value metadata, keys can be repeated.
+func parseMetadata(list []string) (metadata.MD, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	md := metadata.MD{}
+	for _, kv := range list {
+		s := strings.SplitN(kv, ":", 2)
+		key := strings.TrimSpace(s[0])
+		if len(s) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid grpc metadata %q, should be key:value", kv)
+		}
+		md.Append(key, strings.TrimSpace(s[1]))
+	}
+	return md, nil
+}
+
 // GRPCRunnerOptions includes the base RunnerOptions plus grpc specific
 // options.
 type GRPCRunnerOptions struct {
@@ -118,6 +377,53 @@ type GRPCRunnerOptions struct {
 	CertOverride       string        // Override the cert virtual host of authority for testing
 	AllowInitialErrors bool          // whether initial errors don't cause an abort
 	UsePing            bool          // use our own Ping proto for grpc load instead of standard health check one.
+	CapturePeers       bool          // record which peer address served each call (adds a per call option).
+	RecordPhases       bool          // record the client side timing of each phase of the calls (see PhaseNames).
+	// Client side maximum number of calls in flight per connection, calls beyond it wait (0, the default, is unlimited).
+	MaxInflightPerConn int
+	StreamMode         string // "" for unary calls or one of StreamBidi, StreamClient or StreamServer (implies UsePing).
+	StreamMessages     int    // number of messages per stream (default 1).
+	StreamReuse        bool   // keep using the same bidi stream for all the calls of a 'thread' instead of one per call.
+	// Method to call (package.Service/Method) instead of ping or health, with dynamic messages described
+	// by the Proto file or, when empty, obtained using the server reflection service.
+	Method string
+	Proto  string // .proto file (compiled using protoc) or descriptor set (protoc --include_imports --descriptor_set_out).
+	Data   string // json request to send to Method.
+	// Metadata (key:value) to send with each call, keys can be repeated.
+	Metadata    []string
+	CallTimeout time.Duration // deadline of each call (default, 0, is no deadline).
+	// Number of connections the NumThreads clients are spread over (round robin), instead of
+	// the default of NumThreads connections each with Streams clients. Exclusive with Streams.
+	Connections int
+	// Optional, to send a new traceparent metadata with each call (and export the sampled ones as spans).
+	Tracer *tracing.Tracer
+	// Optional check of the json form of the unary calls responses, see fhttp.Expectation for the syntax.
+	Expect string
+	// Optional, to send the (possibly changing during the run) authorization metadata with each call.
+	Auth auth.Provider `json:"-"`
+	// Optional response metadata (trailer or header) key with the server processing time, see
+	// fhttp.ParseServerTime, to record along with the client minus server time overhead.
+	ServerTimeMetadata string
+	// Optional client side retries of the failed calls (enabled when MaxAttempts > 1).
+	Retry periodic.RetryPolicy
+}
+
+// perRPCAuth sends the current value of the auth.Provider as authorization metadata.
+type perRPCAuth struct {
+	provider auth.Provider
+}
+
+func (a perRPCAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	v := a.provider.Authorization()
+	if v == "" {
+		return nil, nil
+	}
+	return map[string]string{"authorization": v}, nil
+}
+
+// RequireTransportSecurity is false so tokens can also be sent to plaintext endpoints (e.g. a local sidecar).
+func (a perRPCAuth) RequireTransportSecurity() bool {
+	return false
 }
 
 // RunGRPCTest runs an http test and returns the aggregated stats.
@@ -126,11 +432,48 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 	if o.Streams < 1 {
 		o.Streams = 1
 	}
+	if err := validateStreamOptions(o); err != nil {
+		return nil, err
+	}
+	if o.Method != "" {
+		if o.UsePing || o.StreamMode != "" {
+			return nil, fmt.Errorf("a generic grpc method can't be combined with ping or streams")
+		}
+		svc, name, err := splitMethod(o.Method)
+		if err != nil {
+			return nil, err
+		}
+		o.Method = svc + "/" + name // normalized
+	}
+	if o.Connections > 0 && o.Streams > 1 {
+		return nil, fmt.Errorf("the number of connections and of streams per connection can't be both set")
+	}
+	if o.CallTimeout > 0 && o.StreamReuse {
+		return nil, fmt.Errorf("a call timeout can't be used with reused streams")
+	}
+	if o.ServerTimeMetadata != "" && o.StreamMode != "" {
+		return nil, fmt.Errorf("server time can't be used with streams")
+	}
+	md, err := parseMetadata(o.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	var expect *fhttp.Expectation
+	if o.Expect != "" {
+		if o.StreamMode != "" {
+			return nil, fmt.Errorf("expect can't be used with streams")
+		}
+		if expect, err = fhttp.ParseExpectation(o.Expect); err != nil {
+			return nil, err
+		}
+	}
 	if o.NumThreads < 1 {
 		// sort of todo, this redoing some of periodic normalize (but we can't use normalize which does too much)
 		o.NumThreads = periodic.DefaultRunnerOptions.NumThreads
 	}
-	if o.UsePing {
+	if o.Method != "" {
+		o.RunType = "GRPC " + o.Method
+	} else if o.UsePing {
 		o.RunType = "GRPC Ping"
 		if o.Delay > 0 {
 			o.RunType += fmt.Sprintf(" Delay=%v", o.Delay)
@@ -142,43 +485,113 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 	if pll > 0 {
 		o.RunType += fmt.Sprintf(" PayloadLength=%d", pll)
 	}
-	log.Infof("Starting %s test for %s with %d*%d threads at %.1f qps", o.RunType, o.Destination, o.Streams, o.NumThreads, o.QPS)
-	o.NumThreads *= o.Streams
+	if o.StreamMode != "" {
+		o.RunType += fmt.Sprintf(" Stream=%s Messages=%d", o.StreamMode, o.StreamMessages)
+		if o.StreamReuse {
+			o.RunType += " Reused"
+		}
+	}
+	if o.Connections > 0 {
+		log.Infof("Starting %s test for %s with %d threads over %d connections at %.1f qps",
+			o.RunType, o.Destination, o.NumThreads, o.Connections, o.QPS)
+	} else {
+		log.Infof("Starting %s test for %s with %d*%d threads at %.1f qps", o.RunType, o.Destination, o.Streams, o.NumThreads, o.QPS)
+		o.NumThreads *= o.Streams
+		o.Runners = nil // sized for the new NumThreads by NewPeriodicRunner (Normalize() may have been called already)
+	}
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads // may change
 	total := GRPCRunnerResults{
 		RetCodes:    make(HealthResultMap),
+		Expect:      o.Expect,
 		Destination: o.Destination,
 		Streams:     o.Streams,
 		Ping:        o.UsePing,
 	}
+	if o.CapturePeers {
+		total.Peers = make(HealthResultMap)
+	}
+	if o.RecordPhases {
+		total.phases = newPhaseTimer(r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
+	if o.ServerTimeMetadata != "" {
+		total.serverTime = fhttp.NewServerTimeRecorder(o.ServerTimeMetadata, r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
+	if o.Retry.MaxAttempts > 1 {
+		total.retry = &o.Retry
+		total.retries = periodic.NewRetryRecorder(r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
 	grpcstate := make([]GRPCRunnerResults, numThreads)
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
-	var conn *grpc.ClientConn
-	var err error
+	var conns []*grpc.ClientConn
+	var inflights []chan struct{}
+	var generic *genericMethod
+	if o.MaxInflightPerConn > 0 {
+		total.queueWait = stats.NewHistogram(0, r.Options().Resolution)
+	}
+	var msgLatency *stats.Histogram
+	if o.StreamMode != "" {
+		msgLatency = stats.NewHistogram(r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
 	ts := time.Now().UnixNano()
 	for i := 0; i < numThreads; i++ {
 		r.Options().Runners[i] = &grpcstate[i]
-		if (i % o.Streams) == 0 {
-			conn, err = Dial(o)
+		ci := i / o.Streams
+		if o.Connections > 0 {
+			ci = i % o.Connections
+		}
+		if ci == len(conns) {
+			conn, err := Dial(o)
 			if err != nil {
 				log.Errf("Error in grpc dial for %s %v", o.Destination, err)
 				return nil, err
 			}
+			conns = append(conns, conn)
+			var inflight chan struct{}
+			if o.MaxInflightPerConn > 0 {
+				inflight = make(chan struct{}, o.MaxInflightPerConn)
+			}
+			inflights = append(inflights, inflight)
+			if o.Method != "" && generic == nil {
+				if generic, err = resolveMethod(metadata.NewOutgoingContext(context.Background(), md), conn, o); err != nil {
+					log.Errf("Unable to resolve grpc method %s for %s: %v", o.Method, o.Destination, err)
+					return nil, err
+				}
+				total.Method = generic.path
+			}
 		} else {
-			log.Debugf("Reusing previous client connection for %d", i)
+			log.Debugf("Reusing previous client connection %d for %d", ci, i)
 		}
+		conn, inflight := conns[ci], inflights[ci]
+		grpcstate[i].connIndex = ci
 		grpcstate[i].Ping = o.UsePing
+		grpcstate[i].metadata = md
+		grpcstate[i].timeout = o.CallTimeout
+		grpcstate[i].tracer = o.Tracer
+		grpcstate[i].expect = expect
+		grpcstate[i].Destination = o.Destination // for the spans
+		grpcstate[i].Method = o.Method
+		ctx, cancel := grpcstate[i].callContext()
 		var err error
-		if o.UsePing { // nolint: nestif
+		if generic != nil { // nolint: nestif
+			grpcstate[i].conn = conn
+			grpcstate[i].generic = generic
+			if grpcstate[i].reqG, err = generic.newRequest(o.Data); err != nil {
+				return nil, err
+			}
+			grpcstate[i].resG = generic.newResponse()
+			if o.Exactly <= 0 {
+				err = conn.Invoke(ctx, generic.path, grpcstate[i].reqG, grpcstate[i].resG)
+			}
+		} else if o.UsePing {
 			grpcstate[i].clientP = NewPingServerClient(conn)
 			if grpcstate[i].clientP == nil {
 				return nil, fmt.Errorf("unable to create ping client %d for %s", i, o.Destination)
 			}
 			grpcstate[i].reqP = PingMessage{Payload: o.Payload, DelayNanos: o.Delay.Nanoseconds(), Seq: int64(i), Ts: ts}
 			if o.Exactly <= 0 {
-				_, err = grpcstate[i].clientP.Ping(context.Background(), &grpcstate[i].reqP)
+				_, err = grpcstate[i].clientP.Ping(ctx, &grpcstate[i].reqP)
 			}
 		} else {
 			grpcstate[i].clientH = grpc_health_v1.NewHealthClient(conn)
@@ -187,15 +600,47 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 			}
 			grpcstate[i].reqH = grpc_health_v1.HealthCheckRequest{Service: o.Service}
 			if o.Exactly <= 0 {
-				_, err = grpcstate[i].clientH.Check(context.Background(), &grpcstate[i].reqH)
+				_, err = grpcstate[i].clientH.Check(ctx, &grpcstate[i].reqH)
 			}
 		}
+		cancel()
 		if !o.AllowInitialErrors && err != nil {
-			log.Errf("Error in first grpc call (ping = %v) for %s: %v", o.UsePing, o.Destination, err)
+			log.Errf("Error in first grpc call (%s) for %s: %v", o.RunType, o.Destination, err)
 			return nil, err
 		}
 		// Setup the stats for each 'thread'
 		grpcstate[i].RetCodes = make(HealthResultMap)
+		if o.CapturePeers {
+			grpcstate[i].Peers = make(HealthResultMap)
+			grpcstate[i].callOpts = append(grpcstate[i].callOpts, grpc.Peer(&grpcstate[i].peer))
+		}
+		if total.serverTime != nil {
+			grpcstate[i].serverTime = total.serverTime.Clone()
+			key, _ := fhttp.SplitServerTimeSource(o.ServerTimeMetadata)
+			grpcstate[i].serverTimeKey = strings.ToLower(key)
+			grpcstate[i].callOpts = append(grpcstate[i].callOpts,
+				grpc.Header(&grpcstate[i].respHeader), grpc.Trailer(&grpcstate[i].respTrailer))
+		}
+		if total.retries != nil {
+			grpcstate[i].retry = total.retry
+			grpcstate[i].stop = r.Options().Stop.StopChan
+			grpcstate[i].retries = total.retries.Clone()
+		}
+		if o.RecordPhases {
+			grpcstate[i].phases = newPhaseTimer(r.Options().Offset.Seconds(), r.Options().Resolution)
+		}
+		if inflight != nil {
+			grpcstate[i].inflight = inflight
+			grpcstate[i].queueWait = total.queueWait.Clone()
+		}
+		if msgLatency != nil {
+			grpcstate[i].stream = &streamState{
+				mode:     o.StreamMode,
+				messages: o.StreamMessages,
+				reuse:    o.StreamReuse,
+				latency:  msgLatency.Clone(),
+			}
+		}
 	}
 
 	if o.Profiler != "" {
@@ -226,29 +671,126 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 	// Numthreads may have reduced
 	numThreads = r.Options().NumThreads
 	keys := []string{}
+	total.Connections = make([]ConnectionStats, len(conns))
 	for i := 0; i < numThreads; i++ {
 		// Q: is there some copying each time stats[i] is used?
+		cs := &total.Connections[grpcstate[i].connIndex]
+		cs.Clients++
 		for k := range grpcstate[i].RetCodes {
 			if _, exists := total.RetCodes[k]; !exists {
 				keys = append(keys, k)
 			}
 			total.RetCodes[k] += grpcstate[i].RetCodes[k]
+			cs.Calls += grpcstate[i].RetCodes[k]
+		}
+		total.ValidationFailures += grpcstate[i].ValidationFailures
+		for k, v := range grpcstate[i].Peers {
+			total.Peers[k] += v
+		}
+		if o.RecordPhases {
+			total.phases.transfer(grpcstate[i].phases)
+		}
+		if grpcstate[i].queueWait != nil {
+			total.queueWait.Transfer(grpcstate[i].queueWait)
+		}
+		if grpcstate[i].serverTime != nil {
+			total.serverTime.Transfer(grpcstate[i].serverTime)
+		}
+		if grpcstate[i].retries != nil {
+			total.retries.Transfer(grpcstate[i].retries)
+		}
+		if s := grpcstate[i].stream; s != nil {
+			s.close()
+			msgLatency.Transfer(s.latency)
 		}
 		// TODO: if grpc client needs 'cleanup'/Close like http one, do it on original NumThreads
 	}
 	// Cleanup state:
 	r.Options().ReleaseRunners()
-	which := "Health"
-	if o.UsePing {
-		which = "Ping"
-	}
+	which := total.which()
 	_, _ = fmt.Fprintf(out, "Jitter: %t\n", total.Jitter)
 	for _, k := range keys {
 		_, _ = fmt.Fprintf(out, "%s %s : %d\n", which, k, total.RetCodes[k])
 	}
+	if expect != nil {
+		_, _ = fmt.Fprintf(out, "Validation failures (-expect %s) : %d\n", o.Expect, total.ValidationFailures)
+	}
+	callsPerConn := stats.Counter{}
+	for i, cs := range total.Connections {
+		if log.LogVerbose() {
+			_, _ = fmt.Fprintf(out, "Connection %d : %d clients, %d calls\n", i, cs.Clients, cs.Calls)
+		}
+		callsPerConn.Record(float64(cs.Calls))
+	}
+	if len(total.Connections) > 1 && log.Log(log.Warning) {
+		callsPerConn.Print(out, "Calls per connection")
+	}
+	if o.CapturePeers {
+		peers := make([]string, 0, len(total.Peers))
+		for k := range total.Peers {
+			peers = append(peers, k)
+		}
+		sort.Strings(peers)
+		for _, k := range peers {
+			_, _ = fmt.Fprintf(out, "Peer %s : %d\n", k, total.Peers[k])
+		}
+	}
+	if total.queueWait != nil {
+		total.QueueWait = total.queueWait.Export().CalcPercentiles(r.Options().Percentiles)
+		if log.LogVerbose() {
+			total.QueueWait.Print(out, "In flight limit queue wait Histogram")
+		} else if log.Log(log.Warning) {
+			total.queueWait.Counter.Print(out, fmt.Sprintf("In flight limit (%d per connection) queue wait", o.MaxInflightPerConn))
+		}
+	}
+	if msgLatency != nil {
+		total.MessageLatency = msgLatency.Export().CalcPercentiles(r.Options().Percentiles)
+		if log.LogVerbose() {
+			total.MessageLatency.Print(out, "Stream message latency Histogram")
+		} else if log.Log(log.Warning) {
+			msgLatency.Counter.Print(out, fmt.Sprintf("Stream (%s) message latency", o.StreamMode))
+		}
+	}
+	if o.RecordPhases {
+		total.Phases = make(map[string]*stats.HistogramData, numPhases)
+		for i, name := range PhaseNames {
+			h := total.phases.hists[i]
+			total.Phases[name] = h.Export().CalcPercentiles(r.Options().Percentiles)
+			if log.LogVerbose() {
+				total.Phases[name].Print(out, "Phase "+name+" Histogram")
+			} else if log.Log(log.Warning) {
+				h.Counter.Print(out, "Phase "+name)
+			}
+		}
+	}
+	if total.serverTime != nil {
+		total.ServerTime = total.serverTime.Results(out, o.ServerTimeMetadata, r.Options().Percentiles)
+	}
+	if total.retries != nil {
+		total.Retries = total.retries.Results(out, total.retry, r.Options().Percentiles)
+	}
 	return &total, nil
 }
 
+// which returns the kind of calls made, used to label the results.
+func (grpcstate *GRPCRunnerResults) which() string {
+	if grpcstate.Method != "" {
+		return strings.TrimPrefix(grpcstate.Method, "/")
+	}
+	if grpcstate.Ping {
+		return "Ping"
+	}
+	return "Health"
+}
+
+// peerKey returns the string used to aggregate calls per peer.
+func peerKey(p *peer.Peer) string {
+	if p == nil || p.Addr == nil {
+		return "unknown"
+	}
+	return p.Addr.String()
+}
+
 // grpcDestination parses dest and returns dest:port based on dest being
 // a hostname, IP address, hostname:port, or ip:port. The original dest is
 // returned if dest is an invalid hostname or invalid IP address. An http/https
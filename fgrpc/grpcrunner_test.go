@@ -16,7 +16,20 @@
 package fgrpc
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,7 +37,17 @@ import (
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 var (
@@ -399,3 +422,801 @@ func TestGRPCDestination(t *testing.T) {
 		}
 	}
 }
+
+func TestGRPCRunnerPeers(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "peers", 0)
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination:  destination,
+		UsePing:      true,
+		CapturePeers: true,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for k, v := range res.Peers {
+		if !strings.HasSuffix(k, fmt.Sprintf(":%d", port)) {
+			t.Errorf("Unexpected peer %q (%d calls), expecting port %d", k, v, port)
+		}
+		total += v
+	}
+	if total != res.DurationHistogram.Count {
+		t.Errorf("Peers %v total %d doesn't match call count %d", res.Peers, total, res.DurationHistogram.Count)
+	}
+	// Default is to not capture:
+	opts.CapturePeers = false
+	res, err = RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Peers != nil {
+		t.Errorf("Peers should not be captured by default, got %v", res.Peers)
+	}
+}
+
+func TestPeerKey(t *testing.T) {
+	fake := &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 50001}}
+	if k := peerKey(fake); k != "10.1.2.3:50001" {
+		t.Errorf("Unexpected key for fake peer: %q", k)
+	}
+	if k := peerKey(&peer.Peer{}); k != "unknown" {
+		t.Errorf("Unexpected key for empty peer: %q", k)
+	}
+	state := GRPCRunnerResults{Peers: make(HealthResultMap), RetCodes: make(HealthResultMap)}
+	state.Peers[peerKey(fake)]++
+	state.Peers[peerKey(fake)]++
+	if state.Peers["10.1.2.3:50001"] != 2 {
+		t.Errorf("Unexpected aggregation %v", state.Peers)
+	}
+}
+
+func TestGRPCRunnerPhases(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "phases", 0)
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        100,
+			Exactly:    10,
+			NumThreads: 2,
+		},
+		Destination:  destination,
+		UsePing:      true,
+		Delay:        10 * time.Millisecond,
+		RecordPhases: true,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range PhaseNames {
+		h := res.Phases[name]
+		if h == nil {
+			t.Fatalf("Missing phase %q in %v", name, res.Phases)
+		}
+		if h.Count != res.DurationHistogram.Count {
+			t.Errorf("Phase %q count %d doesn't match call count %d", name, h.Count, res.DurationHistogram.Count)
+		}
+	}
+	if wait := res.Phases["wait"].Min; wait < opts.Delay.Seconds() {
+		t.Errorf("Server delay %v should be accounted in the wait phase, got min %v", opts.Delay, wait)
+	}
+	var buf bytes.Buffer
+	if err = res.WritePhasesFolded(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(PhaseNames) || !strings.HasPrefix(lines[1], "grpc;Ping;wait ") {
+		t.Errorf("Unexpected folded output %q", buf.String())
+	}
+}
+
+// concurrencyPingSrv is a ping server tracking the maximum number of concurrent calls.
+type concurrencyPingSrv struct {
+	pingSrv // for the streaming methods
+	current int32
+	max     int32
+}
+
+func (s *concurrencyPingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
+	n := atomic.AddInt32(&s.current, 1)
+	for {
+		m := atomic.LoadInt32(&s.max)
+		if n <= m || atomic.CompareAndSwapInt32(&s.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(time.Duration(in.DelayNanos))
+	atomic.AddInt32(&s.current, -1)
+	return in, nil
+}
+
+func TestGRPCRunnerMaxInflight(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &concurrencyPingSrv{}
+	grpcServer := grpc.NewServer()
+	RegisterPingServerServer(grpcServer, srv)
+	go func() {
+		_ = grpcServer.Serve(socket)
+	}()
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        -1,
+			Exactly:    40,
+			NumThreads: 1,
+		},
+		Destination: socket.Addr().String(),
+		Streams:     8,
+		UsePing:     true,
+		Delay:       10 * time.Millisecond,
+	}
+	o1 := opts
+	res, err := RunGRPCTest(&o1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := atomic.LoadInt32(&srv.max); m <= 2 {
+		t.Errorf("Without limit, expected more than 2 concurrent calls, got %d", m)
+	}
+	if res.QueueWait != nil {
+		t.Errorf("Queue wait shouldn't be reported without limit: %+v", res.QueueWait)
+	}
+	atomic.StoreInt32(&srv.max, 0)
+	o2 := opts
+	o2.MaxInflightPerConn = 2
+	res, err = RunGRPCTest(&o2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := atomic.LoadInt32(&srv.max); m != 2 {
+		t.Errorf("Expected limit of 2 concurrent calls, got %d", m)
+	}
+	if res.QueueWait == nil || res.QueueWait.Count != res.DurationHistogram.Count {
+		t.Fatalf("Queue wait %+v should have one entry per call (%d)", res.QueueWait, res.DurationHistogram.Count)
+	}
+	if res.QueueWait.Max < opts.Delay.Seconds() {
+		t.Errorf("Some calls should have waited at least %v, got max %v", opts.Delay, res.QueueWait.Max)
+	}
+}
+
+func TestGRPCRunnerStreams(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "streams", 0)
+	destination := fmt.Sprintf("localhost:%d", port)
+	tests := []struct {
+		mode  string
+		reuse bool
+	}{
+		{StreamBidi, false},
+		{StreamBidi, true},
+		{StreamClient, false},
+		{StreamServer, false},
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        -1,
+				Exactly:    20,
+				NumThreads: 2,
+			},
+			Destination:    destination,
+			Payload:        "stream test",
+			StreamMode:     tst.mode,
+			StreamMessages: 5,
+			StreamReuse:    tst.reuse,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tst, err)
+		}
+		if !res.Ping {
+			t.Errorf("%+v: streams should imply ping", tst)
+		}
+		ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING.String()]
+		if ok != res.DurationHistogram.Count || res.RetCodes[Error] != 0 {
+			t.Errorf("%+v: unexpected ret codes %v for %d calls", tst, res.RetCodes, res.DurationHistogram.Count)
+		}
+		if res.MessageLatency == nil || res.MessageLatency.Count != 5*res.DurationHistogram.Count {
+			t.Errorf("%+v: expected 5 message latencies per call, got %+v for %d calls", tst, res.MessageLatency, res.DurationHistogram.Count)
+		}
+		if !strings.Contains(res.RunType, "Stream="+tst.mode+" Messages=5") {
+			t.Errorf("%+v: stream mode missing from run type %q", tst, res.RunType)
+		}
+	}
+}
+
+func TestGRPCRunnerStreamsInvalid(t *testing.T) {
+	invalid := []GRPCRunnerOptions{
+		{StreamMode: "foo"},
+		{StreamMode: StreamClient, StreamReuse: true},
+		{StreamMode: StreamBidi, StreamReuse: true, CapturePeers: true},
+		{StreamMode: StreamServer, RecordPhases: true},
+	}
+	for _, o := range invalid {
+		o := o
+		o.Destination = "localhost:1"
+		if _, err := RunGRPCTest(&o); err == nil {
+			t.Errorf("Expected error for %+v", o)
+		}
+	}
+}
+
+func TestSplitMethod(t *testing.T) {
+	tests := []struct {
+		input  string
+		svc    string
+		method string
+	}{
+		{"fgrpc.PingServer/Ping", "fgrpc.PingServer", "Ping"},
+		{"/fgrpc.PingServer/Ping", "fgrpc.PingServer", "Ping"},
+		{"grpc.health.v1.Health.Check", "grpc.health.v1.Health", "Check"},
+		{"Ping", "", ""},
+		{"fgrpc.PingServer/", "", ""},
+	}
+	for _, tst := range tests {
+		svc, method, err := splitMethod(tst.input)
+		if tst.svc == "" {
+			if err == nil {
+				t.Errorf("Expected error for %q, got %q %q", tst.input, svc, method)
+			}
+			continue
+		}
+		if err != nil || svc != tst.svc || method != tst.method {
+			t.Errorf("For %q got %q %q %v, expected %q %q", tst.input, svc, method, err, tst.svc, tst.method)
+		}
+	}
+}
+
+// writeDescriptorSet saves the descriptors of the file defining name, and its dependencies, to a temp file.
+func writeDescriptorSet(t *testing.T, name protoreflect.FullName) string {
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	var add func(f protoreflect.FileDescriptor)
+	add = func(f protoreflect.FileDescriptor) {
+		imports := f.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(f))
+	}
+	add(d.ParentFile())
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "test.protoset")
+	if err = ioutil.WriteFile(fname, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// fakeProtoc returns ping.proto, and when protoc isn't installed puts first in the PATH a
+// fake one, which only writes the descriptor set of ping.proto to --descriptor_set_out
+// (when the file to compile, last, exists).
+func fakeProtoc(t *testing.T) string {
+	if _, err := exec.LookPath("protoc"); err == nil {
+		return "ping.proto"
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("protoc isn't installed")
+	}
+	set := writeDescriptorSet(t, "fgrpc.PingServer")
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor a in \"$@\"; do case $a in --descriptor_set_out=*) out=${a#*=};; esac; done\n" +
+		"test -f \"$a\" && cp " + set + " \"$out\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "protoc"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	return "ping.proto"
+}
+
+func TestGRPCRunnerGeneric(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "generic", 0)
+	destination := fmt.Sprintf("localhost:%d", port)
+	tests := []struct {
+		method string
+		proto  string
+		data   string
+	}{
+		{"fgrpc.PingServer/Ping", "", `{"payload": "test", "delayNanos": "1000"}`},
+		{"grpc.health.v1.Health.Check", "", `{"service": "generic"}`},
+		{"fgrpc.PingServer/Ping", writeDescriptorSet(t, "fgrpc.PingServer"), `{"seq": 42}`},
+		{"grpc.health.v1.Health/Check", writeDescriptorSet(t, "grpc.health.v1.Health"), ""},
+		{"fgrpc.PingServer/Ping", fakeProtoc(t), `{"payload": "compiled"}`},
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 10,
+			},
+			Destination: destination,
+			Method:      tst.method,
+			Proto:       tst.proto,
+			Data:        tst.data,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tst, err)
+		}
+		if res.RetCodes["OK"] != res.DurationHistogram.Count || res.RetCodes[Error] != 0 {
+			t.Errorf("%+v: unexpected ret codes %v for %d calls", tst, res.RetCodes, res.DurationHistogram.Count)
+		}
+		if !strings.HasPrefix(res.Method, "/") || !strings.HasSuffix(res.RunType, strings.TrimPrefix(res.Method, "/")) {
+			t.Errorf("%+v: unexpected method %q / run type %q", tst, res.Method, res.RunType)
+		}
+	}
+	invalid := []GRPCRunnerOptions{
+		{Method: "fgrpc.PingServer/NoSuchMethod"},
+		{Method: "fgrpc.NoSuchService/Ping"},
+		{Method: "fgrpc.PingServer/PingStream"},
+		{Method: "fgrpc.PingServer/Ping", Data: `{"nosuchfield": 1}`},
+		{Method: "fgrpc.PingServer/Ping", Proto: "../missing/file.protoset"},
+		{Method: "fgrpc.PingServer/Ping", Proto: "../missing/file.proto"},
+		{Method: "fgrpc.PingServer/Ping", UsePing: true},
+	}
+	for _, o := range invalid {
+		o := o
+		o.Destination = destination
+		o.Exactly = 1
+		if _, err := RunGRPCTest(&o); err == nil {
+			t.Errorf("Expected error for %+v", o)
+		}
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	md, err := parseMetadata([]string{"Authorization: Bearer abc", "x-multi:1", "x-multi: 2", "x-empty:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := metadata.MD{
+		"authorization": []string{"Bearer abc"},
+		"x-multi":       []string{"1", "2"},
+		"x-empty":       []string{""},
+	}
+	if fmt.Sprint(md) != fmt.Sprint(expected) {
+		t.Errorf("Got %v expected %v", md, expected)
+	}
+	if md, err = parseMetadata(nil); md != nil || err != nil {
+		t.Errorf("Expected no metadata and no error, got %v %v", md, err)
+	}
+	for _, invalid := range []string{"novalue", ":value", " :value"} {
+		if _, err = parseMetadata([]string{invalid}); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+// metadataPingSrv is a ping server recording the metadata of the last call.
+type metadataPingSrv struct {
+	pingSrv
+	last atomic.Value
+}
+
+func (s *metadataPingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
+	md, _ := metadata.FromIncomingContext(c)
+	s.last.Store(md)
+	return s.pingSrv.Ping(c, in)
+}
+
+func TestGRPCRunnerMetadataAndTimeout(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &metadataPingSrv{}
+	grpcServer := grpc.NewServer()
+	RegisterPingServerServer(grpcServer, srv)
+	go func() {
+		_ = grpcServer.Serve(socket)
+	}()
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: socket.Addr().String(),
+		UsePing:     true,
+		Metadata:    []string{"dapr-api-token: xyz", "traceparent:00-abc-def-01"},
+		CallTimeout: time.Second,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Error] != 0 {
+		t.Errorf("Unexpected errors %v", res.RetCodes)
+	}
+	md, _ := srv.last.Load().(metadata.MD)
+	if v := md.Get("dapr-api-token"); len(v) != 1 || v[0] != "xyz" {
+		t.Errorf("Token metadata not received, got %v", md)
+	}
+	if v := md.Get("traceparent"); len(v) != 1 || v[0] != "00-abc-def-01" {
+		t.Errorf("Traceparent metadata not received, got %v", md)
+	}
+	// Calls slower than the timeout should all fail:
+	opts.Delay = 200 * time.Millisecond
+	opts.CallTimeout = 10 * time.Millisecond
+	res, err = RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Error] != res.DurationHistogram.Count {
+		t.Errorf("Expected all %d calls to timeout, got %v", res.DurationHistogram.Count, res.RetCodes)
+	}
+	if res.DurationHistogram.Max > 0.15 {
+		t.Errorf("Calls should have been cut short by the timeout, max is %v", res.DurationHistogram.Max)
+	}
+	opts.Metadata = []string{"invalid"}
+	if _, err = RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected error for invalid metadata")
+	}
+}
+
+func TestGRPCRunnerConnections(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "conns", 0)
+	destination := fmt.Sprintf("localhost:%d", port)
+	tests := []struct {
+		threads     int
+		streams     int
+		connections int
+		clients     []int
+	}{
+		{2, 3, 0, []int{3, 3}}, // default: one connection per thread, each with streams clients
+		{7, 1, 3, []int{3, 2, 2}},
+		{2, 1, 5, []int{1, 1}}, // can't have more connections than clients
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        -1,
+				Exactly:    50,
+				NumThreads: tst.threads,
+			},
+			Destination: destination,
+			UsePing:     true,
+			Streams:     tst.streams,
+			Connections: tst.connections,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tst, err)
+		}
+		if len(res.Connections) != len(tst.clients) {
+			t.Fatalf("%+v: got %d connections %+v", tst, len(res.Connections), res.Connections)
+		}
+		var calls int64
+		for i, cs := range res.Connections {
+			if cs.Clients != tst.clients[i] {
+				t.Errorf("%+v: connection %d has %d clients, expected %d", tst, i, cs.Clients, tst.clients[i])
+			}
+			calls += cs.Calls
+		}
+		if calls != res.DurationHistogram.Count {
+			t.Errorf("%+v: connections calls %+v don't add up to %d", tst, res.Connections, res.DurationHistogram.Count)
+		}
+	}
+	opts := GRPCRunnerOptions{Destination: destination, Streams: 2, Connections: 2}
+	if _, err := RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected error when setting both streams and connections")
+	}
+}
+
+func TestGRPCRunnerWarmup(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "warmup", 0)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:         -1,
+			Exactly:     10,
+			NumThreads:  2,
+			WarmupCalls: 20,
+		},
+		Destination:  fmt.Sprintf("localhost:%d", port),
+		UsePing:      true,
+		CapturePeers: true,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.WarmupCalls != 20 {
+		t.Errorf("Expected 20 warmup calls, got %d", res.WarmupCalls)
+	}
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING.String()]
+	var peers int64
+	for _, v := range res.Peers {
+		peers += v
+	}
+	if ok != 10 || peers != 10 || res.DurationHistogram.Count != 10 {
+		t.Errorf("Warmup calls shouldn't be counted, got %v %v for %d calls", res.RetCodes, res.Peers, res.DurationHistogram.Count)
+	}
+}
+
+func TestGRPCRunnerTracing(t *testing.T) {
+	socket, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &metadataPingSrv{}
+	grpcServer := grpc.NewServer()
+	RegisterPingServerServer(grpcServer, srv)
+	go func() {
+		_ = grpcServer.Serve(socket)
+	}()
+	defer grpcServer.Stop()
+	var exported int64
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		atomic.AddInt64(&exported, int64(strings.Count(string(b), `"name":"GRPC Ping"`)))
+	}))
+	defer collector.Close()
+	tracer := tracing.NewTracer(&tracing.Options{SampleRatio: 1, Endpoint: collector.URL})
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: socket.Addr().String(),
+		UsePing:     true,
+		Tracer:      tracer,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer.Close()
+	md, _ := srv.last.Load().(metadata.MD)
+	if v := md.Get(tracing.TraceparentHeader); len(v) != 1 || len(v[0]) != tracing.TraceparentLen {
+		t.Errorf("Traceparent metadata not received, got %v", md)
+	}
+	// the initial calls, made before the run, aren't traced
+	if exported != res.DurationHistogram.Count {
+		t.Errorf("Expected %d exported spans, got %d", res.DurationHistogram.Count, exported)
+	}
+}
+
+func TestGRPCRunnerExpect(t *testing.T) {
+	port := PingServerTCP("0", "", "", "expect", 0)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: fmt.Sprintf("localhost:%d", port),
+		UsePing:     true,
+		Payload:     "hello",
+		Expect:      "json:.payload=hello",
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ValidationFailures != 0 {
+		t.Errorf("Expected no validation failures, got %d", res.ValidationFailures)
+	}
+	opts.Expect = `regex:"payload":"bye"`
+	res, err = RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ValidationFailures != 10 || res.ErrorCount() != 10 {
+		t.Errorf("Expected 10 validation failures, got %d (errors %d)", res.ValidationFailures, res.ErrorCount())
+	}
+	// health check responses
+	opts.UsePing = false
+	opts.Expect = "json:.status=SERVING"
+	res, err = RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ValidationFailures != 0 {
+		t.Errorf("Expected no validation failures for health, got %d", res.ValidationFailures)
+	}
+}
+
+func TestGRPCRunnerServerTime(t *testing.T) {
+	port := PingServerTCP("0", "", "", "servertime", 0)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination:        fmt.Sprintf("localhost:%d", port),
+		UsePing:            true,
+		Delay:              10 * time.Millisecond,
+		ServerTimeMetadata: "Server-Timing",
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := res.ServerTime
+	if st == nil || st.Missing != 0 || st.Server.Count != 10 || st.Overhead.Count != 10 {
+		t.Fatalf("Unexpected server time results %+v", st)
+	}
+	if st.Server.Min < 0.010 || st.Server.Avg > res.DurationHistogram.Avg {
+		t.Errorf("Unexpected server time %+v vs client %+v", st.Server, res.DurationHistogram)
+	}
+	// health checks don't report it
+	opts.UsePing = false
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.ServerTime.Missing != 10 {
+		t.Errorf("Expected 10 missing server times for health checks, got %+v", res.ServerTime)
+	}
+	// nor the streams, whose trailer would grow with each message
+	conn, err := Dial(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := NewPingServerClient(conn).PingStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = stream.Send(&PingMessage{Seq: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = stream.CloseSend()
+	if _, err = stream.Recv(); err != io.EOF {
+		t.Fatalf("Expected end of stream, got %v", err)
+	}
+	if v := stream.Trailer().Get(ServerTimingKey); len(v) != 0 {
+		t.Errorf("Unexpected server timing trailer on the stream %v", v)
+	}
+}
+
+func TestPingServerInjection(t *testing.T) {
+	port := PingServerTCP("0", "", "", "injection", 0)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: fmt.Sprintf("localhost:%d", port),
+		UsePing:     true,
+		Metadata:    []string{"delay: 10ms..20ms", "status: unavailable", "size: 10"},
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Error] != 10 {
+		t.Errorf("Expected all 10 calls to fail, got %v", res.RetCodes)
+	}
+	if res.DurationHistogram.Min < 0.010 {
+		t.Errorf("Expected at least 10ms delay, got %+v", res.DurationHistogram)
+	}
+	opts.Metadata = []string{"status: 14:0,NOT_FOUND:0"}
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Error] != 0 {
+		t.Errorf("Expected no error for 0%% probabilities, got %v", res.RetCodes)
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	tests := []struct {
+		spec string
+		code codes.Code
+	}{
+		{"UNAVAILABLE", codes.Unavailable},
+		{"not_found", codes.NotFound},
+		{"14", codes.Unavailable},
+		{"0", codes.OK},
+		{"DEADLINE_EXCEEDED:100", codes.DeadlineExceeded},
+		{"14:0,5:100", codes.NotFound},
+		{"FOO", codes.OK},
+		{"42", codes.OK},
+	}
+	for _, tst := range tests {
+		if c := generateCode(tst.spec); c != tst.code {
+			t.Errorf("generateCode(%q) got %v expected %v", tst.spec, c, tst.code)
+		}
+	}
+}
+
+func TestGRPCRunnerStreamsNormalized(t *testing.T) {
+	port := PingServerTCP("0", "", "", "normalized", 0)
+	ro := periodic.RunnerOptions{QPS: 100, Exactly: 12, NumThreads: 2}
+	ro.Normalize() // as done by the REST api before the run
+	opts := GRPCRunnerOptions{
+		RunnerOptions: ro,
+		Destination:   fmt.Sprintf("localhost:%d", port),
+		UsePing:       true,
+		Streams:       3,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DurationHistogram.Count != 12 || res.RetCodes[Error] != 0 || res.NumThreads != 6 {
+		t.Errorf("Unexpected results %d calls, %d threads, %v", res.DurationHistogram.Count, res.NumThreads, res.RetCodes)
+	}
+}
+
+func TestGRPCRunnerRetry(t *testing.T) {
+	port := PingServerTCP("0", "", "", "retry", 0)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: fmt.Sprintf("localhost:%d", port),
+		UsePing:     true,
+		Metadata:    []string{"status: UNAVAILABLE"},
+		Retry:       periodic.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: []string{"UNAVAILABLE"}},
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := res.Retries
+	if res.RetCodes[Error] != 10 || rr == nil || rr.Retries != 20 || rr.RetriedCalls != 10 ||
+		rr.RecoveredCalls != 0 || rr.FirstAttemptErrors != 10 {
+		t.Errorf("Unexpected retry results %v %+v", res.RetCodes, rr)
+	}
+	opts.Retry.RetryOn = []string{"5", "DEADLINE_EXCEEDED"}
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.Retries.Retries != 0 || res.Retries.FirstAttemptErrors != 10 {
+		t.Errorf("Unexpected retries for not matching codes %+v", res.Retries)
+	}
+	opts.Retry.RetryOn = []string{"14"}
+	opts.Metadata = nil
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Error] != 0 || res.Retries.Retries != 0 || res.Retries.FirstAttemptErrors != 0 {
+		t.Errorf("Unexpected retries without errors %v %+v", res.RetCodes, res.Retries)
+	}
+	// aborting interrupts the backoffs:
+	opts.Metadata = []string{"status: UNAVAILABLE"}
+	opts.Retry.Backoff = time.Minute
+	stop := periodic.NewAborter()
+	opts.Stop = stop
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		stop.Abort()
+	}()
+	start := time.Now()
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second || res.Retries.Retries != 0 {
+		t.Errorf("Abort should interrupt the retry backoff, took %v: %+v", elapsed, res.Retries)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+// Streaming modes (values of GRPCRunnerOptions.StreamMode), using the matching
+// streaming methods of the ping service.
+const (
+	// StreamBidi sends each message and waits for its echo on a PingStream.
+	StreamBidi = "bidi"
+	// StreamClient sends the messages on a PingClientStream and waits for the single reply.
+	StreamClient = "client"
+	// StreamServer asks PingServerStream for the messages and reads them.
+	StreamServer = "server"
+)
+
+// streamState is the per 'thread' state of a streaming test.
+type streamState struct {
+	mode     string
+	messages int
+	reuse    bool
+	bidi     PingServer_PingStreamClient // reused bidi stream, when reuse is set
+	cancel   context.CancelFunc          // of the reused stream
+	latency  *stats.Histogram            // per message latency
+}
+
+// validateStreamOptions checks and normalizes the streaming options, if any.
+func validateStreamOptions(o *GRPCRunnerOptions) error {
+	switch o.StreamMode {
+	case "":
+		return nil
+	case StreamBidi, StreamClient, StreamServer:
+	default:
+		return fmt.Errorf("invalid grpc stream mode %q, should be one of %s, %s or %s",
+			o.StreamMode, StreamBidi, StreamClient, StreamServer)
+	}
+	if o.StreamReuse && o.StreamMode != StreamBidi {
+		return fmt.Errorf("stream reuse is only possible with the %s stream mode", StreamBidi)
+	}
+	if o.StreamReuse && o.CapturePeers {
+		return fmt.Errorf("peers can't be captured on reused streams")
+	}
+	if o.RecordPhases {
+		return fmt.Errorf("phases can only be recorded for unary calls, not streams")
+	}
+	if o.StreamMessages < 1 {
+		o.StreamMessages = 1
+	}
+	o.UsePing = true
+	return nil
+}
+
+// runStream does one streaming 'call' of the configured mode.
+func (grpcstate *GRPCRunnerResults) runStream(ctx context.Context) error {
+	s := grpcstate.stream
+	switch s.mode {
+	case StreamClient:
+		return grpcstate.clientStream(ctx)
+	case StreamServer:
+		return grpcstate.serverStream(ctx)
+	}
+	if !s.reuse {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := grpcstate.clientP.PingStream(ctx, grpcstate.callOpts...)
+		if err != nil {
+			return err
+		}
+		if err = grpcstate.bidiExchange(stream); err != nil {
+			return err
+		}
+		if err = stream.CloseSend(); err != nil {
+			return err
+		}
+		if _, err = stream.Recv(); err != io.EOF {
+			return fmt.Errorf("expected end of stream, got %v", err)
+		}
+		return nil
+	}
+	if s.bidi == nil {
+		var sctx context.Context
+		sctx, s.cancel = context.WithCancel(ctx)
+		stream, err := grpcstate.clientP.PingStream(sctx)
+		if err != nil {
+			s.close()
+			return err
+		}
+		s.bidi = stream
+	}
+	err := grpcstate.bidiExchange(s.bidi)
+	if err != nil {
+		s.close() // a new stream will be created by the next call
+	}
+	return err
+}
+
+// bidiExchange sends each message and waits for its echo, recording the round trip.
+func (grpcstate *GRPCRunnerResults) bidiExchange(stream PingServer_PingStreamClient) error {
+	s := grpcstate.stream
+	for i := 0; i < s.messages; i++ {
+		start := time.Now()
+		if err := stream.Send(&grpcstate.reqP); err != nil {
+			return err
+		}
+		if _, err := stream.Recv(); err != nil {
+			return err
+		}
+		s.latency.Record(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// clientStream sends the messages, recording the time to send each, then checks the reply.
+func (grpcstate *GRPCRunnerResults) clientStream(ctx context.Context) error {
+	s := grpcstate.stream
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := grpcstate.clientP.PingClientStream(ctx, grpcstate.callOpts...)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < s.messages; i++ {
+		start := time.Now()
+		if err = stream.Send(&grpcstate.reqP); err != nil {
+			return err
+		}
+		s.latency.Record(time.Since(start).Seconds())
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if int(res.StreamCount) != s.messages {
+		return fmt.Errorf("server received %d messages instead of %d", res.StreamCount, s.messages)
+	}
+	return nil
+}
+
+// serverStream asks for the messages and records the time until each arrives.
+func (grpcstate *GRPCRunnerResults) serverStream(ctx context.Context) error {
+	s := grpcstate.stream
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req := grpcstate.reqP
+	req.StreamCount = int32(s.messages)
+	last := time.Now()
+	stream, err := grpcstate.clientP.PingServerStream(ctx, &req, grpcstate.callOpts...)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for {
+		_, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		s.latency.Record(now.Sub(last).Seconds())
+		last = now
+		n++
+	}
+	if n != s.messages {
+		return fmt.Errorf("received %d messages instead of %d", n, s.messages)
+	}
+	return nil
+}
+
+// close ends the reused stream, if any.
+func (s *streamState) close() {
+	if s.bidi != nil {
+		_ = s.bidi.CloseSend()
+		s.bidi = nil
+	}
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
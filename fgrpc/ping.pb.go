@@ -38,10 +38,11 @@ var (
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type PingMessage struct {
-	Seq        int64  `protobuf:"varint,1,opt,name=seq" json:"seq,omitempty"`
-	Ts         int64  `protobuf:"varint,2,opt,name=ts" json:"ts,omitempty"`
-	Payload    string `protobuf:"bytes,3,opt,name=payload" json:"payload,omitempty"`
-	DelayNanos int64  `protobuf:"varint,4,opt,name=delayNanos" json:"delayNanos,omitempty"`
+	Seq         int64  `protobuf:"varint,1,opt,name=seq" json:"seq,omitempty"`
+	Ts          int64  `protobuf:"varint,2,opt,name=ts" json:"ts,omitempty"`
+	Payload     string `protobuf:"bytes,3,opt,name=payload" json:"payload,omitempty"`
+	DelayNanos  int64  `protobuf:"varint,4,opt,name=delayNanos" json:"delayNanos,omitempty"`
+	StreamCount int32  `protobuf:"varint,5,opt,name=streamCount" json:"streamCount,omitempty"`
 }
 
 func (m *PingMessage) Reset()                    { *m = PingMessage{} }
@@ -77,6 +78,13 @@ func (m *PingMessage) GetDelayNanos() int64 {
 	return 0
 }
 
+func (m *PingMessage) GetStreamCount() int32 {
+	if m != nil {
+		return m.StreamCount
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*PingMessage)(nil), "fgrpc.PingMessage")
 }
@@ -95,6 +103,12 @@ const _ = grpc.SupportPackageIsVersion4
 
 type PingServerClient interface {
 	Ping(ctx context.Context, in *PingMessage, opts ...grpc.CallOption) (*PingMessage, error)
+	// Echoes back each message of the stream.
+	PingStream(ctx context.Context, opts ...grpc.CallOption) (PingServer_PingStreamClient, error)
+	// Replies once, with the last message and the count received, when the client closes the stream.
+	PingClientStream(ctx context.Context, opts ...grpc.CallOption) (PingServer_PingClientStreamClient, error)
+	// Streams back streamCount copies of the message (with increasing seq).
+	PingServerStream(ctx context.Context, in *PingMessage, opts ...grpc.CallOption) (PingServer_PingServerStreamClient, error)
 }
 
 type pingServerClient struct {
@@ -114,10 +128,113 @@ func (c *pingServerClient) Ping(ctx context.Context, in *PingMessage, opts ...gr
 	return out, nil
 }
 
+func (c *pingServerClient) PingStream(ctx context.Context, opts ...grpc.CallOption) (PingServer_PingStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_PingServer_serviceDesc.Streams[0], c.cc, "/fgrpc.PingServer/PingStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pingServerPingStreamClient{stream}
+	return x, nil
+}
+
+type PingServer_PingStreamClient interface {
+	Send(*PingMessage) error
+	Recv() (*PingMessage, error)
+	grpc.ClientStream
+}
+
+type pingServerPingStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *pingServerPingStreamClient) Send(m *PingMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *pingServerPingStreamClient) Recv() (*PingMessage, error) {
+	m := new(PingMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pingServerClient) PingClientStream(ctx context.Context, opts ...grpc.CallOption) (PingServer_PingClientStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_PingServer_serviceDesc.Streams[1], c.cc, "/fgrpc.PingServer/PingClientStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pingServerPingClientStreamClient{stream}
+	return x, nil
+}
+
+type PingServer_PingClientStreamClient interface {
+	Send(*PingMessage) error
+	CloseAndRecv() (*PingMessage, error)
+	grpc.ClientStream
+}
+
+type pingServerPingClientStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *pingServerPingClientStreamClient) Send(m *PingMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *pingServerPingClientStreamClient) CloseAndRecv() (*PingMessage, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PingMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pingServerClient) PingServerStream(ctx context.Context, in *PingMessage, opts ...grpc.CallOption) (PingServer_PingServerStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_PingServer_serviceDesc.Streams[2], c.cc, "/fgrpc.PingServer/PingServerStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pingServerPingServerStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PingServer_PingServerStreamClient interface {
+	Recv() (*PingMessage, error)
+	grpc.ClientStream
+}
+
+type pingServerPingServerStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *pingServerPingServerStreamClient) Recv() (*PingMessage, error) {
+	m := new(PingMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for PingServer service
 
 type PingServerServer interface {
 	Ping(context.Context, *PingMessage) (*PingMessage, error)
+	// Echoes back each message of the stream.
+	PingStream(PingServer_PingStreamServer) error
+	// Replies once, with the last message and the count received, when the client closes the stream.
+	PingClientStream(PingServer_PingClientStreamServer) error
+	// Streams back streamCount copies of the message (with increasing seq).
+	PingServerStream(*PingMessage, PingServer_PingServerStreamServer) error
 }
 
 func RegisterPingServerServer(s *grpc.Server, srv PingServerServer) {
@@ -142,6 +259,79 @@ func _PingServer_Ping_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PingServer_PingStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PingServerServer).PingStream(&pingServerPingStreamServer{stream})
+}
+
+type PingServer_PingStreamServer interface {
+	Send(*PingMessage) error
+	Recv() (*PingMessage, error)
+	grpc.ServerStream
+}
+
+type pingServerPingStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *pingServerPingStreamServer) Send(m *PingMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *pingServerPingStreamServer) Recv() (*PingMessage, error) {
+	m := new(PingMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _PingServer_PingClientStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PingServerServer).PingClientStream(&pingServerPingClientStreamServer{stream})
+}
+
+type PingServer_PingClientStreamServer interface {
+	SendAndClose(*PingMessage) error
+	Recv() (*PingMessage, error)
+	grpc.ServerStream
+}
+
+type pingServerPingClientStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *pingServerPingClientStreamServer) SendAndClose(m *PingMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *pingServerPingClientStreamServer) Recv() (*PingMessage, error) {
+	m := new(PingMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _PingServer_PingServerStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PingMessage)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PingServerServer).PingServerStream(m, &pingServerPingServerStreamServer{stream})
+}
+
+type PingServer_PingServerStreamServer interface {
+	Send(*PingMessage) error
+	grpc.ServerStream
+}
+
+type pingServerPingServerStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *pingServerPingServerStreamServer) Send(m *PingMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _PingServer_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "fgrpc.PingServer",
 	HandlerType: (*PingServerServer)(nil),
@@ -151,23 +341,43 @@ var _PingServer_serviceDesc = grpc.ServiceDesc{
 			Handler:    _PingServer_Ping_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PingStream",
+			Handler:       _PingServer_PingStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PingClientStream",
+			Handler:       _PingServer_PingClientStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PingServerStream",
+			Handler:       _PingServer_PingServerStream_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "ping.proto",
 }
 
 func init() { proto.RegisterFile("ping.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 163 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2a, 0xc8, 0xcc, 0x4b,
-	0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x4d, 0x4b, 0x2f, 0x2a, 0x48, 0x56, 0xca, 0xe4,
-	0xe2, 0x0e, 0xc8, 0xcc, 0x4b, 0xf7, 0x4d, 0x2d, 0x2e, 0x4e, 0x4c, 0x4f, 0x15, 0x12, 0xe0, 0x62,
-	0x2e, 0x4e, 0x2d, 0x94, 0x60, 0x54, 0x60, 0xd4, 0x60, 0x0e, 0x02, 0x31, 0x85, 0xf8, 0xb8, 0x98,
-	0x4a, 0x8a, 0x25, 0x98, 0xc0, 0x02, 0x4c, 0x25, 0xc5, 0x42, 0x12, 0x5c, 0xec, 0x05, 0x89, 0x95,
-	0x39, 0xf9, 0x89, 0x29, 0x12, 0xcc, 0x0a, 0x8c, 0x1a, 0x9c, 0x41, 0x30, 0xae, 0x90, 0x1c, 0x17,
-	0x57, 0x4a, 0x6a, 0x4e, 0x62, 0xa5, 0x5f, 0x62, 0x5e, 0x7e, 0xb1, 0x04, 0x0b, 0x58, 0x07, 0x92,
-	0x88, 0x91, 0x1d, 0x17, 0x17, 0xc8, 0xaa, 0xe0, 0xd4, 0xa2, 0xb2, 0xd4, 0x22, 0x21, 0x03, 0x2e,
-	0x16, 0x10, 0x4f, 0x48, 0x48, 0x0f, 0xec, 0x10, 0x3d, 0x24, 0x57, 0x48, 0x61, 0x11, 0x53, 0x62,
-	0x48, 0x62, 0x03, 0x3b, 0xdc, 0x18, 0x10, 0x00, 0x00, 0xff, 0xff, 0x54, 0x22, 0xa0, 0xfe, 0xc6,
-	0x00, 0x00, 0x00,
+	// 219 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x91, 0xb1, 0x4a, 0x04, 0x31,
+	0x10, 0x86, 0x9d, 0xdd, 0x5b, 0xc5, 0x39, 0x90, 0x63, 0xaa, 0x60, 0x21, 0xe1, 0xaa, 0x54, 0xcb,
+	0xa2, 0x9d, 0x85, 0xcd, 0xd5, 0x8a, 0xac, 0x4f, 0x10, 0xbd, 0x31, 0x2c, 0xac, 0x49, 0x4c, 0xa2,
+	0x70, 0xcf, 0xe0, 0x1b, 0x5b, 0x49, 0xa2, 0x0b, 0x5b, 0x58, 0xdc, 0x76, 0x99, 0x0f, 0xbe, 0x9f,
+	0x0f, 0x82, 0xe8, 0x07, 0x6b, 0x5a, 0x1f, 0x5c, 0x72, 0xd4, 0xbc, 0x9a, 0xe0, 0x5f, 0xb6, 0x5f,
+	0x80, 0xeb, 0xc7, 0xc1, 0x9a, 0x7b, 0x8e, 0x51, 0x1b, 0xa6, 0x0d, 0xd6, 0x91, 0xdf, 0x05, 0x48,
+	0x50, 0x75, 0x9f, 0x9f, 0x74, 0x81, 0x55, 0x8a, 0xa2, 0x2a, 0xa0, 0x4a, 0x91, 0x04, 0x9e, 0x79,
+	0x7d, 0x18, 0x9d, 0xde, 0x8b, 0x5a, 0x82, 0x3a, 0xef, 0xa7, 0x93, 0xae, 0x10, 0xf7, 0x3c, 0xea,
+	0xc3, 0x83, 0xb6, 0x2e, 0x8a, 0x55, 0x31, 0x66, 0x84, 0x24, 0xae, 0x63, 0x0a, 0xac, 0xdf, 0x76,
+	0xee, 0xc3, 0x26, 0xd1, 0x48, 0x50, 0x4d, 0x3f, 0x47, 0xd7, 0xdf, 0x80, 0x98, 0x6b, 0x9e, 0x38,
+	0x7c, 0x72, 0xa0, 0x0e, 0x57, 0xf9, 0x22, 0x6a, 0x4b, 0x6c, 0x3b, 0x0b, 0xbd, 0xfc, 0x87, 0x6d,
+	0x4f, 0xe8, 0xf6, 0xcf, 0x2f, 0x9b, 0xc7, 0x7b, 0x0a, 0x3a, 0xa0, 0x3b, 0xdc, 0x64, 0xb8, 0x1b,
+	0x07, 0xb6, 0x69, 0xf9, 0xc2, 0xe4, 0xff, 0xb6, 0x2f, 0xf5, 0x3b, 0x78, 0x3e, 0x2d, 0x1f, 0x73,
+	0xf3, 0x33, 0x00, 0x53, 0xc2, 0x63, 0x5d, 0xa6, 0x01, 0x00, 0x00,
 }
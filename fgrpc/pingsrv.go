@@ -17,8 +17,12 @@ package fgrpc
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"fortio.org/fortio/fhttp"
@@ -27,10 +31,13 @@ import (
 	"fortio.org/fortio/stats"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -40,20 +47,151 @@ const (
 	Error = "ERROR"
 )
 
+// ServerTimingKey is the trailer the ping server reports its processing time in (Server-Timing syntax).
+const ServerTimingKey = "server-timing"
+
+// Request metadata keys to inject latency, errors and change the reply size of the
+// ping server calls, with the same syntax as the http echo server delay=, status=
+// (with grpc codes, by name or number, e.g. "UNAVAILABLE:10,DEADLINE_EXCEEDED:1")
+// and size= (payload size) query parameters.
+const (
+	DelayMetadataKey  = "delay"
+	StatusMetadataKey = "status"
+	SizeMetadataKey   = "size"
+)
+
+// generateCode returns the grpc code from a GenerateStatus like spec where the codes
+// can be names (as in the grpc spec, e.g. UNAVAILABLE or NOT_FOUND) or numbers.
+func generateCode(spec string) codes.Code {
+	entries := strings.Split(spec, ",")
+	for i, entry := range entries {
+		l2 := strings.SplitN(entry, ":", 2)
+		name := strings.TrimSpace(l2[0])
+		if _, err := strconv.Atoi(name); err == nil {
+			continue
+		}
+		var c codes.Code
+		if err := c.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil {
+			log.Warnf("Bad grpc status %q in %s: %v", name, spec, err)
+			return codes.OK
+		}
+		l2[0] = strconv.Itoa(int(c))
+		entries[i] = strings.Join(l2, ":")
+	}
+	code := fhttp.GenerateStatus(strings.Join(entries, ","))
+	if code == http.StatusOK {
+		return codes.OK // no hit (remainder of the probabilities)
+	}
+	if code < 0 || code > int(codes.Unauthenticated) {
+		log.Warnf("Invalid grpc status %d from %s", code, spec)
+		return codes.OK
+	}
+	return codes.Code(code)
+}
+
 type pingSrv struct{}
 
 func (s *pingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
 	log.LogVf("Ping called %+v (ctx %+v)", *in, c)
+	start := time.Now()
+	out, err := s.reply(c, in, start)
+	// Report the processing time, for clients comparing it to their latency (e.g. -server-time server-timing).
+	// Only for the unary calls: on streams the trailer would get one value per message.
+	_ = grpc.SetTrailer(c, metadata.Pairs(ServerTimingKey,
+		fmt.Sprintf("ping;dur=%g", float64(time.Since(start).Microseconds())/1000.)))
+	return out, err
+}
+
+// reply builds the reply to in, after the requested delays, with the requested payload
+// size or error status (from the metadata of c), for the unary and streaming pings.
+func (s *pingSrv) reply(c context.Context, in *PingMessage, start time.Time) (*PingMessage, error) {
 	out := *in // copy the input including the payload etc
-	out.Ts = time.Now().UnixNano()
+	out.Ts = start.UnixNano()
 	if in.DelayNanos > 0 {
 		s := time.Duration(in.DelayNanos)
 		log.LogVf("GRPC ping: sleeping for %v", s)
 		time.Sleep(s)
 	}
+	md, _ := metadata.FromIncomingContext(c)
+	if v := md.Get(DelayMetadataKey); len(v) > 0 {
+		if d := fhttp.GenerateDelay(v[0]); d > 0 {
+			log.LogVf("GRPC ping: sleeping for %v (metadata %s)", d, v[0])
+			time.Sleep(d)
+		}
+	}
+	if v := md.Get(SizeMetadataKey); len(v) > 0 {
+		if size := fhttp.GenerateSize(v[0]); size >= 0 {
+			out.Payload = string(fnet.Payload[:size])
+		}
+	}
+	var err error
+	if v := md.Get(StatusMetadataKey); len(v) > 0 {
+		if code := generateCode(v[0]); code != codes.OK {
+			err = status.Errorf(code, "fortio ping injected error (%s)", v[0])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 	return &out, nil
 }
 
+func (s *pingSrv) PingStream(stream PingServer_PingStreamServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		out, err := s.reply(stream.Context(), in, time.Now())
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(out); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *pingSrv) PingClientStream(stream PingServer_PingClientStreamServer) error {
+	last := &PingMessage{}
+	var n int32
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		last = in
+		n++
+	}
+	out, err := s.reply(stream.Context(), last, time.Now())
+	if err != nil {
+		return err
+	}
+	out.StreamCount = n
+	return stream.SendAndClose(out)
+}
+
+func (s *pingSrv) PingServerStream(in *PingMessage, stream PingServer_PingServerStreamServer) error {
+	log.LogVf("PingServerStream called %+v, will send %d messages", *in, in.StreamCount)
+	for i := int32(0); i < in.StreamCount; i++ {
+		out, err := s.reply(stream.Context(), in, time.Now())
+		if err != nil {
+			return err
+		}
+		out.Seq = in.Seq + int64(i)
+		if err := stream.Send(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // PingServer starts a grpc ping (and health) echo server.
 // returns the port being bound (useful when passing "0" as the port to
 // get a dynamic server). Pass the healthServiceName to use for the
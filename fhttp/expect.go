@@ -0,0 +1,151 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	expectRegexPrefix = "regex:"
+	expectJSONPrefix  = "json:"
+)
+
+// Expectation is a check of the response payloads (-expect), one of:
+// the exact expected bytes; "regex:" followed by a regular expression the
+// payload must match; "json:" followed by a path (e.g. .data.items[0].name)
+// which must be present and not null or empty in the json payload, optionally
+// followed by =value to check the value (strings are compared unquoted and
+// other values in their json form).
+type Expectation struct {
+	exact []byte
+	re    *regexp.Regexp
+	json  bool
+	path  []interface{} // string keys and int indexes
+	value *string
+}
+
+// ParseExpectation parses the -expect syntax described in Expectation.
+func ParseExpectation(s string) (*Expectation, error) {
+	switch {
+	case strings.HasPrefix(s, expectRegexPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(s, expectRegexPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect regex: %v", err)
+		}
+		return &Expectation{re: re}, nil
+	case strings.HasPrefix(s, expectJSONPrefix):
+		e := &Expectation{json: true}
+		p := strings.TrimPrefix(s, expectJSONPrefix)
+		if idx := strings.Index(p, "="); idx >= 0 {
+			v := p[idx+1:]
+			e.value = &v
+			p = p[:idx]
+		}
+		var err error
+		if e.path, err = parseJSONPath(p); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return &Expectation{exact: []byte(s)}, nil
+}
+
+// parseJSONPath parses .key.other[2].last (the leading . is optional) into its elements.
+func parseJSONPath(p string) ([]interface{}, error) {
+	var path []interface{}
+	orig := p
+	p = strings.TrimPrefix(strings.TrimSpace(p), ".")
+	for p != "" {
+		if p[0] == '[' {
+			end := strings.Index(p, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid json path %q: missing ]", orig)
+			}
+			idx, err := strconv.Atoi(p[1:end])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid json path %q: bad index %q", orig, p[1:end])
+			}
+			path = append(path, idx)
+			p = strings.TrimPrefix(p[end+1:], ".")
+			continue
+		}
+		end := strings.IndexAny(p, ".[")
+		if end < 0 {
+			end = len(p)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("invalid json path %q: empty key", orig)
+		}
+		path = append(path, p[:end])
+		p = strings.TrimPrefix(p[end:], ".")
+	}
+	return path, nil
+}
+
+// Check returns true if the payload matches the expectation.
+func (e *Expectation) Check(payload []byte) bool {
+	if e.re != nil {
+		return e.re.Match(payload)
+	}
+	if !e.json {
+		return bytes.Equal(payload, e.exact)
+	}
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return false
+	}
+	for _, p := range e.path {
+		switch k := p.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if v, ok = m[k]; !ok {
+				return false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || k >= len(a) {
+				return false
+			}
+			v = a[k]
+		}
+	}
+	if e.value != nil {
+		if s, ok := v.(string); ok {
+			return s == *e.value
+		}
+		b, _ := json.Marshal(v)
+		return string(b) == *e.value
+	}
+	switch t := v.(type) {
+	case nil:
+		return false
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+	return true
+}
@@ -26,14 +26,20 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"fortio.org/fortio/auth"
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+	"fortio.org/fortio/tracing"
 	"fortio.org/fortio/version"
 	"github.com/google/uuid"
 )
@@ -48,6 +54,37 @@ type Fetcher interface {
 	Close() int
 }
 
+const authorizationHeader = "Authorization"
+
+// setAuthorization sets (or removes when empty) the Authorization header.
+func setAuthorization(h http.Header, value string) {
+	if value == "" {
+		h.Del(authorizationHeader)
+		return
+	}
+	h.Set(authorizationHeader, value)
+}
+
+// authorizationLine returns the Authorization header line of the raw requests
+// (empty when value is).
+func authorizationLine(value string) []byte {
+	if value == "" {
+		return nil
+	}
+	return []byte(authorizationHeader + ": " + value + "\r\n")
+}
+
+// newPayloadRand returns the random source of the RegeneratePayload content of client id.
+func newPayloadRand(id int) *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))) // nolint: gosec // unique content, not crypto
+}
+
+// tlsHandshakeRecorder is implemented by the clients which can record the
+// duration of their TLS handshakes.
+type tlsHandshakeRecorder interface {
+	recordTLSHandshakes(h *stats.Histogram)
+}
+
 const (
 	uuidToken = "{uuid}"
 )
@@ -182,6 +219,89 @@ type HTTPOptions struct {
 	LogErrors        bool          // whether to log non 2xx code as they occur or not
 	ID               int           // id to use for logging (thread id when used as a runner)
 	SequentialWarmup bool          // whether to do http(s) runs warmup sequentially or in parallel (new default is //)
+	// Optional, to send a new traceparent with each request (and export the sampled ones as spans).
+	Tracer *tracing.Tracer `json:"-"`
+	// Optional, to set the (possibly changing during the run) Authorization header of each request.
+	Auth auth.Provider `json:"-"`
+	// RegeneratePayload makes each request send new random content, of the size of the Payload,
+	// instead of the same Payload (so it can't be deduplicated, cached or well compressed downstream).
+	RegeneratePayload bool `json:",omitempty"`
+	// How the address of each new connection is picked among the resolved addresses of the
+	// URL host: fnet.DNSFirst, DNSRoundRobin or DNSRandom. When empty (and DNSRefresh is 0) the
+	// fast client uses the first address and the std client the go resolver.
+	DNSMethod string `json:",omitempty"`
+	// Re-resolve the host every DNSRefresh during the run, the connections are then re-established
+	// when the addresses change (0, the default, is resolving once).
+	DNSRefresh time.Duration `json:",omitempty"`
+	resolvers  *dnsResolvers
+}
+
+// dnsResolvers are the resolvers of a load test run, one per hostname, shared by the clients
+// created with its http options and with the options derived from them (the scenarios ones).
+type dnsResolvers struct {
+	mutex  sync.Mutex
+	byHost map[string]*fnet.DNSResolver
+}
+
+func (d *dnsResolvers) get(hostname, method string, refresh time.Duration) (*fnet.DNSResolver, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if r, found := d.byHost[hostname]; found {
+		return r, nil
+	}
+	r, err := fnet.NewDNSResolver(hostname, method, refresh)
+	if err != nil {
+		return nil, err
+	}
+	if d.byHost == nil {
+		d.byHost = make(map[string]*fnet.DNSResolver)
+	}
+	d.byHost[hostname] = r
+	return r, nil
+}
+
+// stop ends the background refreshes of all the resolvers.
+func (d *dnsResolvers) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, r := range d.byHost {
+		r.Stop()
+	}
+}
+
+// results returns the resolutions summary of each host, sorted by hostname.
+func (d *dnsResolvers) results(percentiles []float64) []*fnet.DNSResults {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	hosts := make([]string, 0, len(d.byHost))
+	for h := range d.byHost {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	res := make([]*fnet.DNSResults, 0, len(hosts))
+	for _, h := range hosts {
+		res = append(res, d.byHost[h].Results(percentiles))
+	}
+	return res
+}
+
+// dnsResolver returns the resolver of hostname, when DNSMethod or DNSRefresh are set (and not
+// overridden by Resolve), nil otherwise. During a load test run, it is shared by all the clients
+// and refreshed every DNSRefresh; otherwise (e.g. curl mode) the host is resolved once.
+func (h *HTTPOptions) dnsResolver(hostname string) (*fnet.DNSResolver, error) {
+	if (h.DNSMethod == "" && h.DNSRefresh <= 0) || h.Resolve != "" || h.UnixDomainSocket != "" {
+		return nil, nil
+	}
+	if h.resolvers == nil {
+		return fnet.NewDNSResolver(hostname, h.DNSMethod, 0)
+	}
+	return h.resolvers.get(hostname, h.DNSMethod, h.DNSRefresh)
+}
+
+// remoteIPGetter is implemented by the clients which can return the address of the
+// connection used by their last call, when using a dnsResolver.
+type remoteIPGetter interface {
+	remoteIP() string
 }
 
 // ResetHeaders resets all the headers, including the User-Agent: one (and the Host: logical special header).
@@ -277,6 +397,11 @@ func newHTTPRequest(o *HTTPOptions) (*http.Request, error) {
 		return nil, err
 	}
 	req.Header = o.GenerateHeaders()
+	if o.Auth != nil {
+		// not shared with the other clients as it's updated for each request
+		req.Header = req.Header.Clone()
+		setAuthorization(req.Header, o.Auth.Authorization())
+	}
 	if o.hostOverride != "" {
 		req.Host = o.hostOverride
 	}
@@ -308,6 +433,16 @@ type Client struct {
 	bodyContainsUUID     bool // if body contains the "{uuid}" pattern (lowercase)
 	logErrors            bool
 	id                   int
+	tracer               *tracing.Tracer
+	auth                 auth.Provider
+	randomBody           []byte // regenerated for each request when not nil
+	rng                  *rand.Rand
+	respHeader           http.Header // of the last response
+	handshakesLock       sync.Mutex  // the handshakes are done by the transport's dialing goroutines
+	handshakeStart       time.Time
+	resolver             *fnet.DNSResolver
+	dnsGeneration        uint64
+	lastIP               string // address of the connection of the last request, when using the resolver
 }
 
 // Close cleans up any resources used by NewStdClient.
@@ -352,7 +487,10 @@ func (c *Client) Fetch() (int, []byte, int) {
 
 		c.req.URL.RawQuery = rawQuery
 	}
-	if c.bodyContainsUUID {
+	if c.randomBody != nil {
+		_, _ = c.rng.Read(c.randomBody)
+		c.req.Body = ioutil.NopCloser(bytes.NewReader(c.randomBody))
+	} else if c.bodyContainsUUID {
 		body := c.body
 		for strings.Contains(body, uuidToken) {
 			body = strings.Replace(body, uuidToken, generateUUID(), 1)
@@ -364,11 +502,30 @@ func (c *Client) Fetch() (int, []byte, int) {
 		c.req.Body = ioutil.NopCloser(bytes.NewReader([]byte(c.body)))
 	}
 
+	if c.auth != nil {
+		setAuthorization(c.req.Header, c.auth.Authorization())
+	}
+	code := SocketError
+	if c.tracer != nil {
+		sc := c.tracer.NewSpanContext()
+		c.req.Header.Set(tracing.TraceparentHeader, sc.Traceparent())
+		defer c.endSpan(&sc, time.Now(), &code)
+	}
+	c.respHeader = nil
+	if c.resolver != nil {
+		c.lastIP = ""
+		if g := c.resolver.Generation(); g != c.dnsGeneration {
+			log.Infof("[%d] Addresses changed, closing the idle connections", c.id)
+			c.dnsGeneration = g
+			c.transport.CloseIdleConnections()
+		}
+	}
 	resp, err := c.client.Do(c.req)
 	if err != nil {
 		log.Errf("[%d] Unable to send %s request for %s : %v", c.id, c.req.Method, c.url, err)
-		return -1, []byte(err.Error()), 0
+		return code, []byte(err.Error()), 0
 	}
+	c.respHeader = resp.Header
 	var data []byte
 	if log.LogDebug() {
 		if data, err = httputil.DumpResponse(resp, false); err != nil {
@@ -381,14 +538,14 @@ func (c *Client) Fetch() (int, []byte, int) {
 	resp.Body.Close()
 	if err != nil {
 		log.Errf("[%d] Unable to read response for %s : %v", c.id, c.url, err)
-		code := resp.StatusCode
+		code = resp.StatusCode
 		if codeIsOK(code) {
 			code = http.StatusNoContent
 			log.Warnf("[%d] Ok code despite read error, switching code to %d", c.id, code)
 		}
 		return code, data, 0
 	}
-	code := resp.StatusCode
+	code = resp.StatusCode
 	log.Debugf("[%d] Got %d : %s for %s %s - response is %d bytes", c.id, code, resp.Status, c.req.Method, c.url, len(data))
 	if c.logErrors && !codeIsOK(code) {
 		log.Warnf("[%d] Non ok http code %d", c.id, code)
@@ -396,6 +553,45 @@ func (c *Client) Fetch() (int, []byte, int) {
 	return code, data, 0
 }
 
+// recordTLSHandshakes makes the client record the duration of its TLS handshakes in h
+// (implements tlsHandshakeRecorder).
+func (c *Client) recordTLSHandshakes(h *stats.Histogram) {
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			c.handshakesLock.Lock()
+			c.handshakeStart = time.Now()
+			c.handshakesLock.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			c.handshakesLock.Lock()
+			h.Record(time.Since(c.handshakeStart).Seconds())
+			c.handshakesLock.Unlock()
+		},
+	}
+	c.req = c.req.WithContext(httptrace.WithClientTrace(c.req.Context(), trace))
+}
+
+// remoteIP returns the address of the connection of the last request (implements remoteIPGetter).
+func (c *Client) remoteIP() string {
+	return c.lastIP
+}
+
+// responseHeader returns the header of the last response (implements responseHeaderGetter).
+func (c *Client) responseHeader(name string) string {
+	return c.respHeader.Get(name)
+}
+
+// endSpan records the span of a request which started at start and got *code.
+func (c *Client) endSpan(sc *tracing.SpanContext, start time.Time, code *int) {
+	c.tracer.End(sc, "HTTP "+c.req.Method, start, time.Now(), !codeIsOK(*code),
+		tracing.Attribute{Key: "http.method", Value: c.req.Method},
+		tracing.Attribute{Key: "http.url", Value: c.url},
+		tracing.Attribute{Key: "http.status_code", Value: *code})
+}
+
 // NewClient creates either a standard or fast client (depending on
 // the DisableFastClient flag).
 func NewClient(o *HTTPOptions) (Fetcher, error) {
@@ -415,6 +611,10 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 	if req == nil {
 		return nil, err
 	}
+	resolver, err := o.dnsResolver(req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
 	tr := http.Transport{
 		MaxIdleConns:        o.NumConnections,
 		MaxIdleConnsPerHost: o.NumConnections,
@@ -425,6 +625,8 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 			// redirect all connections to resolved ip, and use cn as sni host
 			if o.Resolve != "" {
 				addr = o.Resolve + addr[strings.LastIndex(addr, ":"):]
+			} else if resolver != nil {
+				addr = net.JoinHostPort(resolver.IP().String(), addr[strings.LastIndex(addr, ":")+1:])
 			}
 			return (&net.Dialer{
 				Timeout: o.HTTPReqTimeOut,
@@ -454,6 +656,24 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 		transport: &tr,
 		id:        o.ID,
 		logErrors: o.LogErrors,
+		tracer:    o.Tracer,
+		auth:      o.Auth,
+	}
+	if o.RegeneratePayload && len(o.Payload) > 0 {
+		client.randomBody = make([]byte, len(o.Payload))
+		client.rng = newPayloadRand(o.ID)
+	}
+	if resolver != nil {
+		client.resolver = resolver
+		client.dnsGeneration = resolver.Generation()
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+					client.lastIP = host
+				}
+			},
+		}
+		client.req = client.req.WithContext(httptrace.WithClientTrace(client.req.Context(), trace))
 	}
 	if !o.FollowRedirects {
 		// Lets us see the raw response instead of auto following redirects.
@@ -484,6 +704,25 @@ func Fetch(httpOptions *HTTPOptions) (int, []byte) {
 	return code, data
 }
 
+// remoteIP returns the address of the current (or last attempted) connection (implements remoteIPGetter).
+func (c *FastClient) remoteIP() string {
+	if a, ok := c.dest.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
+
+// responseHeader returns the header of the last response (implements responseHeaderGetter).
+func (c *FastClient) responseHeader(name string) string {
+	return findHeader(c.buffer[:c.headerLen], name)
+}
+
+// recordTLSHandshakes makes the client record the duration of its TLS handshakes in h
+// (implements tlsHandshakeRecorder).
+func (c *FastClient) recordTLSHandshakes(h *stats.Histogram) {
+	c.handshakes = h
+}
+
 // FastClient is a fast, lockfree single purpose http 1.0/1.1 client.
 type FastClient struct {
 	buffer       []byte
@@ -509,6 +748,17 @@ type FastClient struct {
 	id           int
 	https        bool
 	tlsConfig    *tls.Config
+	method       string
+	tracer       *tracing.Tracer
+	traceMarker  []byte // placeholder traceparent value in req, replaced for each request
+	auth         auth.Provider
+	authLine     []byte // current Authorization header line in req, replaced when the value changes
+	authPos      int    // offset of authLine in req
+	regenerate   int    // length of the payload at the end of req to regenerate for each request, if not 0
+	rng          *rand.Rand
+	handshakes   *stats.Histogram
+	resolver     *fnet.DNSResolver // picks the address of each new connection when set
+	dnsGen       uint64            // generation of the resolver addresses when the socket was connected
 }
 
 // Close cleans up any resources used by FastClient.
@@ -560,7 +810,7 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 	bc := FastClient{
 		url: o.URL, host: url.Host, hostname: url.Hostname(), port: url.Port(),
 		http10: o.HTTP10, halfClose: o.AllowHalfClose, logErrors: o.LogErrors, id: o.ID,
-		https: o.https,
+		https: o.https, method: method, tracer: o.Tracer, auth: o.Auth,
 	}
 	if o.https {
 		bc.tlsConfig, err = o.TLSOptions.TLSClientConfig()
@@ -581,8 +831,18 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 	} else {
 		var tAddr *net.TCPAddr // strangely we get a non nil wrap of nil if assigning to addr directly
 		var err error
+		if bc.resolver, err = o.dnsResolver(bc.hostname); err != nil {
+			return nil, err
+		}
 		if o.Resolve != "" {
 			tAddr, err = fnet.Resolve(o.Resolve, bc.port)
+		} else if bc.resolver != nil {
+			var port int
+			if port, err = net.LookupPort("tcp", bc.port); err != nil {
+				log.Errf("Unable to resolve port '%s' : %v", bc.port, err)
+				return nil, err
+			}
+			tAddr = &net.TCPAddr{Port: port} // the IP is picked by the resolver for each connection
 		} else {
 			tAddr, err = fnet.Resolve(bc.hostname, bc.port)
 		}
@@ -599,7 +859,7 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 	if customHostHeader {
 		host = o.hostOverride
 	}
-	if bc.tlsConfig != nil {
+	if bc.tlsConfig != nil && bc.tlsConfig.ServerName == "" {
 		bc.tlsConfig.ServerName = host
 	}
 	var buf bytes.Buffer
@@ -619,14 +879,34 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 	bc.reqTimeout = o.HTTPReqTimeOut
 	w := bufio.NewWriter(&buf)
 	// This writes multiple valued headers properly (unlike calling Get() to do it ourselves)
-	_ = o.GenerateHeaders().Write(w)
+	if bc.auth != nil {
+		_ = o.GenerateHeaders().WriteSubset(w, map[string]bool{authorizationHeader: true})
+	} else {
+		_ = o.GenerateHeaders().Write(w)
+	}
 	w.Flush()
+	if bc.auth != nil {
+		bc.authLine = authorizationLine(bc.auth.Authorization())
+		bc.authPos = buf.Len()
+		buf.Write(bc.authLine)
+	}
+	if bc.tracer != nil {
+		sc := bc.tracer.NewSpanContext()
+		bc.traceMarker = []byte(sc.Traceparent())
+		buf.WriteString(tracing.TraceparentHeader + ": ")
+		buf.Write(bc.traceMarker)
+		buf.WriteString("\r\n")
+	}
 	buf.WriteString("\r\n")
 	// Add the payload to http body
 	if payloadLen > 0 {
 		buf.Write(o.Payload)
 	}
 	bc.req = buf.Bytes()
+	if o.RegeneratePayload && payloadLen > 0 {
+		bc.regenerate = payloadLen
+		bc.rng = newPayloadRand(o.ID)
+	}
 	bc.uuidMarkers = [][]byte{}
 	if len(uuidStrings) > 0 {
 		for _, uuidString := range uuidStrings {
@@ -647,18 +927,27 @@ func (c *FastClient) connect() net.Conn {
 	c.socketCount++
 	var socket net.Conn
 	var err error
+	if c.resolver != nil {
+		c.dnsGen = c.resolver.Generation()
+		c.dest = &net.TCPAddr{IP: c.resolver.IP(), Port: c.dest.(*net.TCPAddr).Port}
+	}
+	socket, err = net.Dial(c.dest.Network(), c.dest.String())
+	if err != nil {
+		log.Errf("[%d] Unable to connect to %v : %v", c.id, c.dest, err)
+		return nil
+	}
 	if c.https {
-		socket, err = tls.Dial(c.dest.Network(), c.dest.String(), c.tlsConfig)
-		if err != nil {
+		start := time.Now()
+		tlsSocket := tls.Client(socket, c.tlsConfig)
+		if err = tlsSocket.Handshake(); err != nil {
 			log.Errf("[%d] Unable to TLS connect to %v : %v", c.id, c.dest, err)
+			socket.Close()
 			return nil
 		}
-	} else {
-		socket, err = net.Dial(c.dest.Network(), c.dest.String())
-		if err != nil {
-			log.Errf("[%d] Unable to connect to %v : %v", c.id, c.dest, err)
-			return nil
+		if c.handshakes != nil {
+			c.handshakes.Record(time.Since(start).Seconds())
 		}
+		socket = tlsSocket
 	}
 	fnet.SetSocketBuffers(socket, len(c.buffer), len(c.req))
 	return socket
@@ -688,15 +977,40 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 	} else {
 		log.Debugf("Reusing socket %v", conn)
 	}
+	if reuse && c.resolver != nil && c.resolver.Generation() != c.dnsGen {
+		log.Infof("[%d] Addresses of %s changed, reconnecting", c.id, c.hostname)
+		conn.Close()
+		reuse = false
+		if conn = c.connect(); conn == nil {
+			return c.returnRes()
+		}
+	}
 	c.socket = nil // because of error returns and single retry
 	conErr := conn.SetReadDeadline(time.Now().Add(c.reqTimeout))
 	// Send the request:
+	if c.auth != nil {
+		if line := authorizationLine(c.auth.Authorization()); !bytes.Equal(line, c.authLine) {
+			newReq := make([]byte, 0, len(c.req)-len(c.authLine)+len(line))
+			newReq = append(newReq, c.req[:c.authPos]...)
+			newReq = append(newReq, line...)
+			c.req = append(newReq, c.req[c.authPos+len(c.authLine):]...)
+			c.authLine = line
+		}
+	}
+	if c.regenerate > 0 {
+		_, _ = c.rng.Read(c.req[len(c.req)-c.regenerate:])
+	}
 	req := c.req
 	if len(c.uuidMarkers) > 0 {
 		for _, uuidMarker := range c.uuidMarkers {
 			req = bytes.Replace(req, uuidMarker, []byte(generateUUID()), 1)
 		}
 	}
+	if c.tracer != nil {
+		sc := c.tracer.NewSpanContext()
+		req = bytes.Replace(req, c.traceMarker, []byte(sc.Traceparent()), 1)
+		defer c.endSpan(&sc, time.Now())
+	}
 	n, err := conn.Write(req)
 	if err != nil || conErr != nil {
 		if reuse {
@@ -709,8 +1023,8 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 		log.Errf("[%d] Unable to write to %v : %v", c.id, c.dest, err)
 		return c.returnRes()
 	}
-	if n != len(c.req) {
-		log.Errf("[%d] Short write to %v : %d instead of %d", c.id, c.dest, n, len(c.req))
+	if n != len(req) {
+		log.Errf("[%d] Short write to %v : %d instead of %d", c.id, c.dest, n, len(req))
 		return c.returnRes()
 	}
 	if !c.keepAlive && c.halfClose { // nolint: nestif
@@ -735,6 +1049,14 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 	return c.returnRes()
 }
 
+// endSpan records the span of the request which started at start.
+func (c *FastClient) endSpan(sc *tracing.SpanContext, start time.Time) {
+	c.tracer.End(sc, "HTTP "+c.method, start, time.Now(), !codeIsOK(c.code),
+		tracing.Attribute{Key: "http.method", Value: c.method},
+		tracing.Attribute{Key: "http.url", Value: c.url},
+		tracing.Attribute{Key: "http.status_code", Value: c.code})
+}
+
 func codeIsOK(code int) bool {
 	// TODO: make this configurable
 	return (code >= 200 && code <= 299) || code == http.StatusTeapot
@@ -54,11 +54,16 @@ var (
 	serverIdleTimeout = dflag.DynDuration(flag.CommandLine, "server-idle-timeout", 30*time.Second, "Default IdleTimeout for servers")
 )
 
-// EchoHandler is an http server handler echoing back the input.
+// EchoHandler is an http server handler echoing back the input (the messages
+// for websocket upgrade requests).
 func EchoHandler(w http.ResponseWriter, r *http.Request) {
 	if log.LogVerbose() {
 		LogRequest(r, "Echo") // will also print headers
 	}
+	if isWebSocketUpgrade(r) {
+		WebSocketEchoHandler.ServeHTTP(w, r)
+		return
+	}
 	defaultParams := defaultEchoServerParams.Get()
 	hasQuestionMark := strings.Contains(r.RequestURI, "?")
 	if !hasQuestionMark && len(defaultParams) > 0 {
@@ -81,7 +86,7 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Debugf("Read %d", len(data))
-	dur := generateDelay(r.FormValue("delay"))
+	dur := GenerateDelay(r.FormValue("delay"))
 	if dur > 0 {
 		log.LogVf("Sleeping for %v", dur)
 		time.Sleep(dur)
@@ -89,7 +94,7 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 	statusStr := r.FormValue("status")
 	var status int
 	if statusStr != "" {
-		status = generateStatus(statusStr)
+		status = GenerateStatus(statusStr)
 	} else {
 		status = http.StatusOK
 	}
@@ -121,7 +126,7 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Add(s[0], s[1])
 	}
-	size := generateSize(r.FormValue("size"))
+	size := GenerateSize(r.FormValue("size"))
 	if size >= 0 {
 		log.LogVf("Writing %d size with %d status", size, status)
 		writePayload(w, status, size)
@@ -17,6 +17,7 @@ package fhttp
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -24,12 +25,15 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/tracing"
 	"github.com/google/uuid"
 )
 
@@ -334,8 +338,44 @@ func TestParseStatus(t *testing.T) {
 		{"551:45%,551:55%", 551},
 	}
 	for _, tst := range tests {
-		if actual := generateStatus(tst.input); actual != tst.expected {
-			t.Errorf("Got %d, expected %d for generateStatus(%q)", actual, tst.expected, tst.input)
+		if actual := GenerateStatus(tst.input); actual != tst.expected {
+			t.Errorf("Got %d, expected %d for GenerateStatus(%q)", actual, tst.expected, tst.input)
+		}
+	}
+}
+
+func TestDelayDistributions(t *testing.T) {
+	for _, bad := range []string{"20ms..10ms", "x..10ms", "10ms..y", "~x", "x~1ms", "10ms~y", "x..10ms:50"} {
+		if d := GenerateDelay(bad); d != -1 {
+			t.Errorf("Expected error (-1) for %q, got %v", bad, d)
+		}
+	}
+	var sumUniform, sumNormal, sumExp time.Duration
+	n := 2000
+	for i := 0; i < n; i++ {
+		d := GenerateDelay("10ms..20ms")
+		if d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("Uniform delay %v out of range", d)
+		}
+		sumUniform += d
+		d = GenerateDelay("20ms~5ms")
+		if d < 0 {
+			t.Fatalf("Negative normal delay %v", d)
+		}
+		sumNormal += d
+		sumExp += GenerateDelay("~10ms")
+		if d = GenerateDelay("10ms..20ms:50,5s:50"); d != MaxDelay.Get() && (d < 10*time.Millisecond || d > 20*time.Millisecond) {
+			t.Fatalf("Unexpected weighted distribution delay %v", d)
+		}
+	}
+	for _, avg := range []struct {
+		name     string
+		sum      time.Duration
+		expected time.Duration
+	}{{"uniform", sumUniform, 15 * time.Millisecond}, {"normal", sumNormal, 20 * time.Millisecond}, {"exp", sumExp, 10 * time.Millisecond}} {
+		a := avg.sum / time.Duration(n)
+		if a < avg.expected*9/10 || a > avg.expected*11/10 {
+			t.Errorf("Unexpected %s average %v, expected ~%v", avg.name, a, avg.expected)
 		}
 	}
 }
@@ -366,8 +406,8 @@ func TestParseDelay(t *testing.T) {
 		{"10ms:45%,10ms:55%", 10 * time.Millisecond},
 	}
 	for _, tst := range tests {
-		if actual := generateDelay(tst.input); actual != tst.expected {
-			t.Errorf("Got %d, expected %d for generateStatus(%q)", actual, tst.expected, tst.input)
+		if actual := GenerateDelay(tst.input); actual != tst.expected {
+			t.Errorf("Got %d, expected %d for GenerateStatus(%q)", actual, tst.expected, tst.input)
 		}
 	}
 }
@@ -392,8 +432,8 @@ func TestGenerateStatusBasic(t *testing.T) {
 		{"551:45,551:55", 551},
 	}
 	for _, tst := range tests {
-		if actual := generateStatus(tst.input); actual != tst.expected {
-			t.Errorf("Got %d, expected %d for generateStatus(%q)", actual, tst.expected, tst.input)
+		if actual := GenerateStatus(tst.input); actual != tst.expected {
+			t.Errorf("Got %d, expected %d for GenerateStatus(%q)", actual, tst.expected, tst.input)
 		}
 	}
 }
@@ -402,12 +442,12 @@ func TestGenerateStatusEdgeSum(t *testing.T) {
 	st := "503:99.0,503:1.00001"
 	// Gets 400 without rounding as it exceeds 100, another corner case is if you
 	// add 0.1 1000 times you get 0.99999... so you may get stray 200s without Rounding
-	if actual := generateStatus(st); actual != 503 {
-		t.Errorf("Got %d for generateStatus(%q)", actual, st)
+	if actual := GenerateStatus(st); actual != 503 {
+		t.Errorf("Got %d for GenerateStatus(%q)", actual, st)
 	}
 	st += ",500:0.0001"
-	if actual := generateStatus(st); actual != 400 {
-		t.Errorf("Got %d for long generateStatus(%q) when expecting 400 for > 100", actual, st)
+	if actual := GenerateStatus(st); actual != 400 {
+		t.Errorf("Got %d for long GenerateStatus(%q) when expecting 400 for > 100", actual, st)
 	}
 }
 
@@ -421,7 +461,7 @@ func TestGenerateStatusDistribution(t *testing.T) {
 	str := "501:20,502:30,503:0.5"
 	m := make(map[int]int)
 	for i := 0; i < 10000; i++ {
-		m[generateStatus(str)]++
+		m[GenerateStatus(str)]++
 	}
 	if len(m) != 4 {
 		t.Errorf("Unexpected result, expecting 4 statuses, got %+v", m)
@@ -487,8 +527,8 @@ func TestGenerateSize(t *testing.T) {
 		{"1000000:10,2000000:90", 262144},
 	}
 	for _, tst := range tests {
-		if actual := generateSize(tst.input); actual != tst.expected {
-			t.Errorf("Got %d, expected %d for generateSize(%q)", actual, tst.expected, tst.input)
+		if actual := GenerateSize(tst.input); actual != tst.expected {
+			t.Errorf("Got %d, expected %d for GenerateSize(%q)", actual, tst.expected, tst.input)
 		}
 	}
 }
@@ -1478,6 +1518,156 @@ func TestInsecureRequestWithResolve(t *testing.T) {
 	}
 }
 
+func TestSNIOverride(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	ca, err := ioutil.TempFile("", "fortio-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+	_ = pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	ca.Close()
+	// the test server's certificate is for example.com (and 127.0.0.1) but not for localhost
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	tests := []struct {
+		fastClient bool
+		sni        string
+		code       int
+	}{
+		{false, "example.com", http.StatusOK},
+		{false, "", -1},
+		{false, "wrong.example.org", -1},
+		{true, "example.com", http.StatusOK},
+		{true, "", -1},
+		{true, "wrong.example.org", -1},
+	}
+	for _, tst := range tests {
+		o := HTTPOptions{
+			DisableFastClient: !tst.fastClient,
+			URL:               url,
+			TLSOptions:        TLSOptions{CACert: ca.Name(), ServerName: tst.sni},
+		}
+		code, _ := Fetch(&o)
+		if code != tst.code {
+			t.Errorf("Got %d code while expecting status (%d) for %+v", code, tst.code, tst)
+		}
+	}
+	for _, stdClient := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.URL = url
+		opts.CACert = ca.Name()
+		opts.ServerName = "example.com"
+		opts.DisableFastClient = stdClient
+		opts.DisableKeepAlive = true
+		opts.QPS = 100
+		opts.NumThreads = 2
+		opts.Exactly = 10
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 10 || res.TLSHandshakes == nil || res.TLSHandshakes.Count != 10 {
+			t.Errorf("Unexpected results (std client %v) %v handshakes %+v", stdClient, res.RetCodes, res.TLSHandshakes)
+		}
+	}
+}
+
+// testAuth is an auth.Provider whose value is changed by the test.
+type testAuth struct {
+	lock  sync.Mutex
+	value string
+}
+
+func (a *testAuth) Authorization() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.value
+}
+
+func (a *testAuth) set(v string) {
+	a.lock.Lock()
+	a.value = v
+	a.lock.Unlock()
+}
+
+func TestAuthProvider(t *testing.T) {
+	var lock sync.Mutex
+	var seen []string
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/auth/", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, stdClient := range []bool{false, true} {
+		a := &testAuth{value: "Bearer first"}
+		o := HTTPOptions{URL: fmt.Sprintf("http://localhost:%d/auth/", addr.Port), DisableFastClient: stdClient, Auth: a}
+		_ = o.AddAndValidateExtraHeader("Authorization: Basic ignored")
+		_ = o.AddAndValidateExtraHeader("X-Other: kept")
+		c, err := NewClient(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		seen = nil
+		lock.Unlock()
+		for _, v := range []string{"Bearer first", "Bearer second-longer-token", "", "Bearer 3"} {
+			a.set(v)
+			if code, _, _ := c.Fetch(); code != http.StatusOK {
+				t.Errorf("Unexpected code %d with auth %q (std client %v)", code, v, stdClient)
+			}
+		}
+		c.Close()
+		lock.Lock()
+		if fmt.Sprint(seen) != "[Bearer first Bearer second-longer-token  Bearer 3]" {
+			t.Errorf("Unexpected Authorization headers seen (std client %v): %q", stdClient, seen)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestRegeneratePayload(t *testing.T) {
+	var lock sync.Mutex
+	bodies := make(map[string]bool)
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/regen/", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if len(data) != 64 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		bodies[string(data)] = true
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, stdClient := range []bool{false, true} {
+		o := HTTPOptions{
+			URL:               fmt.Sprintf("http://localhost:%d/regen/", addr.Port),
+			DisableFastClient: stdClient,
+			Payload:           fnet.GenerateRandomPayload(64),
+			RegeneratePayload: true,
+		}
+		c, err := NewClient(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if code, _, _ := c.Fetch(); code != http.StatusOK {
+				t.Errorf("Unexpected code %d (std client %v)", code, stdClient)
+			}
+		}
+		c.Close()
+	}
+	if len(bodies) != 10 {
+		t.Errorf("Expected 10 different bodies, got %d", len(bodies))
+	}
+}
+
 // ValidateUUIDPath is an http server handler validating /{uuid}.
 func ValidateUUIDPath(w http.ResponseWriter, r *http.Request) {
 	if log.LogVerbose() {
@@ -1674,3 +1864,71 @@ func BenchmarkFoldFind(b *testing.B) {
 }
 
 // -- end of benchmark tests / end of this file
+
+func TestTraceparent(t *testing.T) {
+	m, a := DynamicHTTPServer(false)
+	m.HandleFunc("/debug", DebugHandler)
+	tracer := tracing.NewTracer(&tracing.Options{SampleRatio: 1})
+	re := regexp.MustCompile("\nTraceparent: (00-[0-9a-f]{32}-[0-9a-f]{16}-01)\n")
+	for _, std := range []bool{false, true} {
+		o := HTTPOptions{URL: fmt.Sprintf("http://localhost:%d/debug", a.Port), DisableFastClient: std, Tracer: tracer}
+		client, _ := NewClient(&o)
+		var prev string
+		for i := 0; i < 2; i++ {
+			code, data, _ := client.Fetch()
+			m := re.FindStringSubmatch(string(data))
+			if code != http.StatusOK || len(m) != 2 {
+				t.Fatalf("std %v: expected a traceparent header, got %d %s", std, code, data)
+			}
+			if m[1] == prev {
+				t.Errorf("std %v: expected a new traceparent for each request, got %s twice", std, prev)
+			}
+			prev = m[1]
+		}
+		client.Close()
+	}
+}
+
+func TestExpectation(t *testing.T) {
+	payload := []byte(`{"a": [1, {"b": "x", "n": 3.5, "e": ""}], "c": null}`)
+	tests := []struct {
+		expect string
+		match  bool
+	}{
+		{`{"a": [1, {"b": "x", "n": 3.5, "e": ""}], "c": null}`, true},
+		{`{"a":[1]}`, false},
+		{`regex:"b": "[xy]"`, true},
+		{`regex:^\[`, false},
+		{"json:.a", true},
+		{"json:a[1].b", true},
+		{"json:.a[1].b=x", true},
+		{"json:.a[1].b=y", false},
+		{"json:.a[1].n=3.5", true},
+		{"json:.a[0]=1", true},
+		{"json:.a[1].e", false},
+		{"json:.a[1].e=", true},
+		{"json:.a[2]", false},
+		{"json:.c", false},
+		{"json:.c=null", true},
+		{"json:.d", false},
+		{"json:.a.b", false},
+	}
+	for _, tst := range tests {
+		e, err := ParseExpectation(tst.expect)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tst.expect, err)
+			continue
+		}
+		if m := e.Check(payload); m != tst.match {
+			t.Errorf("Expectation %q got %v instead of %v", tst.expect, m, tst.match)
+		}
+	}
+	if e, _ := ParseExpectation("json:.a"); e.Check([]byte("not json")) {
+		t.Errorf("Invalid json shouldn't match")
+	}
+	for _, bad := range []string{"regex:[", "json:.a[", "json:.a[-1]", "json:.a..b"} {
+		if _, err := ParseExpectation(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
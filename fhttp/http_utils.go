@@ -20,6 +20,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"flag"
+	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
@@ -44,6 +45,9 @@ type TLSOptions struct {
 	Cert             string // `Path` to the certificate file to be used
 	Key              string // `Path` to the key file used
 	UnixDomainSocket string // `Path`` of unix domain socket to use instead of host:port
+	// ServerName overrides the name sent as SNI and checked against the server certificate
+	// (by default the host of the url, or of the Host header when set).
+	ServerName string `json:",omitempty"`
 }
 
 // TLSClientConfig creates a tls.Config based on input TLSOptions.
@@ -77,6 +81,7 @@ func (to *TLSOptions) TLSClientConfig() (*tls.Config, error) {
 		caCertPool.AppendCertsFromPEM(caCert)
 		res.RootCAs = caCertPool
 	}
+	res.ServerName = to.ServerName
 	return res, nil
 }
 
@@ -245,9 +250,9 @@ func removeTrailingPercent(s string) string {
 	return s
 }
 
-// generateStatus from string, format: status="503" for 100% 503s
+// GenerateStatus from string, format: status="503" for 100% 503s
 // status="503:20,404:10,403:0.5" for 20% 503s, 10% 404s, 0.5% 403s 69.5% 200s.
-func generateStatus(status string) int {
+func GenerateStatus(status string) int {
 	lst := strings.Split(status, ",")
 	log.Debugf("Parsing status %s -> %v", status, lst)
 	// Simple non probabilistic status case:
@@ -303,13 +308,13 @@ func generateStatus(status string) int {
 	return http.StatusOK // default/reminder of probability table
 }
 
-// generateSize from string, format: "size=512" for 100% 512 bytes body replies,
+// GenerateSize from string, format: "size=512" for 100% 512 bytes body replies,
 // size="512:20,16384:10" for 20% 512 bytes, 10% 16k, 70% default echo back.
 // returns -1 for the default case, so one can specify 0 and force no payload
 // even if it's a post request with a payload (to test asymmetric large inbound
 // small outbound).
 // TODO: refactor similarities with status and delay.
-func generateSize(sizeInput string) (size int) {
+func GenerateSize(sizeInput string) (size int) {
 	size = -1 // default value/behavior
 	if len(sizeInput) == 0 {
 		return size
@@ -377,10 +382,64 @@ func generateSize(sizeInput string) (size int) {
 var MaxDelay = dflag.DynDuration(flag.CommandLine, "max-echo-delay", 1500*time.Millisecond,
 	"Maximum sleep time for delay= echo server parameter. dynamic flag.")
 
-// generateDelay from string, format: delay="100ms" for 100% 100ms delay
+// parseDelay returns a delay for the value: a duration ("100ms") or a random one
+// from a distribution: "10ms..50ms" uniform between 10ms and 50ms, "20ms~5ms"
+// normal of mean 20ms and standard deviation 5ms, "~20ms" exponential of mean 20ms.
+// The delay is capped to MaxDelay (and negative ones are 0).
+func parseDelay(value string) (time.Duration, error) {
+	var d time.Duration
+	if idx := strings.Index(value, ".."); idx > 0 { // nolint: nestif
+		lo, err := time.ParseDuration(value[:idx])
+		if err != nil {
+			return 0, err
+		}
+		hi, err := time.ParseDuration(value[idx+2:])
+		if err != nil {
+			return 0, err
+		}
+		if hi < lo {
+			return 0, fmt.Errorf("invalid delay range %s", value)
+		}
+		d = lo + time.Duration(rand.Int63n(int64(hi-lo)+1)) // nolint: gosec // we want fast not crypto
+	} else if idx := strings.IndexByte(value, '~'); idx >= 0 {
+		if idx == 0 {
+			mean, err := time.ParseDuration(value[1:])
+			if err != nil {
+				return 0, err
+			}
+			d = time.Duration(rand.ExpFloat64() * float64(mean)) // nolint: gosec // we want fast not crypto
+		} else {
+			mean, err := time.ParseDuration(value[:idx])
+			if err != nil {
+				return 0, err
+			}
+			stddev, err := time.ParseDuration(value[idx+1:])
+			if err != nil {
+				return 0, err
+			}
+			d = mean + time.Duration(rand.NormFloat64()*float64(stddev)) // nolint: gosec // we want fast not crypto
+		}
+	} else {
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > MaxDelay.Get() {
+		d = MaxDelay.Get()
+	}
+	return d, nil
+}
+
+// GenerateDelay from string, format: delay="100ms" for 100% 100ms delay
 // delay="10ms:20,20ms:10,1s:0.5" for 20% 10ms, 10% 20ms, 0.5% 1s and 69.5% 0
-// TODO: very similar with generateStatus - refactor?
-func generateDelay(delay string) time.Duration {
+// and each delay can also be a distribution (see parseDelay), e.g.
+// delay="10ms..20ms:90,100ms~20ms:10".
+// TODO: very similar with GenerateStatus - refactor?
+func GenerateDelay(delay string) time.Duration {
 	lst := strings.Split(delay, ",")
 	log.Debugf("Parsing delay %s -> %v", delay, lst)
 	if len(delay) == 0 {
@@ -388,19 +447,16 @@ func generateDelay(delay string) time.Duration {
 	}
 	// Simple non probabilistic status case:
 	if len(lst) == 1 && !strings.ContainsRune(delay, ':') {
-		d, err := time.ParseDuration(delay)
+		d, err := parseDelay(delay)
 		if err != nil {
 			log.Warnf("Bad input delay %v, not a duration nor comma and colon separated %% list", delay)
 			return -1
 		}
 		log.Debugf("Parsed delay %s -> %d", delay, d)
-		if d > MaxDelay.Get() {
-			d = MaxDelay.Get()
-		}
 		return d
 	}
 	weights := make([]float32, len(lst))
-	delays := make([]time.Duration, len(lst))
+	delays := make([]string, len(lst))
 	lastPercent := float64(0)
 	i := 0
 	for _, entry := range lst {
@@ -409,14 +465,10 @@ func generateDelay(delay string) time.Duration {
 			log.Warnf("Should have exactly 1 : in delay list %s -> %v", delay, entry)
 			return -1
 		}
-		d, err := time.ParseDuration(l2[0])
-		if err != nil {
+		if _, err := parseDelay(l2[0]); err != nil {
 			log.Warnf("Bad input delay %v -> %v, not a number before colon", delay, l2[0])
 			return -1
 		}
-		if d > MaxDelay.Get() {
-			d = MaxDelay.Get()
-		}
 		percStr := removeTrailingPercent(l2[1])
 		p, err := strconv.ParseFloat(percStr, 32)
 		if err != nil || p < 0 || p > 100 {
@@ -431,14 +483,15 @@ func generateDelay(delay string) time.Duration {
 			return -1
 		}
 		weights[i] = p32
-		delays[i] = d
+		delays[i] = l2[0]
 		i++
 	}
 	res := 100. * rand.Float32() // nolint: gosec // we want fast not crypto
 	for i, v := range weights {
 		if res <= v {
-			log.Debugf("[0.-100.[ for %s roll %f got #%d -> %d", delay, res, i, delays[i])
-			return delays[i]
+			d, _ := parseDelay(delays[i]) // already validated
+			log.Debugf("[0.-100.[ for %s roll %f got #%d -> %d", delay, res, i, d)
+			return d
 		}
 	}
 	log.Debugf("[0.-100.[ for %s roll %f no hit, defaulting to 0", delay, res)
@@ -20,8 +20,11 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"sort"
+	"strconv"
 	"sync"
+	"time"
 
+	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
 	"fortio.org/fortio/periodic"
 	"fortio.org/fortio/stats"
@@ -39,32 +42,164 @@ type HTTPRunnerResults struct {
 	// internal type/data
 	sizes       *stats.Histogram
 	headerSizes *stats.Histogram
+	handshakes  *stats.Histogram
 	// exported result
 	HTTPOptions
 	Sizes       *stats.HistogramData
 	HeaderSizes *stats.HistogramData
-	SocketCount int
+	// TLSHandshakes is the histogram of the TLS handshakes durations (of the new
+	// connections, including the warmup ones), for https runs.
+	TLSHandshakes *stats.HistogramData `json:",omitempty"`
+	SocketCount   int
 	// http code to abort the run on (-1 for connection or other socket error)
 	AbortOn int
 	aborter *periodic.Aborter
+	expect  *Expectation
+	// Expect is the check of the 2xx responses bodies (see Expectation), when set.
+	Expect string `json:",omitempty"`
+	// ValidationFailures is the number of 2xx responses whose body didn't match Expect.
+	ValidationFailures int64
+	// Scenarios has the per scenario results of a mixed workload run.
+	Scenarios []ScenarioResults `json:",omitempty"`
+	picker    *scenarioPicker
+	// ServerTime has the server reported time and overhead histograms, when ServerTimeHeader is set.
+	ServerTime       *ServerTimeResults `json:",omitempty"`
+	serverTime       *ServerTimeRecorder
+	serverTimeHeader string
+	// Retries has the first attempts latency and the retries counts, when a Retry policy is set.
+	Retries *periodic.RetryResults `json:",omitempty"`
+	retry   *periodic.RetryPolicy
+	retries *periodic.RetryRecorder
+	stop    chan struct{} // the run abort channel, to interrupt the retry backoffs
+	// CallsPerIP is the count of calls per server address, when DNSMethod or DNSRefresh are set.
+	CallsPerIP map[string]int64 `json:",omitempty"`
+	// DNS has the resolutions of each host (the URL's and the scenarios ones), when DNSMethod
+	// or DNSRefresh are set.
+	DNS []*fnet.DNSResults `json:",omitempty"`
 }
 
 // Run tests http request fetching. Main call being run at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (httpstate *HTTPRunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
-	code, body, headerSize := httpstate.client.Fetch()
+	client, expect := httpstate.client, httpstate.expect
+	var scenario *ScenarioResults
+	if httpstate.picker != nil {
+		scenario = &httpstate.Scenarios[httpstate.picker.pick()]
+		client, expect = scenario.client, scenario.expect
+	}
+	start := time.Now()
+	code, body, headerSize, last := httpstate.fetch(client, start)
+	if scenario != nil {
+		scenario.duration.Record(time.Since(start).Seconds())
+		scenario.RetCodes[code]++
+	}
+	if httpstate.serverTime != nil && code > 0 {
+		if hg, ok := client.(responseHeaderGetter); ok {
+			// compared to the last attempt only, the server time being the one of that attempt
+			httpstate.serverTime.Record(hg.responseHeader(httpstate.serverTimeHeader), last)
+		}
+	}
+	if httpstate.CallsPerIP != nil {
+		if g, ok := client.(remoteIPGetter); ok {
+			if ip := g.remoteIP(); ip != "" {
+				httpstate.CallsPerIP[ip]++
+			}
+		}
+	}
 	size := len(body)
 	log.Debugf("Got in %3d hsz %d sz %d - will abort on %d", code, headerSize, size, httpstate.AbortOn)
 	httpstate.RetCodes[code]++
 	httpstate.sizes.Record(float64(size))
 	httpstate.headerSizes.Record(float64(headerSize))
+	if expect != nil && codeIsOK(code) && !expect.Check(body[headerSize:]) {
+		httpstate.ValidationFailures++
+		if scenario != nil {
+			scenario.ValidationFailures++
+		}
+		log.LogVf("Unexpected response body %s", DebugSummary(body[headerSize:], 256))
+	}
 	if httpstate.AbortOn == code {
 		httpstate.aborter.Abort()
 		log.Infof("Aborted run because of code %d - data %s", code, DebugSummary(body, 1024))
 	}
 }
 
+// fetch calls the client, retrying the failed calls as per the retry policy if set, and
+// also returns the duration of the last attempt.
+func (httpstate *HTTPRunnerResults) fetch(client Fetcher, start time.Time) (int, []byte, int, time.Duration) {
+	code, body, headerSize := client.Fetch()
+	last := time.Since(start)
+	p := httpstate.retry
+	if p == nil {
+		return code, body, headerSize, last
+	}
+	first := last
+	firstFailed := !codeIsOK(code)
+	retries := 0
+	for retries+1 < p.MaxAttempts && !codeIsOK(code) && p.ShouldRetry(strconv.Itoa(code)) {
+		log.Debugf("Retrying call which got %d", code)
+		w := p.Wait(retries)
+		httpstate.retries.RecordWait(w)
+		select {
+		case <-httpstate.stop:
+			httpstate.retries.Record(first, firstFailed, retries, false)
+			return code, body, headerSize, last
+		case <-time.After(w):
+		}
+		retries++
+		attemptStart := time.Now()
+		code, body, headerSize = client.Fetch()
+		last = time.Since(attemptStart)
+	}
+	httpstate.retries.Record(first, firstFailed, retries, codeIsOK(code))
+	return code, body, headerSize, last
+}
+
+// ResetStats clears the per call statistics, after the warmup (implements periodic.Resetter).
+func (httpstate *HTTPRunnerResults) ResetStats() {
+	httpstate.RetCodes = make(map[int]int64)
+	httpstate.ValidationFailures = 0
+	httpstate.sizes.Reset()
+	httpstate.headerSizes.Reset()
+	if httpstate.serverTime != nil {
+		httpstate.serverTime.Reset()
+	}
+	if httpstate.retries != nil {
+		httpstate.retries.Reset()
+	}
+	if httpstate.CallsPerIP != nil {
+		httpstate.CallsPerIP = make(map[string]int64)
+	}
+	for i := range httpstate.Scenarios {
+		s := &httpstate.Scenarios[i]
+		s.RetCodes = make(map[int]int64)
+		s.ValidationFailures = 0
+		s.duration.Reset()
+	}
+}
+
+// ErrorCount returns the number of calls which didn't get an ok response (see codeIsOK),
+// including socket errors, or got an unexpected body (implements periodic.HasErrorCount).
+func (httpstate *HTTPRunnerResults) ErrorCount() int64 {
+	n := httpstate.ValidationFailures
+	for code, count := range httpstate.RetCodes {
+		if !codeIsOK(code) {
+			n += count
+		}
+	}
+	return n
+}
+
+// ReturnCodes returns the number of calls by http code (implements periodic.HasReturnCodes).
+func (httpstate *HTTPRunnerResults) ReturnCodes() map[string]int64 {
+	codes := make(map[string]int64, len(httpstate.RetCodes))
+	for code, count := range httpstate.RetCodes {
+		codes[strconv.Itoa(code)] = count
+	}
+	return codes
+}
+
 // HTTPRunnerOptions includes the base RunnerOptions plus http specific
 // options.
 type HTTPRunnerOptions struct {
@@ -74,6 +209,16 @@ type HTTPRunnerOptions struct {
 	AllowInitialErrors bool   // whether initial errors don't cause an abort
 	// Which status code cause an abort of the run (default 0 = don't abort; reminder -1 is returned for socket errors)
 	AbortOn int
+	// Optional check of the 2xx responses bodies, see Expectation for the syntax.
+	Expect string
+	// Optional mixed workload: each call is one of the scenarios, picked according to their
+	// weights, instead of the URL and payload of the HTTPOptions (which provide the other options).
+	Scenarios []Scenario
+	// Optional response header with the server processing time (e.g. Server-Timing, with an optional
+	// :metric, see ParseServerTime) to record, along with the client minus server time overhead.
+	ServerTimeHeader string
+	// Optional client side retries of the failed calls (enabled when MaxAttempts > 1).
+	Retry periodic.RetryPolicy
 }
 
 // RunHTTPTest runs an http test and returns the aggregated stats.
@@ -84,20 +229,62 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	if o.SequentialWarmup {
 		warmupMode = "sequential"
 	}
-	log.Infof("Starting http test for %s with %d threads at %.1f qps and %s warmup", o.URL, o.NumThreads, o.QPS, warmupMode)
+	if len(o.Scenarios) > 0 {
+		o.RunType = fmt.Sprintf("HTTP %d Scenarios", len(o.Scenarios))
+		if o.URL == "" {
+			o.URL = o.Scenarios[0].URL
+		}
+		log.Infof("Starting http test of %d scenarios with %d threads at %.1f qps and %s warmup",
+			len(o.Scenarios), o.NumThreads, o.QPS, warmupMode)
+	} else {
+		log.Infof("Starting http test for %s with %d threads at %.1f qps and %s warmup", o.URL, o.NumThreads, o.QPS, warmupMode)
+	}
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads
 	o.HTTPOptions.Init(o.URL)
+	if o.DNSMethod != "" || o.DNSRefresh > 0 {
+		// shared by all the clients of the run, including the scenarios ones
+		resolvers := &dnsResolvers{}
+		o.HTTPOptions.resolvers = resolvers
+		defer func() {
+			resolvers.stop()
+			o.HTTPOptions.resolvers = nil // the next run with these options resolves again
+		}()
+	}
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	var expect *Expectation
+	if o.Expect != "" {
+		var err error
+		if expect, err = ParseExpectation(o.Expect); err != nil {
+			return nil, err
+		}
+	}
 	total := HTTPRunnerResults{
+		Expect:      o.Expect,
 		HTTPOptions: o.HTTPOptions,
 		RetCodes:    make(map[int]int64),
 		sizes:       stats.NewHistogram(0, 100),
 		headerSizes: stats.NewHistogram(0, 5),
+		handshakes:  stats.NewHistogram(r.Options().Offset.Seconds(), r.Options().Resolution),
 		AbortOn:     o.AbortOn,
 		aborter:     r.Options().Stop,
 	}
+	if o.ServerTimeHeader != "" {
+		total.serverTime = NewServerTimeRecorder(o.ServerTimeHeader, r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
+	if o.Retry.MaxAttempts > 1 {
+		total.retry = &o.Retry
+		total.retries = periodic.NewRetryRecorder(r.Options().Offset.Seconds(), r.Options().Resolution)
+	}
+	scenarioOpts, cumulative, err := setupScenarios(o, r.Options(), &total, expect)
+	if err != nil {
+		return nil, err
+	}
+	perIP := (o.DNSMethod != "" || o.DNSRefresh > 0) && o.Resolve == "" && o.UnixDomainSocket == ""
+	if perIP {
+		total.CallsPerIP = make(map[string]int64)
+	}
 	httpstate := make([]HTTPRunnerResults, numThreads)
 	// First build all the clients sequentially. This ensures we do not have data races when
 	// constructing requests.
@@ -107,18 +294,20 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		o.HTTPOptions.ID = i
 		// Create a client (and transport) and connect once for each 'thread'
 		var err error
-		httpstate[i].client, err = NewClient(&o.HTTPOptions)
+		if len(scenarioOpts) > 0 {
+			err = httpstate[i].setupScenarios(&total, scenarioOpts, cumulative, i)
+		} else {
+			httpstate[i].client, err = NewClient(&o.HTTPOptions)
+		}
 		// nil check on interface doesn't work
 		if err != nil {
 			return nil, err
 		}
+		httpstate[i].handshakes = total.handshakes.Clone()
+		httpstate[i].recordTLSHandshakes()
 		if o.SequentialWarmup && o.Exactly <= 0 {
-			code, data, headerSize := httpstate[i].client.Fetch()
-			if !o.AllowInitialErrors && !codeIsOK(code) {
-				return nil, fmt.Errorf("error %d for %s: %q", code, o.URL, string(data))
-			}
-			if i == 0 && log.LogVerbose() {
-				log.LogVf("first hit of url %s: status %03d, headers %d, total %d\n%s\n", o.URL, code, headerSize, len(data), data)
+			if err = httpstate[i].warmup(o, i); err != nil {
+				return nil, err
 			}
 		}
 		// Setup the stats for each 'thread'
@@ -127,20 +316,26 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		httpstate[i].RetCodes = make(map[int]int64)
 		httpstate[i].AbortOn = total.AbortOn
 		httpstate[i].aborter = total.aborter
+		httpstate[i].expect = expect
+		if total.serverTime != nil {
+			httpstate[i].serverTime = total.serverTime.Clone()
+			httpstate[i].serverTimeHeader, _ = SplitServerTimeSource(o.ServerTimeHeader)
+		}
+		if total.retries != nil {
+			httpstate[i].retry = total.retry
+			httpstate[i].stop = r.Options().Stop.StopChan
+			httpstate[i].retries = total.retries.Clone()
+		}
+		if perIP {
+			httpstate[i].CallsPerIP = make(map[string]int64)
+		}
 	}
 	if o.Exactly <= 0 && !o.SequentialWarmup {
 		warmup := errgroup{}
 		for i := 0; i < numThreads; i++ {
 			i := i
 			warmup.Go(func() error {
-				code, data, headerSize := httpstate[i].client.Fetch()
-				if !o.AllowInitialErrors && !codeIsOK(code) {
-					return fmt.Errorf("error %d for %s: %q", code, o.URL, string(data))
-				}
-				if i == 0 && log.LogVerbose() {
-					log.LogVf("first hit of url %s: status %03d, headers %d, total %d\n%s\n", o.URL, code, headerSize, len(data), data)
-				}
-				return nil
+				return httpstate[i].warmup(o, i)
 			})
 		}
 		if err := warmup.Wait(); err != nil {
@@ -177,7 +372,19 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	// unused ones. We also must cleanup all the created clients.
 	keys := []int{}
 	for i := 0; i < numThreads; i++ {
-		total.SocketCount += httpstate[i].client.Close()
+		if httpstate[i].client != nil {
+			total.SocketCount += httpstate[i].client.Close()
+		}
+		for j := range httpstate[i].Scenarios {
+			s := &httpstate[i].Scenarios[j]
+			total.SocketCount += s.client.Close()
+			t := &total.Scenarios[j]
+			for k, v := range s.RetCodes {
+				t.RetCodes[k] += v
+			}
+			t.ValidationFailures += s.ValidationFailures
+			t.duration.Transfer(s.duration)
+		}
 		// Q: is there some copying each time stats[i] is used?
 		for k := range httpstate[i].RetCodes {
 			if _, exists := total.RetCodes[k]; !exists {
@@ -185,8 +392,19 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 			}
 			total.RetCodes[k] += httpstate[i].RetCodes[k]
 		}
+		total.ValidationFailures += httpstate[i].ValidationFailures
 		total.sizes.Transfer(httpstate[i].sizes)
 		total.headerSizes.Transfer(httpstate[i].headerSizes)
+		total.handshakes.Transfer(httpstate[i].handshakes)
+		if total.serverTime != nil {
+			total.serverTime.Transfer(httpstate[i].serverTime)
+		}
+		if total.retries != nil {
+			total.retries.Transfer(httpstate[i].retries)
+		}
+		for ip, n := range httpstate[i].CallsPerIP {
+			total.CallsPerIP[ip] += n
+		}
 	}
 	// Cleanup state:
 	r.Options().ReleaseRunners()
@@ -199,18 +417,93 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	for _, k := range keys {
 		_, _ = fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
 	}
+	if expect != nil {
+		_, _ = fmt.Fprintf(out, "Validation failures (-expect %s) : %d (%.1f %%)\n", o.Expect, total.ValidationFailures,
+			100.*float64(total.ValidationFailures)/totalCount)
+	}
+	for i := range total.Scenarios {
+		total.Scenarios[i].print(out, r.Options().Percentiles)
+	}
+	if total.serverTime != nil {
+		total.ServerTime = total.serverTime.Results(out, o.ServerTimeHeader, r.Options().Percentiles)
+	}
+	if total.retries != nil {
+		total.Retries = total.retries.Results(out, total.retry, r.Options().Percentiles)
+	}
+	if o.HTTPOptions.resolvers != nil {
+		o.HTTPOptions.resolvers.stop()
+		total.DNS = o.HTTPOptions.resolvers.results(r.Options().Percentiles)
+		for _, d := range total.DNS {
+			_, _ = fmt.Fprintf(out, "DNS %s (%s): %d lookups, %d errors, %d changes, last addresses %v\n", d.Host, d.Method,
+				d.Lookups, d.Errors, d.Changes, d.IPs)
+		}
+	}
+	if len(total.CallsPerIP) > 0 {
+		ips := make([]string, 0, len(total.CallsPerIP))
+		for ip := range total.CallsPerIP {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		for _, ip := range ips {
+			_, _ = fmt.Fprintf(out, "IP %s : %d (%.1f %%)\n", ip, total.CallsPerIP[ip], 100.*float64(total.CallsPerIP[ip])/totalCount)
+		}
+	}
 	total.HeaderSizes = total.headerSizes.Export()
 	total.Sizes = total.sizes.Export()
+	if total.handshakes.Count > 0 {
+		total.TLSHandshakes = total.handshakes.Export().CalcPercentiles(r.Options().Percentiles)
+	}
 	if log.LogVerbose() {
 		total.HeaderSizes.Print(out, "Response Header Sizes Histogram")
 		total.Sizes.Print(out, "Response Body/Total Sizes Histogram")
+		if total.TLSHandshakes != nil {
+			total.TLSHandshakes.Print(out, "TLS Handshakes Histogram")
+		}
 	} else if log.Log(log.Warning) {
 		total.headerSizes.Counter.Print(out, "Response Header Sizes")
 		total.sizes.Counter.Print(out, "Response Body/Total Sizes")
+		if total.TLSHandshakes != nil {
+			total.handshakes.Counter.Print(out, "TLS Handshakes")
+		}
 	}
 	return &total, nil
 }
 
+// recordTLSHandshakes makes the client(s) of the 'thread' record their TLS handshakes.
+func (httpstate *HTTPRunnerResults) recordTLSHandshakes() {
+	clients := []Fetcher{httpstate.client}
+	for j := range httpstate.Scenarios {
+		clients = append(clients, httpstate.Scenarios[j].client)
+	}
+	for _, c := range clients {
+		if hr, ok := c.(tlsHandshakeRecorder); ok {
+			hr.recordTLSHandshakes(httpstate.handshakes)
+		}
+	}
+}
+
+// warmup does the initial call(s) of 'thread' i, to each scenario when set.
+func (httpstate *HTTPRunnerResults) warmup(o *HTTPRunnerOptions, i int) error {
+	clients, urls := []Fetcher{httpstate.client}, []string{o.URL}
+	if len(httpstate.Scenarios) > 0 {
+		clients, urls = nil, nil
+		for j := range httpstate.Scenarios {
+			clients = append(clients, httpstate.Scenarios[j].client)
+			urls = append(urls, httpstate.Scenarios[j].URL)
+		}
+	}
+	for j, client := range clients {
+		code, data, headerSize := client.Fetch()
+		if !o.AllowInitialErrors && !codeIsOK(code) {
+			return fmt.Errorf("error %d for %s: %q", code, urls[j], string(data))
+		}
+		if i == 0 && log.LogVerbose() {
+			log.LogVf("first hit of url %s: status %03d, headers %d, total %d\n%s\n", urls[j], code, headerSize, len(data), data)
+		}
+	}
+	return nil
+}
+
 // A errgroup is a collection of goroutines working on subtasks that are part of
 // the same overall task.
 type errgroup struct {
@@ -19,13 +19,17 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
 )
 
 func TestHTTPRunner(t *testing.T) {
@@ -380,3 +384,325 @@ func TestAbortOn(t *testing.T) {
 		t.Errorf("Abort2 not working, did %d requests expecting ideally 1 and <= %d", count, o.NumThreads)
 	}
 }
+
+func TestHTTPRunnerErrorCount(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/foo/", EchoHandler)
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 20
+	opts.URL = fmt.Sprintf("http://localhost:%d/foo/bar?status=503:50,418:20", addr.Port)
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := res.ErrorCount() // 418 is ok, as for the other http stats
+	if errs != res.RetCodes[http.StatusServiceUnavailable] || errs+res.RetCodes[http.StatusOK]+res.RetCodes[http.StatusTeapot] != 20 {
+		t.Errorf("Error count %d doesn't match the codes %v", errs, res.RetCodes)
+	}
+}
+
+func TestHTTPRunnerExpect(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/foo/", EchoHandler)
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 20
+	opts.URL = fmt.Sprintf("http://localhost:%d/foo/bar?status=503:25", addr.Port)
+	opts.Payload = []byte(`{"items": [{"id": "abc"}]}`)
+	opts.Expect = "json:.items[0].id=abc"
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ValidationFailures != 0 || res.Expect != opts.Expect {
+		t.Errorf("Expected no validation failures, got %d (%q)", res.ValidationFailures, res.Expect)
+	}
+	opts.Expect = "json:.items[0].id=def"
+	res, err = RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 503s aren't checked
+	if res.ValidationFailures != res.RetCodes[http.StatusOK] || res.ValidationFailures == 0 {
+		t.Errorf("Expected validation failures for all %d 200s, got %d", res.RetCodes[http.StatusOK], res.ValidationFailures)
+	}
+	if errs := res.ErrorCount(); errs != 20 {
+		t.Errorf("Error count %d should include the validation failures", errs)
+	}
+	opts.Expect = "regex:("
+	if _, err = RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for invalid expect regex")
+	}
+}
+
+func TestParseScenarios(t *testing.T) {
+	s, err := ParseScenarios([]byte(`{"scenarios": [{"name": "a", "weight": 70, "url": "localhost/a"}, {"url": "localhost/b"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2 || s[0].Name != "a" || s[0].Weight != 70 || s[1].Name != "localhost/b" || s[1].Weight != 1 {
+		t.Errorf("Unexpected scenarios %+v", s)
+	}
+	s, err = ParseScenarios([]byte(` [{"URL": "localhost/c", "Payload": "x", "Headers": ["Foo: bar"]}]`))
+	if err != nil || len(s) != 1 || s[0].Payload != "x" || s[0].Headers[0] != "Foo: bar" {
+		t.Errorf("Unexpected scenarios %+v %v", s, err)
+	}
+	for _, bad := range []string{`[]`, `{"scenarios": [{"name": "no url"}]}`, `[{"url": "x", "weight": -1}]`, `[{`} {
+		if _, err = ParseScenarios([]byte(bad)); err == nil {
+			t.Errorf("Expected error for %s", bad)
+		}
+	}
+}
+
+func TestHTTPRunnerScenarios(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/a/", EchoHandler)
+	mux.HandleFunc("/b/", EchoHandler)
+	base := fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 400
+	opts.NumThreads = 4
+	opts.Scenarios = []Scenario{
+		{Name: "a", Weight: 3, URL: base + "a/", Payload: "aaa", Expect: "aaa"},
+		{Name: "b", Weight: 1, URL: base + "b/?status=503", Headers: []string{"X-Scenario: b"}},
+	}
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Scenarios) != 2 {
+		t.Fatalf("Expected 2 scenario results, got %+v", res.Scenarios)
+	}
+	a, b := res.Scenarios[0], res.Scenarios[1]
+	if a.DurationHistogram.Count+b.DurationHistogram.Count != res.DurationHistogram.Count {
+		t.Errorf("Scenario calls %d + %d don't add up to %d", a.DurationHistogram.Count, b.DurationHistogram.Count,
+			res.DurationHistogram.Count)
+	}
+	if a.RetCodes[http.StatusOK] != a.DurationHistogram.Count || b.RetCodes[http.StatusServiceUnavailable] != b.DurationHistogram.Count {
+		t.Errorf("Unexpected scenario codes %v %v", a.RetCodes, b.RetCodes)
+	}
+	if ratio := float64(a.DurationHistogram.Count) / float64(res.DurationHistogram.Count); ratio < 0.65 || ratio > 0.85 {
+		t.Errorf("Expected about 75%% of the calls for scenario a, got %.2f", ratio)
+	}
+	if a.ValidationFailures != 0 || res.RunType != "HTTP 2 Scenarios" {
+		t.Errorf("Unexpected validation failures %d or run type %q", a.ValidationFailures, res.RunType)
+	}
+	opts.Scenarios[1].Headers = []string{"invalid"}
+	if _, err = RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for invalid scenario header")
+	}
+}
+
+func TestParseServerTime(t *testing.T) {
+	tests := []struct {
+		value    string
+		metric   string
+		expected float64
+		ok       bool
+	}{
+		{"12", "", 0.012, true},
+		{" 1.5 ", "", 0.0015, true},
+		{"250us", "", 0.00025, true},
+		{"0.5s", "", 0.5, true},
+		{"db;dur=53, app;dur=47.2", "", 0.053, true},
+		{"db;dur=53, app;dur=47.2", "app", 0.0472, true},
+		{"db;dur=53, App;dur=47.2", "app", 0.0472, true},
+		{"db;dur=53, app;dur=47.2", "total", 0, false},
+		{`total;desc="all";dur="20"`, "", 0.020, true},
+		{"miss, cache;desc=hit", "", 0, false},
+		{"db;dur=abc", "", 0, false},
+		{"12", "total", 0, false},
+		{"", "", 0, false},
+		{"soon", "", 0, false},
+	}
+	for _, tst := range tests {
+		v, ok := ParseServerTime(tst.value, tst.metric)
+		if ok != tst.ok || (ok && (v < tst.expected-1e-9 || v > tst.expected+1e-9)) {
+			t.Errorf("ParseServerTime(%q, %q) got %v %v, expected %v %v", tst.value, tst.metric, v, ok, tst.expected, tst.ok)
+		}
+	}
+}
+
+func TestSplitServerTimeSource(t *testing.T) {
+	if name, metric := SplitServerTimeSource("Server-Timing:total"); name != "Server-Timing" || metric != "total" {
+		t.Errorf("Unexpected split %q %q", name, metric)
+	}
+	if name, metric := SplitServerTimeSource("X-Envoy-Upstream-Service-Time"); name != "X-Envoy-Upstream-Service-Time" || metric != "" {
+		t.Errorf("Unexpected split %q %q", name, metric)
+	}
+}
+
+func TestHTTPRunnerServerTime(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/timed/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Server-Timing", "app;dur=10, db;dur=0.5")
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, stdClient := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 10
+		opts.URL = fmt.Sprintf("http://localhost:%d/timed/", addr.Port)
+		opts.DisableFastClient = stdClient
+		opts.ServerTimeHeader = "server-timing"
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := res.ServerTime
+		if st == nil || st.Missing != 0 || st.Server.Count != 10 || st.Server.Min != 0.010 || st.Overhead.Count != 10 {
+			t.Errorf("Unexpected server time results (std client %v) %+v", stdClient, st)
+		}
+		opts.ServerTimeHeader = "server-timing:db"
+		if res, err = RunHTTPTest(&opts); err != nil {
+			t.Fatal(err)
+		}
+		if st = res.ServerTime; st.Missing != 0 || st.Server.Count != 10 || st.Server.Max != 0.0005 {
+			t.Errorf("Unexpected db server time results (std client %v) %+v", stdClient, st)
+		}
+		opts.ServerTimeHeader = "X-Missing"
+		if res, err = RunHTTPTest(&opts); err != nil {
+			t.Fatal(err)
+		}
+		if res.ServerTime.Missing != 10 {
+			t.Errorf("Expected 10 missing server times, got %+v", res.ServerTime)
+		}
+	}
+	// with retries, the overhead is the one of the last attempt, not including the backoffs
+	var calls int64
+	mux.HandleFunc("/timed-flaky/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-Timing", "app;dur=1")
+		if atomic.AddInt64(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 4
+	opts.NumThreads = 1
+	opts.URL = fmt.Sprintf("http://localhost:%d/timed-flaky/", addr.Port)
+	opts.ServerTimeHeader = "server-timing"
+	opts.Retry = periodic.RetryPolicy{MaxAttempts: 2, Backoff: 50 * time.Millisecond}
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := res.ServerTime; st.Overhead.Count != 4 || st.Overhead.Max >= 0.050 || res.DurationHistogram.Min < 0.050 {
+		t.Errorf("Unexpected overhead with retries %+v (durations %+v)", st.Overhead, res.DurationHistogram)
+	}
+}
+
+func TestHTTPRunnerRetry(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var calls int64
+	mux.HandleFunc("/flaky/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // every other attempt fails
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 10
+	opts.NumThreads = 1
+	opts.URL = fmt.Sprintf("http://localhost:%d/flaky/", addr.Port)
+	opts.Retry = periodic.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: []string{"5xx"}}
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := res.Retries
+	if res.RetCodes[http.StatusOK] != 10 || rr == nil || rr.Retries != 10 || rr.RetriedCalls != 10 ||
+		rr.RecoveredCalls != 10 || rr.FirstAttemptErrors != 10 || rr.FirstAttempt.Count != 10 {
+		t.Errorf("Unexpected retry results %v %+v", res.RetCodes, rr)
+	}
+	if rr.FirstAttempt.Avg >= res.DurationHistogram.Avg {
+		t.Errorf("First attempts %g should be faster than the calls with retries %g", rr.FirstAttempt.Avg, res.DurationHistogram.Avg)
+	}
+	// not retried codes:
+	atomic.StoreInt64(&calls, 0)
+	opts.Retry.RetryOn = []string{"429", "-1"}
+	if res, err = RunHTTPTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusServiceUnavailable] != 5 || res.Retries.Retries != 0 || res.Retries.FirstAttemptErrors != 5 {
+		t.Errorf("Unexpected results without retries %v %+v", res.RetCodes, res.Retries)
+	}
+	// aborting interrupts the backoffs:
+	opts.URL = fmt.Sprintf("http://localhost:%d/echo-retry/?status=503", addr.Port)
+	mux.HandleFunc("/echo-retry/", EchoHandler)
+	opts.Retry = periodic.RetryPolicy{MaxAttempts: 3, Backoff: time.Minute}
+	stop := periodic.NewAborter()
+	opts.Stop = stop
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		stop.Abort()
+	}()
+	start := time.Now()
+	if res, err = RunHTTPTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second || res.Retries.Retries != 0 {
+		t.Errorf("Abort should interrupt the retry backoff, took %v: %+v", elapsed, res.Retries)
+	}
+}
+
+func TestHTTPRunnerDNS(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-dns/", EchoHandler)
+	defer func() { fnet.Lookup = net.LookupIP }()
+	var lookups int64
+	fnet.Lookup = func(host string) ([]net.IP, error) {
+		atomic.AddInt64(&lookups, 1)
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}, nil
+	}
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 10
+		opts.NumThreads = 2
+		opts.DisableFastClient = std
+		opts.URL = fmt.Sprintf("http://headless.local:%d/echo-dns/", addr.Port)
+		opts.DNSMethod = fnet.DNSRoundRobin
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 10 || len(res.DNS) != 1 || res.DNS[0].Lookups != 1 {
+			t.Errorf("std %v: unexpected results %v %+v", std, res.RetCodes, res.DNS)
+		}
+		if len(res.CallsPerIP) != 2 || res.CallsPerIP["127.0.0.1"]+res.CallsPerIP["127.0.0.2"] != 10 {
+			t.Errorf("std %v: expected the calls spread on both addresses, got %v", std, res.CallsPerIP)
+		}
+	}
+	// scenarios share one resolver per host, all stopped at the end of the run
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 20
+	opts.NumThreads = 2
+	opts.DNSMethod = fnet.DNSRoundRobin
+	opts.DNSRefresh = 10 * time.Millisecond
+	opts.Scenarios = []Scenario{
+		{Name: "a", Weight: 1, URL: fmt.Sprintf("http://headless.local:%d/echo-dns/a", addr.Port)},
+		{Name: "b", Weight: 1, URL: fmt.Sprintf("http://other.local:%d/echo-dns/b", addr.Port)},
+	}
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.DNS) != 2 || res.DNS[0].Host != "headless.local" || res.DNS[1].Host != "other.local" ||
+		res.CallsPerIP["127.0.0.1"]+res.CallsPerIP["127.0.0.2"] != 20 {
+		t.Errorf("Unexpected scenarios dns results %+v %v", res.DNS, res.CallsPerIP)
+	}
+	n := atomic.LoadInt64(&lookups)
+	time.Sleep(50 * time.Millisecond)
+	if l := atomic.LoadInt64(&lookups); l != n {
+		t.Errorf("Expected no lookups after the run, got %d more", l-n)
+	}
+}
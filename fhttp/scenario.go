@@ -0,0 +1,216 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// Scenario is one of the weighted requests of a mixed workload run.
+type Scenario struct {
+	Name        string
+	Weight      float64 // relative to the sum of the weights of all the scenarios
+	URL         string
+	Payload     string   `json:",omitempty"` // implies POST, like -payload
+	ContentType string   `json:",omitempty"`
+	Headers     []string `json:",omitempty"` // extra "Key: Value" headers, in addition to the -H ones
+	Expect      string   `json:",omitempty"` // check of the 2xx responses (see Expectation), overrides -expect
+}
+
+// ScenarioResults are the results of one Scenario of the run. The calls are also
+// counted in the aggregate HTTPRunnerResults.
+type ScenarioResults struct {
+	Scenario
+	RetCodes           map[int]int64
+	ValidationFailures int64
+	// Duration of the calls of this scenario (measured around the fetch only).
+	DurationHistogram *stats.HistogramData
+	client            Fetcher
+	expect            *Expectation
+	duration          *stats.Histogram
+}
+
+// ReadScenarios reads a json scenarios file: a list of Scenario or an object with a
+// "scenarios" list. Only json is supported, not yaml.
+func ReadScenarios(fileName string) ([]Scenario, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenarios(data)
+}
+
+// ParseScenarios parses and validates scenarios in the ReadScenarios format.
+func ParseScenarios(data []byte) ([]Scenario, error) {
+	var scenarios []Scenario
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &scenarios)
+	} else {
+		var f struct{ Scenarios []Scenario }
+		err = json.Unmarshal(data, &f)
+		scenarios = f.Scenarios
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenarios (expecting json, yaml isn't supported): %v", err)
+	}
+	if len(scenarios) == 0 {
+		return nil, fmt.Errorf("no scenario found")
+	}
+	for i := range scenarios {
+		s := &scenarios[i]
+		if s.URL == "" {
+			return nil, fmt.Errorf("scenario %d (%s) has no url", i, s.Name)
+		}
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("scenario %d (%s) has a negative weight", i, s.Name)
+		}
+		if s.Weight == 0 {
+			s.Weight = 1
+		}
+		if s.Name == "" {
+			s.Name = s.URL
+		}
+	}
+	return scenarios, nil
+}
+
+// scenarioOptions returns the http options of the scenario, derived from the run's ones.
+func scenarioOptions(base *HTTPOptions, s *Scenario) (*HTTPOptions, error) {
+	o := *base
+	if base.extraHeaders != nil {
+		o.extraHeaders = base.extraHeaders.Clone()
+	}
+	o.initDone = false
+	o.Init(s.URL)
+	if s.Payload != "" {
+		o.Payload = []byte(s.Payload)
+	}
+	if s.ContentType != "" {
+		o.ContentType = s.ContentType
+	}
+	for _, h := range s.Headers {
+		if err := o.AddAndValidateExtraHeader(h); err != nil {
+			return nil, fmt.Errorf("scenario %s: %v", s.Name, err)
+		}
+	}
+	return &o, nil
+}
+
+// scenarioPicker chooses the scenario of each call of a 'thread' according to the weights.
+type scenarioPicker struct {
+	cumulative []float64 // shared by all the threads
+	rng        *rand.Rand
+}
+
+func (p *scenarioPicker) pick() int {
+	v := p.rng.Float64() * p.cumulative[len(p.cumulative)-1]
+	for i, c := range p.cumulative {
+		if v < c {
+			return i
+		}
+	}
+	return len(p.cumulative) - 1
+}
+
+// setupScenarios parses the expectations and creates the http options of the scenarios,
+// and their results in total (ro being the normalized runner options).
+func setupScenarios(o *HTTPRunnerOptions, ro *periodic.RunnerOptions, total *HTTPRunnerResults,
+	expect *Expectation) ([]*HTTPOptions, []float64, error) {
+	if len(o.Scenarios) == 0 {
+		return nil, nil, nil
+	}
+	opts := make([]*HTTPOptions, len(o.Scenarios))
+	cumulative := make([]float64, len(o.Scenarios))
+	total.Scenarios = make([]ScenarioResults, len(o.Scenarios))
+	sum := 0.
+	for i := range o.Scenarios {
+		s := &o.Scenarios[i]
+		var err error
+		if opts[i], err = scenarioOptions(&o.HTTPOptions, s); err != nil {
+			return nil, nil, err
+		}
+		res := &total.Scenarios[i]
+		res.Scenario = *s
+		res.expect = expect
+		if s.Expect != "" {
+			if res.expect, err = ParseExpectation(s.Expect); err != nil {
+				return nil, nil, fmt.Errorf("scenario %s: %v", s.Name, err)
+			}
+		}
+		res.RetCodes = make(map[int]int64)
+		res.duration = stats.NewHistogram(ro.Offset.Seconds(), ro.Resolution)
+		sum += s.Weight
+		cumulative[i] = sum
+	}
+	return opts, cumulative, nil
+}
+
+// setupScenarios creates the clients and stats of the scenarios for 'thread' id.
+func (httpstate *HTTPRunnerResults) setupScenarios(total *HTTPRunnerResults, opts []*HTTPOptions, cumulative []float64, id int) error {
+	httpstate.Scenarios = make([]ScenarioResults, len(opts))
+	for i, so := range opts {
+		s := &httpstate.Scenarios[i]
+		so.ID = id
+		var err error
+		if s.client, err = NewClient(so); err != nil {
+			return err
+		}
+		s.Scenario = total.Scenarios[i].Scenario
+		s.expect = total.Scenarios[i].expect
+		s.RetCodes = make(map[int]int64)
+		s.duration = total.Scenarios[i].duration.Clone()
+	}
+	httpstate.picker = &scenarioPicker{
+		cumulative: cumulative,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))), // nolint: gosec // load mix, not crypto
+	}
+	return nil
+}
+
+// print outputs the summary of the scenario and exports its histogram.
+func (s *ScenarioResults) print(out io.Writer, percentiles []float64) {
+	s.DurationHistogram = s.duration.Export().CalcPercentiles(percentiles)
+	codes := make([]int, 0, len(s.RetCodes))
+	for k := range s.RetCodes {
+		codes = append(codes, k)
+	}
+	sort.Ints(codes)
+	var b strings.Builder
+	for _, k := range codes {
+		fmt.Fprintf(&b, ", code %d : %d", k, s.RetCodes[k])
+	}
+	if s.expect != nil {
+		fmt.Fprintf(&b, ", validation failures : %d", s.ValidationFailures)
+	}
+	_, _ = fmt.Fprintf(out, "Scenario %s (weight %g) : %d calls%s\n", s.Name, s.Weight, s.DurationHistogram.Count, b.String())
+	if log.LogVerbose() {
+		s.DurationHistogram.Print(out, "Scenario "+s.Name+" Histogram")
+	} else if log.Log(log.Warning) {
+		s.duration.Counter.Print(out, "Scenario "+s.Name+" duration")
+	}
+}
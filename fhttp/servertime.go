@@ -0,0 +1,187 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// SplitServerTimeSource splits a server time source like "Server-Timing:total" into the
+// header (or grpc metadata key) and the optional Server-Timing metric name.
+func SplitServerTimeSource(source string) (name string, metric string) {
+	if idx := strings.IndexByte(source, ':'); idx >= 0 {
+		return source[:idx], strings.TrimSpace(source[idx+1:])
+	}
+	return source, ""
+}
+
+// ParseServerTime returns the server processing time, in seconds, from the value of a
+// Server-Timing header (the dur= value, in milliseconds, of the metric named metric or,
+// when metric is empty, the largest one as the metrics usually overlap, e.g. total and db)
+// or of a header like X-Envoy-Upstream-Service-Time: a number of milliseconds or a
+// duration with its unit (e.g. 1.5ms).
+func ParseServerTime(value, metric string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if strings.Contains(value, "dur=") {
+		max, found := 0., false
+		for _, m := range strings.Split(value, ",") {
+			params := strings.Split(m, ";")
+			if metric != "" && !strings.EqualFold(strings.TrimSpace(params[0]), metric) {
+				continue
+			}
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "dur=") {
+					continue
+				}
+				ms, err := strconv.ParseFloat(strings.Trim(strings.TrimPrefix(param, "dur="), `"`), 64)
+				if err != nil {
+					return 0, false
+				}
+				if !found || ms > max {
+					max = ms
+				}
+				found = true
+			}
+		}
+		return max / 1000., found
+	}
+	if metric != "" {
+		return 0, false
+	}
+	if ms, err := strconv.ParseFloat(value, 64); err == nil {
+		return ms / 1000., true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false
+	}
+	return d.Seconds(), true
+}
+
+// ServerTimeRecorder records the server reported processing time of the calls
+// and the overhead (network, queuing, proxies, sidecars...) of each call: the
+// client measured duration minus the server reported time.
+// One per 'thread', merged with Transfer.
+type ServerTimeRecorder struct {
+	metric   string
+	server   *stats.Histogram
+	overhead *stats.Histogram
+	missing  int64
+}
+
+// ServerTimeResults are the exported ServerTimeRecorder histograms.
+type ServerTimeResults struct {
+	Source   string // header or metadata the server time is read from
+	Server   *stats.HistogramData
+	Overhead *stats.HistogramData
+	Missing  int64 // number of responses without (valid) server time
+}
+
+// NewServerTimeRecorder returns a recorder of the server time of source (a header or
+// metadata key with an optional :metric, see SplitServerTimeSource) with histograms of
+// the given offset and resolution.
+func NewServerTimeRecorder(source string, offset, resolution float64) *ServerTimeRecorder {
+	_, metric := SplitServerTimeSource(source)
+	return &ServerTimeRecorder{
+		metric:   metric,
+		server:   stats.NewHistogram(offset, resolution),
+		overhead: stats.NewHistogram(offset, resolution),
+	}
+}
+
+// Record records the server time parsed from value (see ParseServerTime) and the
+// overhead for a call which took clientDuration.
+func (s *ServerTimeRecorder) Record(value string, clientDuration time.Duration) {
+	server, ok := ParseServerTime(value, s.metric)
+	if !ok {
+		s.missing++
+		log.Debugf("Missing or invalid server time %q", value)
+		return
+	}
+	s.server.Record(server)
+	overhead := clientDuration.Seconds() - server
+	if overhead < 0 {
+		overhead = 0 // clocks granularity or server time including more than the response
+	}
+	s.overhead.Record(overhead)
+}
+
+// Clone returns an empty recorder with the same histograms parameters.
+func (s *ServerTimeRecorder) Clone() *ServerTimeRecorder {
+	return &ServerTimeRecorder{metric: s.metric, server: s.server.Clone(), overhead: s.overhead.Clone()}
+}
+
+// Reset clears the recorded data.
+func (s *ServerTimeRecorder) Reset() {
+	s.server.Reset()
+	s.overhead.Reset()
+	s.missing = 0
+}
+
+// Transfer merges the data of src into s and resets src.
+func (s *ServerTimeRecorder) Transfer(src *ServerTimeRecorder) {
+	s.server.Transfer(src.server)
+	s.overhead.Transfer(src.overhead)
+	s.missing += src.missing
+	src.missing = 0
+}
+
+// Results exports the histograms, with the given percentiles, and prints their summary to out.
+func (s *ServerTimeRecorder) Results(out io.Writer, source string, percentiles []float64) *ServerTimeResults {
+	res := &ServerTimeResults{
+		Source:   source,
+		Server:   s.server.Export().CalcPercentiles(percentiles),
+		Overhead: s.overhead.Export().CalcPercentiles(percentiles),
+		Missing:  s.missing,
+	}
+	_, _ = fmt.Fprintf(out, "Server time (%s) missing in %d responses\n", source, s.missing)
+	if log.LogVerbose() {
+		res.Server.Print(out, "Server Time Histogram")
+		res.Overhead.Print(out, "Client minus Server Time Histogram")
+	} else if log.Log(log.Warning) {
+		s.server.Counter.Print(out, "Server time")
+		s.overhead.Counter.Print(out, "Client minus Server time")
+	}
+	return res
+}
+
+// responseHeaderGetter is implemented by the clients which can return the
+// headers of their last response.
+type responseHeaderGetter interface {
+	responseHeader(name string) string
+}
+
+// findHeader returns the value of the header name in the raw http response headers.
+func findHeader(headers []byte, name string) string {
+	lines := bytes.Split(headers, []byte("\r\n"))
+	for _, line := range lines[1:] { // skipping the status line
+		if idx := bytes.IndexByte(line, ':'); idx > 0 && strings.EqualFold(string(line[:idx]), name) {
+			return string(bytes.TrimSpace(line[idx+1:]))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"fortio.org/fortio/log"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketFrame is a websocket message with its type (websocket.TextFrame or BinaryFrame).
+type WebSocketFrame struct {
+	Data []byte
+	Type byte
+}
+
+// WebSocketFrameCodec sends and receives WebSocketFrame (pointers), keeping the frame type.
+var WebSocketFrameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(*WebSocketFrame)
+		return f.Data, f.Type, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*WebSocketFrame)
+		f.Data, f.Type = data, payloadType
+		return nil
+	},
+}
+
+// isWebSocketUpgrade returns true for websocket handshake requests.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// WebSocketEchoHandler echoes back the messages it receives, as text or binary
+// like they were sent. The EchoHandler uses it for websocket upgrade requests.
+// Unlike websocket.Handler it accepts any (or no) Origin.
+var WebSocketEchoHandler = websocket.Server{Handler: webSocketEcho}
+
+func webSocketEcho(ws *websocket.Conn) {
+	log.LogVf("WebSocket echo connection from %v", ws.Request().RemoteAddr)
+	defer ws.Close()
+	var f WebSocketFrame
+	for {
+		err := WebSocketFrameCodec.Receive(ws, &f)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Infof("WebSocket echo read error: %v", err)
+			}
+			return
+		}
+		if err = WebSocketFrameCodec.Send(ws, &f); err != nil {
+			log.Infof("WebSocket echo write error: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// DNSResolver methods, how the address of each new connection is picked among the
+// resolved (A and AAAA) addresses.
+const (
+	DNSFirst      = "first"       // always the first address (the default)
+	DNSRoundRobin = "round-robin" // each new connection uses the next address
+	DNSRandom     = "random"      // a random address for each new connection
+)
+
+// Lookup is the function used by the DNSResolver to resolve the host (net.LookupIP, changeable for tests).
+var Lookup = net.LookupIP
+
+// DNSResolver resolves a host once and gives its addresses to the new connections,
+// optionally re-resolving it in the background every refresh period during the run
+// (until Stop). It is shared by the clients ('threads') of a run.
+type DNSResolver struct {
+	generation uint64 // atomic (first for 64 bits alignment)
+	host       string
+	method     string
+	refresh    time.Duration
+	stop       chan struct{}
+	done       chan struct{}
+	stopOnce   sync.Once
+	mutex      sync.Mutex
+	ips        []net.IP
+	next       int
+	lookups    int64
+	errors     int64
+	lookupTime *stats.Histogram
+}
+
+// DNSResults are the resolutions of a run.
+type DNSResults struct {
+	Host       string
+	Method     string
+	Refresh    time.Duration
+	IPs        []string // last resolved addresses
+	Lookups    int64
+	Errors     int64  // failed lookups, the previous addresses are then kept
+	Changes    uint64 // number of times the addresses changed during the run
+	LookupTime *stats.HistogramData
+}
+
+// NewDNSResolver returns a resolver for host, which is resolved immediately and then
+// every refresh period, when > 0, until Stop is called.
+// method is one of DNSFirst (when empty), DNSRoundRobin or DNSRandom.
+func NewDNSResolver(host, method string, refresh time.Duration) (*DNSResolver, error) {
+	switch method {
+	case "":
+		method = DNSFirst
+	case DNSFirst, DNSRoundRobin, DNSRandom:
+	default:
+		return nil, fmt.Errorf("invalid dns method %q, should be %s, %s or %s", method, DNSFirst, DNSRoundRobin, DNSRandom)
+	}
+	r := &DNSResolver{
+		host:       strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"),
+		method:     method,
+		refresh:    refresh,
+		lookupTime: stats.NewHistogram(0, 0.0001),
+	}
+	if err := r.lookup(); err != nil {
+		return nil, err
+	}
+	atomic.StoreUint64(&r.generation, 0) // the first resolution isn't a change
+	log.Infof("Resolved %s to %v, using %s address for each connection", r.host, r.ips, method)
+	if refresh > 0 {
+		r.stop, r.done = make(chan struct{}), make(chan struct{})
+		go r.refresher()
+	}
+	return r, nil
+}
+
+// refresher re-resolves the host every refresh period until Stop, in the background so
+// the calls never wait for the lookups.
+func (r *DNSResolver) refresher() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			_ = r.lookup()
+		}
+	}
+}
+
+// Stop ends the background re-resolution of the host, at the end of the run, and
+// waits for an ongoing lookup to finish.
+func (r *DNSResolver) Stop() {
+	if r.stop == nil {
+		return
+	}
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+// lookup resolves the host, keeping the previous addresses in case of error. The lookup
+// itself is done without holding the mutex, so the new connections aren't delayed.
+func (r *DNSResolver) lookup() error {
+	start := time.Now()
+	ips, err := Lookup(r.host)
+	elapsed := time.Since(start)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookupTime.Record(elapsed.Seconds())
+	r.lookups++
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no address found for %s", r.host)
+	}
+	if err != nil {
+		r.errors++
+		log.Errf("Unable to lookup %s: %v", r.host, err)
+		return err
+	}
+	if !sameIPs(ips, r.ips) {
+		if r.ips != nil {
+			log.Infof("Addresses of %s changed from %v to %v", r.host, r.ips, ips)
+		}
+		r.ips = ips
+		r.next = 0
+		atomic.AddUint64(&r.generation, 1)
+	}
+	return nil
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as, bs := make([]string, len(a)), make([]string, len(b))
+	for i := range a {
+		as[i], bs[i] = a[i].String(), b[i].String()
+	}
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Generation returns the generation of the addresses, incremented each time they change.
+// Cheap enough to be called for each call, so the clients can drop their (keep alive)
+// connections when the addresses change.
+func (r *DNSResolver) Generation() uint64 {
+	return atomic.LoadUint64(&r.generation)
+}
+
+// IP returns the address for a new connection, as per the method.
+func (r *DNSResolver) IP() net.IP {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch r.method {
+	case DNSRoundRobin:
+		ip := r.ips[r.next%len(r.ips)]
+		r.next++
+		return ip
+	case DNSRandom:
+		return r.ips[rand.Intn(len(r.ips))] // nolint: gosec // we want fast not crypto
+	}
+	return r.ips[0]
+}
+
+// Results returns the resolutions summary, with the lookup time histogram with the given percentiles.
+func (r *DNSResolver) Results(percentiles []float64) *DNSResults {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := &DNSResults{
+		Host:       r.host,
+		Method:     r.method,
+		Refresh:    r.refresh,
+		Lookups:    r.lookups,
+		Errors:     r.errors,
+		Changes:    atomic.LoadUint64(&r.generation),
+		LookupTime: r.lookupTime.Export().CalcPercentiles(percentiles),
+	}
+	for _, ip := range r.ips {
+		res.IPs = append(res.IPs, ip.String())
+	}
+	return res
+}
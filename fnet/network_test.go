@@ -23,6 +23,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -648,3 +649,100 @@ func TestDebugSummary(t *testing.T) {
 func init() {
 	log.SetLogLevel(log.Debug)
 }
+
+func TestDNSResolver(t *testing.T) {
+	defer func() { fnet.Lookup = net.LookupIP }()
+	var mutex sync.Mutex
+	var lookups int
+	var lookupErr error
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("::1")}
+	fnet.Lookup = func(host string) ([]net.IP, error) {
+		if host != "headless.local" {
+			t.Errorf("Unexpected lookup of %q", host)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		lookups++
+		return ips, lookupErr
+	}
+	// waits for the background refreshes to do at least n lookups.
+	waitLookups := func(n int) int {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+			mutex.Lock()
+			l := lookups
+			mutex.Unlock()
+			if l >= n {
+				return l
+			}
+		}
+		t.Fatalf("Timed out waiting for %d lookups", n)
+		return 0
+	}
+	if _, err := fnet.NewDNSResolver("headless.local", "foo", 0); err == nil {
+		t.Errorf("Expected error for invalid method")
+	}
+	r, err := fnet.NewDNSResolver("headless.local", fnet.DNSRoundRobin, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for i := 0; i < 4; i++ {
+		got = append(got, r.IP().String())
+	}
+	if strings.Join(got, " ") != "10.0.0.1 10.0.0.2 ::1 10.0.0.1" {
+		t.Errorf("Unexpected round robin %v", got)
+	}
+	r.Stop() // no-op without refresh
+	if r.Generation() != 0 || lookups != 1 {
+		t.Errorf("No refresh expected, got generation %d after %d lookups", r.Generation(), lookups)
+	}
+	lookups = 0
+	r, err = fnet.NewDNSResolver("[headless.local]", "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := r.IP().String(); ip != "10.0.0.1" || r.IP().String() != ip {
+		t.Errorf("Expected first address, got %s", ip)
+	}
+	mutex.Lock()
+	ips = []net.IP{net.ParseIP("::1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")}
+	mutex.Unlock()
+	waitLookups(2)
+	if g := r.Generation(); g != 0 { // same addresses, in a different order
+		t.Errorf("Unexpected change %d", g)
+	}
+	mutex.Lock()
+	ips = []net.IP{net.ParseIP("10.0.0.3")}
+	n := lookups
+	mutex.Unlock()
+	waitLookups(n + 2) // the one after the change is done
+	if g := r.Generation(); g != 1 || r.IP().String() != "10.0.0.3" {
+		t.Errorf("Expected new addresses, got generation %d", g)
+	}
+	mutex.Lock()
+	lookupErr = fmt.Errorf("test lookup error")
+	n = lookups
+	mutex.Unlock()
+	waitLookups(n + 2)
+	if g := r.Generation(); g != 1 || r.IP().String() != "10.0.0.3" {
+		t.Errorf("Expected previous addresses to be kept on errors, got generation %d", g)
+	}
+	r.Stop()
+	r.Stop() // can be called more than once
+	res := r.Results([]float64{50})
+	time.Sleep(30 * time.Millisecond)
+	mutex.Lock()
+	n = lookups
+	mutex.Unlock()
+	if int64(n) != res.Lookups {
+		t.Errorf("Expected no lookups after Stop, got %d instead of %d", n, res.Lookups)
+	}
+	if res.Lookups < 5 || res.Errors < 1 || res.Changes != 1 || res.Host != "headless.local" ||
+		res.Method != fnet.DNSFirst || len(res.IPs) != 1 || res.LookupTime.Count != res.Lookups {
+		t.Errorf("Unexpected dns results %+v", res)
+	}
+	lookupErr = fmt.Errorf("test lookup error")
+	if _, err = fnet.NewDNSResolver("headless.local", fnet.DNSRandom, 0); err == nil {
+		t.Errorf("Expected error for failed lookup")
+	}
+}
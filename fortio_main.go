@@ -21,14 +21,20 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	neturl "net/url"
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"fortio.org/fortio/auth"
 	"fortio.org/fortio/bincommon"
+	"fortio.org/fortio/compare"
 	"fortio.org/fortio/dflag/configmap"
+	"fortio.org/fortio/distributed"
 	"fortio.org/fortio/fgrpc"
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/fnet"
@@ -36,9 +42,11 @@ import (
 	"fortio.org/fortio/periodic"
 	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
+	"fortio.org/fortio/tracing"
 	"fortio.org/fortio/udprunner"
 	"fortio.org/fortio/ui"
 	"fortio.org/fortio/version"
+	"fortio.org/fortio/wsrunner"
 )
 
 // -- Start of support for multiple proxies (-P) flags on cmd line.
@@ -69,9 +77,23 @@ func (f *httpMultiFlagList) Set(value string) error {
 
 // -- End of -M support.
 
+// -- Same for -grpc-metadata.
+type grpcMetadataFlagList struct{}
+
+func (f *grpcMetadataFlagList) String() string {
+	return ""
+}
+
+func (f *grpcMetadataFlagList) Set(value string) error {
+	grpcMetadata = append(grpcMetadata, value)
+	return nil
+}
+
+// -- End of -grpc-metadata support.
+
 // Usage to a writer.
 func usage(w io.Writer, msgs ...interface{}) {
-	_, _ = fmt.Fprintf(w, "Φορτίο %s usage:\n\t%s command [flags] target\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
+	_, _ = fmt.Fprintf(w, "Φορτίο %s usage:\n\t%s command [flags] target\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
 		version.Short(),
 		os.Args[0],
 		"where command is one of: load (load testing), server (starts ui, http-echo,",
@@ -79,7 +101,8 @@ func usage(w io.Writer, msgs ...interface{}) {
 		" server), report (report only UI server), redirect (only the redirect server),",
 		" proxies (only the -M and -P configured proxies), grpcping (grpc client),",
 		" or curl (single URL debug), or nc (single tcp or udp:// connection),",
-		" or version (prints the version).",
+		" or worker (server registering with a -coordinator), or diff (compares 2 json",
+		" results), or version (prints the version).",
 		"where target is a url (http load tests) or host:port (grpc health test).")
 	bincommon.FlagsUsage(w, msgs...)
 }
@@ -123,6 +146,10 @@ var (
 		"http echo server `URI` for debug, empty turns off that part (more secure)")
 	jsonFlag = flag.String("json", "",
 		"Json output to provided file `path` or '-' for stdout (empty = no json output, unless -a is used)")
+	csvFlag = flag.String("csv", "",
+		"Csv output (summary, percentiles, histogram buckets and return codes) to provided file `path` or '-' for stdout")
+	openMetricsFlag = flag.String("openmetrics", "",
+		"OpenMetrics text format output of the results to provided file `path` or '-' for stdout")
 	uiPathFlag = flag.String("ui-path", "/fortio/", "http server `URI` for UI, empty turns off that part (more secure)")
 	curlFlag   = flag.Bool("curl", false, "Just fetch the content once")
 	labelsFlag = flag.String("labels", "",
@@ -136,6 +163,9 @@ var (
 	// -M flag.
 	httpMultiFlags httpMultiFlagList
 	httpMulties    = make([]string, 0)
+	// -grpc-metadata flag.
+	grpcMetadataFlags grpcMetadataFlagList
+	grpcMetadata      = make([]string, 0)
 
 	defaultDataDir = "."
 
@@ -164,6 +194,31 @@ var (
 	healthSvcFlag  = flag.String("healthservice", "", "which service string to pass to health check")
 	pingDelayFlag  = flag.Duration("grpc-ping-delay", 0, "grpc ping delay in response")
 	streamsFlag    = flag.Int("s", 1, "Number of streams per grpc connection")
+	grpcPeersFlag  = flag.Bool("grpc-peers", false,
+		"grpc load test: record and report the distribution of peer addresses serving the calls (small per call cost)")
+	grpcInflightFlag = flag.Int("grpc-client-max-inflight", 0,
+		"grpc load test: client side limit of calls in flight per connection (see -s), extra calls wait for a slot"+
+			" and the queue wait time is reported. Default (0) is unlimited.")
+	grpcPhasesFlag = flag.String("grpc-phases", "",
+		"grpc load test: record the client side time of each call phase (send, wait, receive, finish) and write the totals"+
+			" in folded stacks (flamegraph) format to `file` or '-' for stdout")
+	grpcStreamModeFlag = flag.String("grpc-stream", "",
+		"grpc load test: use the ping streaming methods instead of unary calls, `mode` is one of "+
+			fgrpc.StreamBidi+", "+fgrpc.StreamClient+" or "+fgrpc.StreamServer+" (implies -ping)")
+	grpcStreamMsgsFlag  = flag.Int("grpc-stream-messages", 1, "grpc load test: number of messages per stream (see -grpc-stream)")
+	grpcStreamReuseFlag = flag.Bool("grpc-stream-reuse", false,
+		"grpc load test: reuse the same "+fgrpc.StreamBidi+" stream for all the calls of a connection's stream instead of a new one per call")
+	grpcMethodFlag = flag.String("grpc-method", "",
+		"grpc load test: call `package.Service/Method` (any unary method) instead of health or ping, see -grpc-data and -grpc-proto")
+	grpcDataFlag  = flag.String("grpc-data", "", "grpc load test: `json` request for -grpc-method, default is an empty message")
+	grpcProtoFlag = flag.String("grpc-proto", "",
+		"grpc load test: .proto `file` (compiled using protoc, which must be in the PATH, with the file's directory as import path)"+
+			" or descriptor set file (protoc --include_imports --descriptor_set_out) describing -grpc-method,"+
+			" default is to use the server reflection service")
+	grpcConnsFlag = flag.Int("grpc-conns", 0,
+		"grpc load test: number of connections the -c clients are spread over (round robin), instead of the default"+
+			" of one connection per client with -s streams each")
+	grpcTimeoutFlag = flag.Duration("grpc-timeout", 0, "grpc load test: deadline of each call, default (0) is no deadline")
 
 	maxStreamsFlag = flag.Uint("grpc-max-streams", 0,
 		"MaxConcurrentStreams for the grpc server. Default (0) is to leave the option unset.")
@@ -171,12 +226,98 @@ var (
 	uniformFlag   = flag.Bool("uniform", false, "set to true to de-synchronize parallel clients' requests uniformly")
 	nocatchupFlag = flag.Bool("nocatchup", false,
 		"set to exact fixed qps and prevent fortio from trying to catchup when the target fails to keep up temporarily")
+	warmupCallsFlag = flag.Int64("warmup-calls", 0,
+		"Number of warmup calls, made before the measured run and not included in its histogram. Default (0) is no warmup.")
+	warmupDurationFlag = flag.Duration("warmup-duration", 0,
+		"Warmup `duration`, at the same qps, before the measured run (if -warmup-calls isn't set). Default (0) is no warmup.")
+	qpsProfileFlag = flag.String("qps-profile", "",
+		"Load `profile` of successive stages, each at its own qps, e.g. \"100:30s,500:30s,max:1m\" (replaces -qps, -t and -n)")
+	rampFlag = flag.String("ramp", "",
+		"Linear qps ramp `startQPS:endQPS:duration`, e.g. \"0:1000:2m\", run as -ramp-steps stages (replaces -qps, -t and -n)")
+	rampStepsFlag = flag.Int("ramp-steps", 10, "Number of stages (steps) for -ramp")
+	openLoopFlag  = flag.String("open-loop", "",
+		"Open loop mode: start the calls at the -qps rate independently of the previous calls completion, with `arrivals` "+
+			periodic.ArrivalsFixed+" or "+periodic.ArrivalsPoisson+", using up to -c concurrent calls")
+	openLoopQueueFlag = flag.Int("open-loop-queue", 0,
+		"Number of calls which can wait for a free client in -open-loop mode, the ones beyond are dropped")
+	snapshotIntervalFlag = flag.Duration("snapshot-interval", 0,
+		"Print interim results of the run so far (qps, errors, p50/p99 of the interval) as json lines every `interval`."+
+			" Default (0) is no interim results")
+	soakIntervalFlag = flag.Duration("soak-interval", 0,
+		"Soak mode: summarize the calls (qps, errors, avg, p50/p90/p99, max) of each `interval` window in the results (and"+
+			" -soak-file) and report the p99 trend over the run. Default (0) is no windows")
+	soakFileFlag = flag.String("soak-file", "",
+		"Soak mode: json lines `file` each -soak-interval window summary is written to as it completes")
+	soakMaxDriftFlag = flag.String("soak-max-drift", "20%",
+		"Soak mode: flag latency drift when the fitted p99 increases by more than that `fraction` or percentage over the run")
+	distributedFlag = flag.String("distributed", "",
+		"Distributed http load: split the -qps and -n over the fortio workers (ui base urls) listed in the json (not yaml) `file`"+
+			" or registered with the coordinator at that url, and merge their results")
+	coordinatorFlag = flag.String("coordinator", "",
+		"Coordinator ui base `url` (e.g. http://coordinator:8080/fortio/) the fortio worker command registers with")
+	workerURLFlag = flag.String("worker-url", "",
+		"Ui base `url` the worker is reachable at, to register with the -coordinator (default http://hostname:port/fortio/)")
+	scenariosFlag = flag.String("scenarios", "",
+		"Mixed workload: json (not yaml) `file` with a list of weighted http scenarios (Name, Weight, URL, Payload, "+
+			"ContentType, Headers, Expect) each call picks one of, with per scenario results, instead of the url argument")
+	expectFlag = flag.String("expect", "",
+		"Check the (2xx) http response bodies or the json form of the grpc responses, the calls not matching are counted as "+
+			"validation failures: exact `payload`, or regex:<regular expression>, or json:<path> (e.g. json:.items[0].id) for a "+
+			"non empty value at that path, or json:<path>=<value>")
+	serverTimeFlag = flag.String("server-time", "",
+		"Record histograms of the server reported processing time and of the client minus server time (network, "+
+			"proxies...) from that http response `header` (e.g. Server-Timing or X-Envoy-Upstream-Service-Time) or grpc "+
+			"trailer/header metadata key (e.g. server-timing, set by fortio's ping server). For Server-Timing the largest "+
+			"dur is used, or the one of the metric named after a colon (e.g. Server-Timing:total)")
+	retryAttemptsFlag = flag.Int("retry-attempts", 0,
+		"Client side retries of the failed http and grpc calls: maximum number of attempts of each call, including the "+
+			"first one (default 0 is no retry). The first attempts latency and errors are then reported separately")
+	retryBackoffFlag = flag.Duration("retry-backoff", 25*time.Millisecond,
+		"Wait before the first -retry-attempts retry, doubled for each following one")
+	retryMaxBackoffFlag = flag.Duration("retry-max-backoff", time.Second, "Maximum wait between -retry-attempts attempts")
+	retryJitterFlag     = flag.String("retry-jitter", "none",
+		"Randomization of the -retry-attempts waits, to not retry in sync: none, full (between 0 and the backoff) or "+
+			"equal (half the backoff plus up to the other half)")
+	retryOnFlag = flag.String("retry-on", "",
+		"Comma separated `codes` of the failed calls to retry: http codes (503, -1 for socket errors) or classes (5xx), "+
+			"grpc codes (UNAVAILABLE or 14...), default is all the failed calls")
+	otelFlag = flag.Bool("otel", false,
+		"Send a new W3C traceparent header (http) or metadata (grpc) with each call, see also -otel-endpoint")
+	otelSampleFlag   = flag.Float64("otel-sample", 1, "Fraction of the -otel calls marked as sampled (and exported as spans)")
+	otelEndpointFlag = flag.String("otel-endpoint", "",
+		"OpenTelemetry collector OTLP/HTTP base `url` (e.g. http://localhost:4318) to export the sampled -otel calls as client spans")
+	otelServiceFlag = flag.String("otel-service", "fortio", "Service name of the exported -otel spans")
+	authFlag        = flag.String("auth", "",
+		"Authorization `spec` for the http, grpc and websocket calls, updated during the run: a static (bearer) token,"+
+			" file:path for a token file re-read when it changes or oauth2:token_url?client_id=x&client_secret=y&scope=z"+
+			" for OAuth2 client credentials tokens refreshed before they expire")
+	promPushFlag = flag.String("prometheus-push", "",
+		"Prometheus push gateway base `url` (e.g. http://pushgateway:9091) to send the results metrics to at the end of the run")
+	promJobFlag = flag.String("prometheus-job", "fortio", "Prometheus push gateway `job` name for -prometheus-push")
+	// Assertions (SLO) checked at the end of the load test.
+	maxP50Flag       = flag.Duration("max-p50", 0, "Fail (non zero exit code) if the median latency is above that `duration`")
+	maxP90Flag       = flag.Duration("max-p90", 0, "Fail (non zero exit code) if the 90th percentile latency is above that `duration`")
+	maxP99Flag       = flag.Duration("max-p99", 0, "Fail (non zero exit code) if the 99th percentile latency is above that `duration`")
+	maxP999Flag      = flag.Duration("max-p999", 0, "Fail (non zero exit code) if the 99.9th percentile latency is above that `duration`")
+	maxAvgFlag       = flag.Duration("max-avg", 0, "Fail (non zero exit code) if the average latency is above that `duration`")
+	maxErrorRateFlag = flag.String("max-error-rate", "",
+		"Fail (non zero exit code) if more than that `rate` of the calls fail, as a fraction or percentage (e.g. 0.001 or 0.1%)")
+	minQPSFlag = flag.Float64("min-qps", 0, "Fail (non zero exit code) if the actual qps is below that value")
+	// diff mode thresholds.
+	diffMaxQPSDecreaseFlag = flag.String("max-qps-decrease", "",
+		"diff: fail (non zero exit code) if the qps of the 2nd result decreased by more than that `fraction` or percentage (e.g. 5%)")
+	diffMaxLatencyIncreaseFlag = flag.String("max-latency-increase", "",
+		"diff: fail (non zero exit code) if the average or a percentile (-p) latency increased by more than that `fraction` or percentage")
+	diffMaxErrorRateIncreaseFlag = flag.String("max-error-rate-increase", "",
+		"diff: fail (non zero exit code) if the error rate increased by more than that `rate` (e.g. 0.1% more errors)")
 	// nc mode flag(s).
 	ncDontStopOnCloseFlag = flag.Bool("nc-dont-stop-on-eof", false, "in netcat (nc) mode, don't abort as soon as remote side closes")
 	// Mirror origin global setting (should be per destination eventually).
 	mirrorOriginFlag = flag.Bool("multi-mirror-origin", true, "Mirror the request url to the target for multi proxies (-M)")
 	multiSerialFlag  = flag.Bool("multi-serial-mode", false, "Multi server (-M) requests one at a time instead of parallel mode")
 	udpTimeoutFlag   = flag.Duration("udp-timeout", udprunner.UDPTimeOutDefaultValue, "Udp timeout")
+	udpTemplateFlag  = flag.Bool("udp-template", false,
+		"Udp -payload is a template, its {conn}, {seq} and {time} are replaced for each request")
 
 	accessLogFileFlag = flag.String("access-log-file", "",
 		"file `path` to log all requests to. Maybe have performance impacts")
@@ -190,6 +331,8 @@ func main() {
 	flag.Var(&proxiesFlags, "P",
 		"Tcp proxies to run, e.g -P \"localport1 dest_host1:dest_port1\" -P \"[::1]:0 www.google.com:443\" ...")
 	flag.Var(&httpMultiFlags, "M", "Http multi proxy to run, e.g -M \"localport1 baseDestURL1 baseDestURL2\" -M ...")
+	flag.Var(&grpcMetadataFlags, "grpc-metadata",
+		"grpc load test: `key:value` metadata to send with each call, e.g -grpc-metadata \"dapr-api-token: xyz\" -grpc-metadata ...")
 	bincommon.SharedMain(usage)
 	if len(os.Args) < 2 {
 		usageErr("Error: need at least 1 command parameter")
@@ -257,7 +400,7 @@ func main() {
 		if startProxies() == 0 {
 			usageErr("Error: fortio proxies command needs at least one -P / -M flag")
 		}
-	case "server":
+	case "server", "worker":
 		isServer = true
 		if *tcpPortFlag != disabled {
 			fnet.TCPEchoServer("tcp-echo", *tcpPortFlag)
@@ -275,8 +418,13 @@ func main() {
 			os.Exit(1) // error already logged
 		}
 		startProxies()
+		if command == "worker" {
+			startWorker()
+		}
 	case "grpcping":
 		grpcClient()
+	case "diff":
+		fortioDiff(percList)
 	default:
 		usageErr("Error: unknown command ", command)
 	}
@@ -350,10 +498,29 @@ func fortioNC() {
 
 // nolint: funlen, gocognit // maybe refactor/shorten later.
 func fortioLoad(justCurl bool, percList []float64) {
-	if len(flag.Args()) != 1 {
+	if *scenariosFlag != "" && !justCurl {
+		if len(flag.Args()) != 0 {
+			usageErr("Error: fortio load -scenarios doesn't take a url or destination argument")
+		}
+	} else if len(flag.Args()) != 1 {
 		usageErr("Error: fortio load/curl needs a url or destination")
 	}
 	httpOpts := bincommon.SharedHTTPOptions()
+	if *otelFlag {
+		httpOpts.Tracer = tracing.NewTracer(&tracing.Options{
+			SampleRatio: *otelSampleFlag,
+			Endpoint:    *otelEndpointFlag,
+			ServiceName: *otelServiceFlag,
+		})
+		defer httpOpts.Tracer.Close()
+	}
+	if *authFlag != "" {
+		p, err := auth.Parse(*authFlag)
+		if err != nil {
+			log.Fatalf("Invalid -auth %q: %v", *authFlag, err)
+		}
+		httpOpts.Auth = p
+	}
 	if justCurl {
 		bincommon.FetchURL(httpOpts)
 		return
@@ -369,17 +536,42 @@ func fortioLoad(justCurl bool, percList []float64) {
 		qps = float64(*exactlyFlag) / (*durationFlag).Seconds()
 		log.LogVf("Calculated QPS to do %d request in %v: %f", *exactlyFlag, *durationFlag, qps)
 	}
-	_, _ = fmt.Fprintf(out, "Fortio %s running at %g queries per second, %d->%d procs",
-		version.Short(), qps, prevGoMaxProcs, runtime.GOMAXPROCS(0))
-	if *exactlyFlag > 0 {
-		_, _ = fmt.Fprintf(out, ", for %d calls: %s\n", *exactlyFlag, url)
+	var stages []periodic.Stage
+	var err error
+	if *qpsProfileFlag != "" && *rampFlag != "" {
+		usageErr("Error: can't use both `-qps-profile` and `-ramp`")
+	}
+	if *qpsProfileFlag != "" {
+		stages, err = periodic.ParseQPSProfile(*qpsProfileFlag)
+	} else if *rampFlag != "" {
+		stages, err = periodic.ParseRamp(*rampFlag, *rampStepsFlag)
+	}
+	if err != nil {
+		usageErr("Error: ", err)
+	}
+	if *openLoopFlag != "" && *openLoopFlag != periodic.ArrivalsFixed && *openLoopFlag != periodic.ArrivalsPoisson {
+		usageErr("Error: `-open-loop` arrivals should be " + periodic.ArrivalsFixed + " or " + periodic.ArrivalsPoisson)
+	}
+	if *openLoopFlag != "" && (qps <= 0 || stages != nil) {
+		usageErr("Error: `-open-loop` needs a target `-qps` and can't be used with a qps profile")
+	}
+	assertions := loadAssertions()
+	if stages != nil {
+		_, _ = fmt.Fprintf(out, "Fortio %s running qps profile %s, %d->%d procs: %s\n",
+			version.Short(), periodic.ProfileString(stages), prevGoMaxProcs, runtime.GOMAXPROCS(0), url)
 	} else {
-		if *durationFlag <= 0 {
-			// Infinite mode is determined by having a negative duration value
-			*durationFlag = -1
-			_, _ = fmt.Fprintf(out, ", until interrupted: %s\n", url)
+		_, _ = fmt.Fprintf(out, "Fortio %s running at %g queries per second, %d->%d procs",
+			version.Short(), qps, prevGoMaxProcs, runtime.GOMAXPROCS(0))
+		if *exactlyFlag > 0 {
+			_, _ = fmt.Fprintf(out, ", for %d calls: %s\n", *exactlyFlag, url)
 		} else {
-			_, _ = fmt.Fprintf(out, ", for %v: %s\n", *durationFlag, url)
+			if *durationFlag <= 0 {
+				// Infinite mode is determined by having a negative duration value
+				*durationFlag = -1
+				_, _ = fmt.Fprintf(out, ", until interrupted: %s\n", url)
+			} else {
+				_, _ = fmt.Fprintf(out, ", for %v: %s\n", *durationFlag, url)
+			}
 		}
 	}
 	if qps <= 0 {
@@ -412,14 +604,30 @@ func fortioLoad(justCurl bool, percList []float64) {
 		RunID:       *bincommon.RunIDFlag,
 		Offset:      *offsetFlag,
 		NoCatchUp:   *nocatchupFlag,
+		// warmup
+		WarmupCalls:    *warmupCallsFlag,
+		WarmupDuration: *warmupDurationFlag,
+		Stages:         stages,
+		OpenLoop:       *openLoopFlag,
+		OpenLoopQueue:  *openLoopQueueFlag,
+		// interim results
+		SnapshotInterval: *snapshotIntervalFlag,
+		// soak mode
+		SoakInterval: *soakIntervalFlag,
+		SoakFile:     *soakFileFlag,
 	}
-	err := ro.AddAccessLogger(*accessLogFileFlag, *accessLogFileFormat)
+	if ro.SoakMaxDrift, err = compare.ParseThreshold(*soakMaxDriftFlag); err != nil {
+		usageErr("Error: invalid -soak-max-drift: ", err)
+	}
+	err = ro.AddAccessLogger(*accessLogFileFlag, *accessLogFileFormat)
 	if err != nil {
 		// Error already logged.
 		os.Exit(1)
 	}
 	var res periodic.HasRunnerResult
-	if *grpcFlag {
+	if *distributedFlag != "" {
+		res, err = runDistributed(url, &ro, httpOpts)
+	} else if *grpcFlag {
 		o := fgrpc.GRPCRunnerOptions{
 			RunnerOptions:      ro,
 			Destination:        url,
@@ -429,9 +637,31 @@ func fortioLoad(justCurl bool, percList []float64) {
 			Payload:            httpOpts.PayloadString(),
 			Delay:              *pingDelayFlag,
 			UsePing:            *doPingLoadFlag,
+			CapturePeers:       *grpcPeersFlag,
+			RecordPhases:       *grpcPhasesFlag != "",
+			MaxInflightPerConn: *grpcInflightFlag,
+			StreamMode:         *grpcStreamModeFlag,
+			StreamMessages:     *grpcStreamMsgsFlag,
+			StreamReuse:        *grpcStreamReuseFlag,
+			Method:             *grpcMethodFlag,
+			Proto:              *grpcProtoFlag,
+			Data:               *grpcDataFlag,
+			Metadata:           grpcMetadata,
+			CallTimeout:        *grpcTimeoutFlag,
+			Connections:        *grpcConnsFlag,
+			Tracer:             httpOpts.Tracer,
+			Expect:             *expectFlag,
+			Auth:               httpOpts.Auth,
+			ServerTimeMetadata: *serverTimeFlag,
+			Retry:              retryPolicy(),
 		}
 		o.TLSOptions = httpOpts.TLSOptions
-		res, err = fgrpc.RunGRPCTest(&o)
+		var gres *fgrpc.GRPCRunnerResults
+		gres, err = fgrpc.RunGRPCTest(&o)
+		if err == nil && o.RecordPhases {
+			writePhases(gres, *grpcPhasesFlag)
+		}
+		res = gres
 	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
 		o := tcprunner.RunnerOptions{
 			RunnerOptions: ro,
@@ -447,7 +677,30 @@ func fortioLoad(justCurl bool, percList []float64) {
 		o.ReqTimeout = *udpTimeoutFlag
 		o.Destination = url
 		o.Payload = httpOpts.Payload
+		o.PayloadTemplate = *udpTemplateFlag
 		res, err = udprunner.RunUDPTest(&o)
+	} else if wsrunner.IsWebSocketURL(url) {
+		o := wsrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.TLSOptions = httpOpts.TLSOptions
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		o.Headers = httpOpts.AllHeaders().Clone()
+		o.Auth = httpOpts.Auth
+		for _, h := range []string{"Content-Length", "Content-Type", "Host"} {
+			o.Headers.Del(h) // the payload is sent as messages, not in the handshake request
+		}
+		res, err = wsrunner.RunWSTest(&o)
+	} else if _, _, found := periodic.LookupRunnerType(url); found {
+		o := periodic.CustomRunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.Target = url
+		o.Payload = httpOpts.Payload
+		o.Timeout = httpOpts.HTTPReqTimeOut
+		res, err = periodic.RunCustomTest(&o)
 	} else {
 		o := fhttp.HTTPRunnerOptions{
 			HTTPOptions:        *httpOpts,
@@ -455,13 +708,24 @@ func fortioLoad(justCurl bool, percList []float64) {
 			Profiler:           *profileFlag,
 			AllowInitialErrors: *allowInitialErrorsFlag,
 			AbortOn:            *abortOnFlag,
+			Expect:             *expectFlag,
+			ServerTimeHeader:   *serverTimeFlag,
+			Retry:              retryPolicy(),
+		}
+		if *scenariosFlag != "" {
+			o.Scenarios, err = fhttp.ReadScenarios(*scenariosFlag)
+		}
+		if err == nil {
+			res, err = fhttp.RunHTTPTest(&o)
 		}
-		res, err = fhttp.RunHTTPTest(&o)
 	}
 	if err != nil {
 		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
 		os.Exit(1)
 	}
+	if httpOpts.Tracer != nil {
+		httpOpts.Tracer.Close() // flush the spans before the results and possible exit
+	}
 	rr := res.Result()
 	warmup := *numThreadsFlag
 	if ro.Exactly > 0 {
@@ -504,6 +768,256 @@ func fortioLoad(justCurl bool, percList []float64) {
 		}
 		_, _ = fmt.Fprintf(out, "Successfully wrote %d bytes of Json data to %s\n", n, jsonFileName)
 	}
+	if *csvFlag != "" {
+		writeResultFile(out, *csvFlag, "Csv", func(w io.Writer) error {
+			return periodic.WriteCSV(w, res)
+		})
+	}
+	if *openMetricsFlag != "" {
+		writeResultFile(out, *openMetricsFlag, "OpenMetrics", func(w io.Writer) error {
+			p := periodic.NewPrometheusExposition()
+			p.AddResults(res)
+			_, err := p.WriteOpenMetrics(w)
+			return err
+		})
+	}
+	if *promPushFlag != "" {
+		if err = periodic.PushPrometheus(*promPushFlag, *promJobFlag, res); err != nil {
+			log.Errf("Unable to push metrics to %s: %v", *promPushFlag, err)
+		} else {
+			_, _ = fmt.Fprintf(out, "Successfully pushed metrics to %s\n", *promPushFlag)
+		}
+	}
+	if assertions.Empty() {
+		return
+	}
+	failed := assertions.Check(res)
+	for _, f := range failed {
+		_, _ = fmt.Fprintf(out, "Assertion failed: %s\n", f)
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+	_, _ = fmt.Fprintf(out, "All assertions passed\n")
+}
+
+// retryPolicy returns the -retry-* flags policy.
+func retryPolicy() periodic.RetryPolicy {
+	jitter, err := periodic.ParseRetryJitter(*retryJitterFlag)
+	if err != nil {
+		usageErr("Error: invalid -retry-jitter: ", err)
+	}
+	return periodic.RetryPolicy{
+		MaxAttempts: *retryAttemptsFlag,
+		Backoff:     *retryBackoffFlag,
+		MaxBackoff:  *retryMaxBackoffFlag,
+		Jitter:      jitter,
+		RetryOn:     periodic.ParseRetryOn(*retryOnFlag),
+	}
+}
+
+// runDistributed runs the load test over the -distributed workers, passing them
+// the run options through their REST api.
+func runDistributed(url string, ro *periodic.RunnerOptions, httpOpts *fhttp.HTTPOptions) (periodic.HasRunnerResult, error) {
+	if *grpcFlag || *scenariosFlag != "" || strings.HasPrefix(url, tcprunner.TCPURLPrefix) ||
+		strings.HasPrefix(url, udprunner.UDPURLPrefix) || wsrunner.IsWebSocketURL(url) {
+		return nil, fmt.Errorf("only http load tests can be distributed")
+	}
+	if name, _, found := periodic.LookupRunnerType(url); found {
+		return nil, fmt.Errorf("only http load tests can be distributed, not %s ones", name)
+	}
+	if httpOpts.Auth != nil {
+		return nil, fmt.Errorf("-auth can't be used with distributed runs, set the Authorization header with -H instead")
+	}
+	if *serverTimeFlag != "" || ro.SoakInterval > 0 || *retryAttemptsFlag > 1 {
+		return nil, fmt.Errorf("-server-time, -soak-interval and -retry-attempts can't be used with distributed runs")
+	}
+	if ro.Duration <= 0 && ro.Exactly <= 0 {
+		return nil, fmt.Errorf("distributed runs need a duration or a number of calls")
+	}
+	workers, err := distributed.ReadWorkers(*distributedFlag)
+	if err != nil {
+		return nil, err
+	}
+	p := neturl.Values{}
+	p.Set("url", url)
+	p.Set("qps", strconv.FormatFloat(ro.QPS, 'g', -1, 64))
+	p.Set("t", ro.Duration.String())
+	p.Set("c", strconv.Itoa(ro.NumThreads))
+	p.Set("n", strconv.FormatInt(ro.Exactly, 10))
+	p.Set("r", strconv.FormatFloat(ro.Resolution, 'g', -1, 64))
+	percs := make([]string, len(ro.Percentiles))
+	for i, pp := range ro.Percentiles {
+		percs[i] = strconv.FormatFloat(pp, 'g', -1, 64)
+	}
+	p.Set("p", strings.Join(percs, ","))
+	p.Set("labels", ro.Labels)
+	p.Set("timeout", httpOpts.HTTPReqTimeOut.String())
+	p.Set("warmup-calls", strconv.FormatInt(ro.WarmupCalls, 10))
+	p.Set("warmup-duration", ro.WarmupDuration.String())
+	p.Set("expect", *expectFlag)
+	p.Set("resolve", httpOpts.Resolve)
+	if httpOpts.DNSMethod != "" || httpOpts.DNSRefresh > 0 {
+		p.Set("dns-method", httpOpts.DNSMethod)
+		p.Set("dns-refresh", httpOpts.DNSRefresh.String())
+	}
+	p.Set("sni", httpOpts.ServerName)
+	if len(httpOpts.Payload) > 0 {
+		p.Set("payload", httpOpts.PayloadString())
+	}
+	for k, on := range map[string]bool{
+		"jitter": ro.Jitter, "uniform": ro.Uniform, "nocatchup": ro.NoCatchUp,
+		"stdclient": httpOpts.DisableFastClient, "https-insecure": httpOpts.Insecure,
+		"payload-regenerate": httpOpts.RegeneratePayload,
+	} {
+		if on {
+			p.Set(k, "on")
+		}
+	}
+	for k, values := range httpOpts.AllHeaders() {
+		if k == "Content-Length" {
+			continue // set by each worker
+		}
+		for _, v := range values {
+			p.Add("H", k+": "+v)
+		}
+	}
+	log.Infof("Distributing the run over %d workers: %v", len(workers), workers)
+	// the workers (REST runs) don't have an offset
+	res, err := distributed.Run(workers, p, ro.Percentiles, 0, ro.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range res.Workers {
+		_, _ = fmt.Fprintf(ro.Out, "Worker %s : %d calls, %.1f qps, %d errors\n", w.URL, w.Calls, w.ActualQPS, w.Errors)
+		if w.Self != nil && w.Self.Saturated {
+			_, _ = fmt.Fprintf(ro.Out, "WARNING worker %s appears saturated (%s)\n", w.URL, w.Self.Reason)
+		}
+	}
+	res.DurationHistogram.Print(ro.Out, "Merged Function Time")
+	keys := make([]int, 0, len(res.RetCodes))
+	for k := range res.RetCodes {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(ro.Out, "Code %3d : %d\n", k, res.RetCodes[k])
+	}
+	return res, nil
+}
+
+// startWorker registers the worker with the -coordinator (in the background).
+func startWorker() {
+	if *coordinatorFlag == "" {
+		usageErr("Error: fortio worker needs a -coordinator")
+	}
+	self := *workerURLFlag
+	if self == "" {
+		hname, _ := os.Hostname()
+		port := *echoPortFlag
+		if idx := strings.LastIndex(port, ":"); idx >= 0 {
+			port = port[idx+1:]
+		}
+		self = "http://" + hname + ":" + port + *uiPathFlag
+	}
+	go distributed.RegisterWith(*coordinatorFlag, self)
+}
+
+// writeResultFile writes the results, using write, to fname ('-' for stdout) and
+// logs the outcome to out.
+func writeResultFile(out io.Writer, fname, format string, write func(io.Writer) error) {
+	f := os.Stdout
+	if fname != "-" {
+		var err error
+		f, err = os.Create(fname)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v", fname, err)
+		}
+	}
+	if err := write(f); err != nil {
+		log.Fatalf("Unable to write %s data to %s: %v", format, fname, err)
+	}
+	if f == os.Stdout {
+		return
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Close error for %s: %v", fname, err)
+	}
+	_, _ = fmt.Fprintf(out, "Successfully wrote %s data to %s\n", format, fname)
+}
+
+// loadAssertions returns the thresholds set by the -max-* and -min-qps flags.
+func loadAssertions() *periodic.Assertions {
+	a := periodic.Assertions{
+		MaxPercentiles: make(map[float64]time.Duration),
+		MaxAvg:         *maxAvgFlag,
+		MaxErrorRate:   -1,
+		MinQPS:         *minQPSFlag,
+	}
+	for p, d := range map[float64]time.Duration{50: *maxP50Flag, 90: *maxP90Flag, 99: *maxP99Flag, 99.9: *maxP999Flag} {
+		if d > 0 {
+			a.MaxPercentiles[p] = d
+		}
+	}
+	if *maxErrorRateFlag != "" {
+		var err error
+		if a.MaxErrorRate, err = periodic.ParseRate(*maxErrorRateFlag); err != nil {
+			usageErr("Error: invalid `-max-error-rate`: ", err)
+		}
+	}
+	return &a
+}
+
+// fortioDiff compares the 2 json results files, prints the differences and exits
+// with an error if the -max-*-increase/decrease thresholds are exceeded.
+func fortioDiff(percList []float64) {
+	if len(flag.Args()) != 2 {
+		usageErr("Error: fortio diff needs 2 json result files: before.json after.json")
+	}
+	var t compare.Thresholds
+	for _, th := range []struct {
+		name  string
+		value string
+		ptr   *float64
+	}{
+		{"-max-qps-decrease", *diffMaxQPSDecreaseFlag, &t.MaxQPSDecrease},
+		{"-max-latency-increase", *diffMaxLatencyIncreaseFlag, &t.MaxLatencyIncrease},
+		{"-max-error-rate-increase", *diffMaxErrorRateIncreaseFlag, &t.MaxErrorRateIncrease},
+	} {
+		var err error
+		if *th.ptr, err = compare.ParseThreshold(th.value); err != nil {
+			usageErr("Error: invalid "+th.name+": ", err)
+		}
+	}
+	a, err := compare.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Unable to read result: %v", err)
+	}
+	b, err := compare.ReadFile(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("Unable to read result: %v", err)
+	}
+	d := compare.Compare(a, b, percList, t)
+	d.Print(os.Stdout)
+	if len(d.Regressions) > 0 {
+		os.Exit(1)
+	}
+}
+
+// writePhases saves the folded per phase timing of a grpc run to fname ('-' for stdout).
+func writePhases(res *fgrpc.GRPCRunnerResults, fname string) {
+	f := os.Stdout
+	if fname != "-" {
+		var err error
+		f, err = os.Create(fname)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v", fname, err)
+		}
+		defer f.Close()
+	}
+	if err := res.WritePhasesFolded(f); err != nil {
+		log.Fatalf("Unable to write grpc phases to %s: %v", fname, err)
+	}
 }
 
 func grpcClient() {
@@ -0,0 +1,114 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HasErrorCount is implemented by the results of the runners which can tell
+// how many of the calls failed.
+type HasErrorCount interface {
+	ErrorCount() int64
+}
+
+// Assertions are thresholds (SLOs) checked against the final results of a run.
+// Zero values are not checked.
+type Assertions struct {
+	// Maximum latency at the given percentiles (e.g. 99 -> 50ms).
+	MaxPercentiles map[float64]time.Duration
+	MaxAvg         time.Duration
+	// Maximum fraction of failed calls, between 0 and 1; negative to not check.
+	MaxErrorRate float64
+	MinQPS       float64
+}
+
+// Empty returns true if there is nothing to check.
+func (a *Assertions) Empty() bool {
+	return len(a.MaxPercentiles) == 0 && a.MaxAvg <= 0 && a.MaxErrorRate < 0 && a.MinQPS <= 0
+}
+
+// Check returns the list of the assertions res violates, empty if all passed.
+func (a *Assertions) Check(res HasRunnerResult) []string {
+	var failed []string
+	rr := res.Result()
+	h := rr.DurationHistogram
+	if h.Count == 0 {
+		return []string{"no calls were made"}
+	}
+	ps := make([]float64, 0, len(a.MaxPercentiles))
+	for p := range a.MaxPercentiles {
+		ps = append(ps, p)
+	}
+	sort.Float64s(ps)
+	for _, p := range ps {
+		limit := a.MaxPercentiles[p]
+		v := secondsToDuration(h.CalcPercentile(p))
+		if v > limit {
+			failed = append(failed, fmt.Sprintf("p%s %v > %v", PercentileString(p), v, limit))
+		}
+	}
+	if avg := secondsToDuration(h.Avg); a.MaxAvg > 0 && avg > a.MaxAvg {
+		failed = append(failed, fmt.Sprintf("avg %v > %v", avg, a.MaxAvg))
+	}
+	if a.MaxErrorRate >= 0 {
+		if e, ok := res.(HasErrorCount); ok {
+			errors := e.ErrorCount()
+			rate := float64(errors) / float64(h.Count)
+			if rate > a.MaxErrorRate {
+				failed = append(failed, fmt.Sprintf("error rate %.3g%% (%d/%d) > %.3g%%",
+					100.*rate, errors, h.Count, 100.*a.MaxErrorRate))
+			}
+		}
+	}
+	if a.MinQPS > 0 && rr.ActualQPS < a.MinQPS {
+		failed = append(failed, fmt.Sprintf("qps %.5g < %g", rr.ActualQPS, a.MinQPS))
+	}
+	return failed
+}
+
+// PercentileString formats a percentile for the p<percentile> notation, e.g.
+// 99.9 as "99.9" (and 99 as "99").
+func PercentileString(p float64) string {
+	return strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// ParseRate parses an error rate either as a fraction ("0.001") or a percentage
+// ("0.1%") and returns the fraction.
+func ParseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	div := 1.
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		div = 100.
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	r /= div
+	if r < 0 || r > 1 {
+		return 0, fmt.Errorf("rate %g should be between 0 and 1 (or 0%% and 100%%)", r)
+	}
+	return r, nil
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
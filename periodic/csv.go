@@ -0,0 +1,83 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// CSVHeader is the first line of the WriteCSV output.
+var CSVHeader = []string{"Kind", "Name", "Start", "End", "Count", "Percent", "Value"}
+
+// WriteCSV writes the results as a flat csv table (for spreadsheets), one line per:
+// summary value (Kind "summary": qps, calls, avg, etc... latencies being in seconds),
+// percentile (Kind "percentile", Name p<percentile>, Value in seconds), histogram
+// bucket (Kind "bucket" with the Start, End, Count and cumulative Percent) and
+// return code (Kind "code" with the Count and Percent of the calls).
+func WriteCSV(w io.Writer, res HasRunnerResult) error {
+	rr := res.Result()
+	h := rr.DurationHistogram
+	cw := csv.NewWriter(w)
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	pct := func(count int64) string {
+		if h.Count == 0 {
+			return "0"
+		}
+		return f(100. * float64(count) / float64(h.Count))
+	}
+	_ = cw.Write(CSVHeader)
+	summary := func(name, value string) {
+		_ = cw.Write([]string{"summary", name, "", "", "", "", value})
+	}
+	summary("run_type", rr.RunType)
+	summary("labels", rr.Labels)
+	summary("start_time", rr.StartTime.Format("2006-01-02T15:04:05.000Z07:00"))
+	summary("requested_qps", rr.RequestedQPS)
+	summary("actual_qps", f(rr.ActualQPS))
+	summary("duration_seconds", f(rr.ActualDuration.Seconds()))
+	summary("threads", strconv.Itoa(rr.NumThreads))
+	summary("calls", strconv.FormatInt(h.Count, 10))
+	if e, ok := res.(HasErrorCount); ok {
+		summary("errors", strconv.FormatInt(e.ErrorCount(), 10))
+	}
+	summary("min", f(h.Min))
+	summary("max", f(h.Max))
+	summary("avg", f(h.Avg))
+	summary("stddev", f(h.StdDev))
+	for _, p := range h.Percentiles {
+		_ = cw.Write([]string{"percentile", "p" + PercentileString(p.Percentile), "", "", "", "", f(p.Value)})
+	}
+	for _, b := range h.Data {
+		_ = cw.Write([]string{"bucket", "", f(b.Start), f(b.End), strconv.FormatInt(b.Count, 10), f(b.Percent), ""})
+	}
+	if rc, ok := res.(HasReturnCodes); ok {
+		codes := rc.ReturnCodes()
+		keys := make([]string, 0, len(codes))
+		for k := range codes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_ = cw.Write([]string{"code", k, "", "", strconv.FormatInt(codes[k], 10), pct(codes[k]), ""})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,195 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Snapshot is an interim result of a run in progress, emitted every
+// RunnerOptions.SnapshotInterval.
+type Snapshot struct {
+	RunID   int64
+	Labels  string
+	Elapsed time.Duration // since the start of the run (after the warmup)
+	Count   int64         // calls completed so far
+	QPS     float64       // average qps so far
+	// Failed calls so far, for the runners implementing HasErrorCount (as of about the
+	// previous snapshot, exact in the final one).
+	Errors int64
+	// Calls completed since the previous snapshot, their qps and latency percentiles (in seconds).
+	IntervalCount int64
+	IntervalQPS   float64
+	P50           float64
+	P99           float64
+	Final         bool // true for the last snapshot, emitted at the end of the run
+}
+
+// threadInterim is the calls of one thread since the last snapshot. Each thread
+// records into its own, so its lock is only contended by the snapshots.
+type threadInterim struct {
+	sync.Mutex
+	interval *stats.Histogram
+	// ErrorCount() of the thread's runner, which walks its return codes so it is only
+	// refreshed on the first call of the thread after each snapshot.
+	errors        int64
+	refreshErrors bool
+}
+
+// interimStats accumulates the calls of the threads between snapshots.
+type interimStats struct {
+	start    time.Time
+	last     time.Time
+	count    int64
+	threads  []*threadInterim
+	interval *stats.Histogram // the merged threads ones, only used by the snapshots
+}
+
+func newInterimStats(numThreads int, offset, resolution float64) *interimStats {
+	s := &interimStats{
+		interval: stats.NewHistogram(offset, resolution),
+		threads:  make([]*threadInterim, numThreads),
+	}
+	for i := range s.threads {
+		s.threads[i] = &threadInterim{interval: s.interval.Clone()}
+	}
+	return s
+}
+
+// record adds one call of thread id, f being that thread's runner.
+func (s *interimStats) record(id int, f Runnable, latency float64) {
+	t := s.threads[id]
+	t.Lock()
+	t.interval.Record(latency)
+	if t.refreshErrors {
+		t.refreshErrors = false
+		if e, ok := f.(HasErrorCount); ok {
+			// each thread has its own runner, so it's safe to read its state here
+			t.errors = e.ErrorCount()
+		}
+	}
+	t.Unlock()
+}
+
+// recordInterim records the call for the snapshots and soak windows, if enabled.
+func (r *periodicRunner) recordInterim(id int, f Runnable, latency float64) {
+	if r.interim != nil {
+		r.interim.record(id, f, latency)
+	}
+	if r.soak != nil {
+		r.soak.record(id, f, latency)
+	}
+}
+
+// collect merges (and resets) the calls of the threads since the last collect and
+// returns them with the errors so far. While the threads are running (runners is
+// nil) the errors are the ones refreshed by their first call after the previous
+// collect, so they lag by about one interval; once they are done, the final errors
+// are read from their runners.
+func (s *interimStats) collect(runners []Runnable) (*stats.HistogramData, int64) {
+	var errors int64
+	for i, t := range s.threads {
+		t.Lock()
+		s.interval.Transfer(t.interval)
+		if runners != nil {
+			if e, ok := runners[i].(HasErrorCount); ok {
+				t.errors = e.ErrorCount()
+			}
+		}
+		errors += t.errors
+		t.refreshErrors = true
+		t.Unlock()
+	}
+	h := s.interval.Export()
+	s.interval.Reset()
+	s.count += h.Count
+	return h, errors
+}
+
+// snapshot returns the stats so far, resetting the interval ones. runners is passed
+// for the final one, once the threads are done.
+func (s *interimStats) snapshot(now time.Time, runners []Runnable) *Snapshot {
+	h, errors := s.collect(runners)
+	snap := &Snapshot{
+		Elapsed:       now.Sub(s.start),
+		Count:         s.count,
+		Errors:        errors,
+		IntervalCount: h.Count,
+	}
+	intervalDuration := now.Sub(s.last)
+	s.last = now
+	if snap.Elapsed > 0 {
+		snap.QPS = float64(snap.Count) / snap.Elapsed.Seconds()
+	}
+	if intervalDuration > 0 {
+		snap.IntervalQPS = float64(h.Count) / intervalDuration.Seconds()
+	}
+	if h.Count > 0 {
+		snap.P50 = h.CalcPercentile(50)
+		snap.P99 = h.CalcPercentile(99)
+	}
+	return snap
+}
+
+// startSnapshots emits snapshots every SnapshotInterval until the returned
+// function is called, which emits the final one.
+func (r *periodicRunner) startSnapshots(start time.Time) func() {
+	s := r.interim
+	s.start = start
+	s.last = start
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(r.SnapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				r.emitSnapshot(s.snapshot(now, nil))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		snap := s.snapshot(time.Now(), r.Runners)
+		snap.Final = true
+		r.emitSnapshot(snap)
+	}
+}
+
+func (r *periodicRunner) emitSnapshot(snap *Snapshot) {
+	snap.RunID = r.RunID
+	snap.Labels = r.Labels
+	if r.OnSnapshot != nil {
+		r.OnSnapshot(snap)
+		return
+	}
+	j, err := json.Marshal(snap)
+	if err != nil {
+		log.Errf("Unable to json serialize snapshot: %v", err)
+		return
+	}
+	_, _ = r.Out.Write(append(j, '\n'))
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Arrivals processes for the open loop mode (RunnerOptions.OpenLoop).
+const (
+	// ArrivalsFixed starts the calls at fixed 1/QPS intervals.
+	ArrivalsFixed = "fixed"
+	// ArrivalsPoisson starts the calls following a Poisson process of rate QPS
+	// (exponentially distributed intervals).
+	ArrivalsPoisson = "poisson"
+)
+
+// OpenLoopResults are the open loop mode specific results.
+type OpenLoopResults struct {
+	Arrivals string
+	// Calls which couldn't start at their scheduled time because all the runners were busy
+	// and which waited in the queue.
+	LateStarts int64
+	// Calls which were never made because all the runners were busy and the queue was full.
+	DroppedCalls int64
+	// Time between the scheduled start of the calls and their actual start.
+	StartDelay *stats.HistogramData
+	// Time between the scheduled start of the calls and their end: the response time
+	// as seen by independent users, including the time spent waiting for a runner.
+	ResponseTime *stats.HistogramData
+}
+
+func (r *periodicRunner) runOpenLoopSetup(extra string) (requestedDuration string, numCalls int64) {
+	requestedDuration = "until stop"
+	if r.Exactly > 0 {
+		numCalls = r.Exactly
+		requestedDuration = fmt.Sprintf("exactly %d calls", numCalls)
+	} else if r.Duration > 0 {
+		requestedDuration = fmt.Sprint(r.Duration)
+	}
+	if log.Log(log.Warning) || (numCalls == 0 && r.Duration <= 0) {
+		_, _ = fmt.Fprintf(r.Out, "Starting open loop (%s arrivals) at %g qps with up to %d thread(s) [gomax %d] and queue of %d for %s%s\n",
+			r.OpenLoop, r.QPS, r.NumThreads, runtime.GOMAXPROCS(0), r.OpenLoopQueue, requestedDuration, extra)
+	}
+	return
+}
+
+// runOpenLoop schedules the calls according to the arrivals process and dispatches
+// them to the NumThreads runners, at most numCalls (0 for until Duration or stop).
+func (r *periodicRunner) runOpenLoop(runnerChan chan struct{}, funcTimes, sleepTimes *stats.Histogram,
+	numCalls int64, start time.Time) *OpenLoopResults {
+	res := OpenLoopResults{Arrivals: r.OpenLoop}
+	// Calls in flight, either running or waiting for a runner. The channel never
+	// blocks as at most NumThreads+OpenLoopQueue calls are dispatched at once.
+	var inFlight int64
+	maxInFlight := int64(r.NumThreads + r.OpenLoopQueue)
+	calls := make(chan time.Time, maxInFlight)
+	startDelays := stats.NewHistogram(0, r.Resolution)
+	responseTimes := stats.NewHistogram(funcTimes.Offset, funcTimes.Divider)
+	var wg sync.WaitGroup
+	var fDs, dDs, rDs []*stats.Histogram
+	for t := 0; t < r.NumThreads; t++ {
+		durP := stats.NewHistogram(funcTimes.Offset, funcTimes.Divider)
+		delayP := stats.NewHistogram(startDelays.Offset, startDelays.Divider)
+		respP := stats.NewHistogram(responseTimes.Offset, responseTimes.Divider)
+		fDs = append(fDs, durP)
+		dDs = append(dDs, delayP)
+		rDs = append(rDs, respP)
+		wg.Add(1)
+		go func(t int) {
+			r.openLoopRunner(t, calls, &inFlight, durP, delayP, respP)
+			wg.Done()
+		}(t)
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano())) // nolint: gosec // not for crypto
+	endTime := start.Add(r.Duration)
+	next := start
+	useExactly := numCalls > 0
+	hasDuration := r.Duration > 0
+MainLoop:
+	for i := int64(0); !useExactly || i < numCalls; i++ {
+		if i > 0 {
+			interval := 1. / r.QPS
+			if r.OpenLoop == ArrivalsPoisson {
+				interval = rng.ExpFloat64() / r.QPS
+			}
+			next = next.Add(time.Duration(interval * 1e9))
+		}
+		if !useExactly && hasDuration && next.After(endTime) {
+			break
+		}
+		sleepDuration := time.Until(next)
+		sleepTimes.Record(sleepDuration.Seconds())
+		select {
+		case <-runnerChan:
+			break MainLoop
+		case <-time.After(sleepDuration):
+		}
+		n := atomic.LoadInt64(&inFlight)
+		if n >= maxInFlight {
+			res.DroppedCalls++
+			log.Debugf("All runners busy and queue full, dropping call %d", i)
+			continue
+		}
+		if n >= int64(r.NumThreads) {
+			res.LateStarts++
+		}
+		atomic.AddInt64(&inFlight, 1)
+		calls <- next
+	}
+	close(calls)
+	wg.Wait()
+	for t := range fDs {
+		funcTimes.Transfer(fDs[t])
+		startDelays.Transfer(dDs[t])
+		responseTimes.Transfer(rDs[t])
+	}
+	res.StartDelay = startDelays.Export().CalcPercentiles(r.Percentiles)
+	res.ResponseTime = responseTimes.Export().CalcPercentiles(r.Percentiles)
+	return &res
+}
+
+// openLoopRunner makes the calls scheduled on the calls channel until it is closed.
+func (r *periodicRunner) openLoopRunner(id int, calls chan time.Time, inFlight *int64,
+	funcTimes, startDelays, responseTimes *stats.Histogram) {
+	f := r.Runners[id]
+	for scheduled := range calls {
+		fStart := time.Now()
+		startDelays.Record(fStart.Sub(scheduled).Seconds())
+		f.Run(id)
+		latency := time.Since(fStart).Seconds()
+		if r.AccessLogger != nil {
+			r.AccessLogger.Report(id, fStart.UnixNano(), latency)
+		}
+		r.recordInterim(id, f, latency)
+		funcTimes.Record(latency)
+		responseTimes.Record(time.Since(scheduled).Seconds())
+		atomic.AddInt64(inFlight, -1)
+	}
+}
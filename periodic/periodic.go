@@ -55,6 +55,13 @@ type Runnable interface {
 	Run(tid int)
 }
 
+// Resetter is optionally implemented by Runnables which keep per call statistics
+// (return codes, sizes,...). ResetStats is called after the warmup calls so they
+// don't get mixed with the measured ones.
+type Resetter interface {
+	ResetStats()
+}
+
 // MakeRunners creates an array of NumThreads identical Runnable instances
 // (for the (rare/test) cases where there is no unique state needed).
 func (r *RunnerOptions) MakeRunners(rr Runnable) {
@@ -146,6 +153,32 @@ type RunnerOptions struct {
 	AccessLogger AccessLogger
 	// No catch-up: if true we will do exactly the requested QPS and not try to catch up if the target is temporarily slow.
 	NoCatchUp bool
+	// Optional warmup, before the measured run: number of calls (split between the threads) or,
+	// if WarmupCalls isn't set, duration during which the Runners are called at the same qps
+	// without their timing being recorded.
+	WarmupCalls    int64
+	WarmupDuration time.Duration
+	// Optional load profile: the target qps changes for each stage, in order. When set
+	// QPS, Duration and Exactly are not used. See ParseQPSProfile and ParseRamp.
+	Stages []Stage
+	// Optional open loop mode, ArrivalsFixed or ArrivalsPoisson: the calls are started at the QPS
+	// rate independently of the completion of the previous ones, by up to NumThreads concurrent
+	// Runners. Calls that can't start on time wait in a queue of OpenLoopQueue entries, or
+	// are dropped when it is full. Default ("") is the closed loop mode.
+	OpenLoop      string
+	OpenLoopQueue int
+	// Optional interim results: a Snapshot of the run so far is passed to OnSnapshot (or written
+	// as a json line to Out if OnSnapshot is nil) every SnapshotInterval, and at the end.
+	SnapshotInterval time.Duration
+	OnSnapshot       func(*Snapshot)
+	interim          *interimStats
+	// Optional soak mode: the calls are also summarized per SoakInterval window (written as
+	// json lines to SoakFile if set, and in the results) and the trend of the windows p99 is
+	// flagged as a drift when it increases by more than SoakMaxDrift (fraction) over the run.
+	SoakInterval time.Duration
+	SoakFile     string
+	SoakMaxDrift float64
+	soak         *soakWindows
 }
 
 // RunnerResults encapsulates the actual QPS observed and duration histogram.
@@ -166,6 +199,12 @@ type RunnerResults struct {
 	NoCatchUp         bool
 	RunID             int64 // Echo back the optional run id
 	AccessLoggerInfo  string
+	WarmupCalls       int64            // Number of warmup calls made (not included in the DurationHistogram)
+	WarmupDuration    time.Duration    // Actual duration of the warmup
+	Stages            []StageResults   `json:",omitempty"` // Per stage results when using a load profile
+	OpenLoop          *OpenLoopResults `json:",omitempty"` // Open loop mode results
+	Soak              *SoakResults     `json:",omitempty"` // Soak mode windows and trend
+	Self              *SelfStats       // Resources usage of the load generator itself during the run
 }
 
 // HasRunnerResult is the interface implictly implemented by HTTPRunnerResults
@@ -234,6 +273,18 @@ func (r *RunnerOptions) Normalize() {
 	if r.Runners == nil {
 		r.Runners = make([]Runnable, r.NumThreads)
 	}
+	if r.OpenLoop != "" && r.OpenLoop != ArrivalsFixed && r.OpenLoop != ArrivalsPoisson {
+		log.Errf("Invalid open loop arrivals %q, should be %s or %s, using %s", r.OpenLoop, ArrivalsFixed, ArrivalsPoisson, ArrivalsPoisson)
+		r.OpenLoop = ArrivalsPoisson
+	}
+	if r.OpenLoop != "" && r.QPS <= 0 {
+		log.Warnf("Open loop mode needs a target qps, using closed loop at max qps instead")
+		r.OpenLoop = ""
+	}
+	if r.OpenLoop != "" && len(r.Stages) > 0 {
+		log.Warnf("Open loop mode isn't supported with a qps profile, using closed loop")
+		r.OpenLoop = ""
+	}
 	if r.Stop != nil {
 		return
 	}
@@ -411,7 +462,17 @@ func (r *periodicRunner) Run() RunnerResults {
 		extra = fmt.Sprintf(" with access logger %s", r.AccessLogger.Info())
 	}
 	requestedQPS := "max"
-	if useQPS {
+	if len(r.Stages) > 0 {
+		requestedDuration, requestedQPS = r.runStagesSetup(extra)
+		useExactly = false
+		useQPS = false
+		for _, s := range r.Stages {
+			useQPS = useQPS || s.QPS > 0
+		}
+	} else if r.OpenLoop != "" {
+		requestedDuration, numCalls = r.runOpenLoopSetup(extra)
+		requestedQPS = fmt.Sprintf("%.9g", r.QPS)
+	} else if useQPS {
 		requestedDuration, requestedQPS, numCalls, leftOver = r.runQPSSetup(extra)
 	} else {
 		requestedDuration, numCalls, leftOver = r.runMaxQPSSetup(extra)
@@ -424,12 +485,33 @@ func (r *periodicRunner) Run() RunnerResults {
 		r.MakeRunners(r.Runners[0])
 		log.Warnf("Context array was of %d len, replacing with %d clone of first one", runnersLen, len(r.Runners))
 	}
+	var warmupCalls int64
+	var warmupDuration time.Duration
+	if r.WarmupCalls > 0 || r.WarmupDuration > 0 {
+		warmupCalls, warmupDuration = r.runWarmup(runnerChan)
+	}
+	endSelfStats := startSelfStats()
 	start := time.Now()
+	var endSnapshots func()
+	if r.SnapshotInterval > 0 {
+		r.interim = newInterimStats(r.NumThreads, r.Offset.Seconds(), r.Resolution)
+		endSnapshots = r.startSnapshots(start)
+	}
+	var endSoak func() *SoakResults
+	if r.SoakInterval > 0 {
+		endSoak = r.startSoak(start)
+	}
 	// Histogram  and stats for Function duration - millisecond precision
 	functionDuration := stats.NewHistogram(r.Offset.Seconds(), r.Resolution)
 	// Histogram and stats for Sleep time (negative offset to capture <0 sleep in their own bucket):
 	sleepTime := stats.NewHistogram(-0.001, 0.001)
-	if r.NumThreads <= 1 {
+	var stages []StageResults
+	var openLoop *OpenLoopResults
+	if len(r.Stages) > 0 {
+		stages = r.runStages(runnerChan, functionDuration, sleepTime)
+	} else if r.OpenLoop != "" {
+		openLoop = r.runOpenLoop(runnerChan, functionDuration, sleepTime, numCalls, start)
+	} else if r.NumThreads <= 1 {
 		log.LogVf("Running single threaded")
 		runOne(0, runnerChan, functionDuration, sleepTime, numCalls+leftOver, start, r)
 	} else {
@@ -459,6 +541,15 @@ func (r *periodicRunner) Run() RunnerResults {
 		}
 	}
 	elapsed := time.Since(start)
+	self := endSelfStats()
+	if endSnapshots != nil {
+		endSnapshots()
+	}
+	var soak *SoakResults
+	if endSoak != nil {
+		soak = endSoak()
+		r.soak = nil
+	}
 	actualQPS := float64(functionDuration.Count) / elapsed.Seconds()
 	if log.Log(log.Warning) {
 		_, _ = fmt.Fprintf(r.Out, "Ended after %v : %d calls. qps=%.5g\n", elapsed, functionDuration.Count, actualQPS)
@@ -479,6 +570,21 @@ func (r *periodicRunner) Run() RunnerResults {
 			}
 		}
 	}
+	if openLoop != nil {
+		_, _ = fmt.Fprintf(r.Out, "Open loop: %d late starts, %d dropped calls\n", openLoop.LateStarts, openLoop.DroppedCalls)
+		if log.Log(log.Verbose) {
+			openLoop.StartDelay.Print(r.Out, "Start Delay")
+			openLoop.ResponseTime.Print(r.Out, "Response Time (from scheduled start)")
+		} else if log.Log(log.Warning) {
+			for _, h := range []struct {
+				msg  string
+				data *stats.HistogramData
+			}{{"Start delay", openLoop.StartDelay}, {"Response time (from scheduled start)", openLoop.ResponseTime}} {
+				_, _ = fmt.Fprintf(r.Out, "%s : count %d avg %.8g +/- %.4g min %g max %g sum %.9g\n",
+					h.msg, h.data.Count, h.data.Avg, h.data.StdDev, h.data.Min, h.data.Max, h.data.Sum)
+			}
+		}
+	}
 	actualCount := functionDuration.Count
 	if useExactly && actualCount != r.Exactly {
 		requestedDuration += fmt.Sprintf(", interrupted after %d", actualCount)
@@ -491,6 +597,13 @@ func (r *periodicRunner) Run() RunnerResults {
 		r.RunType, r.Labels, start, requestedQPS, requestedDuration,
 		actualQPS, elapsed, r.NumThreads, version.Short(), functionDuration.Export().CalcPercentiles(r.Percentiles),
 		r.Exactly, r.Jitter, r.Uniform, r.NoCatchUp, r.RunID, loggerInfo,
+		warmupCalls, warmupDuration, stages, openLoop, soak, self,
+	}
+	if soak != nil && log.Log(log.Warning) {
+		soak.Print(r.Out)
+	}
+	if log.Log(log.Warning) || self.Saturated {
+		self.Print(r.Out)
 	}
 	if log.Log(log.Warning) {
 		result.DurationHistogram.Print(r.Out, "Aggregated Function Time")
@@ -510,6 +623,44 @@ func (r *periodicRunner) Run() RunnerResults {
 	return result
 }
 
+// runWarmup calls the Runners, the same way as the actual run but without recording
+// anything, for WarmupCalls or WarmupDuration. Runners implementing Resetter are
+// reset afterwards. Returns the number of calls made and the time it took.
+func (r *periodicRunner) runWarmup(runnerChan chan struct{}) (int64, time.Duration) {
+	w := &periodicRunner{r.RunnerOptions}
+	w.AccessLogger = nil
+	w.Exactly = r.WarmupCalls
+	w.Duration = r.WarmupDuration
+	var numCalls, leftOver int64
+	if w.Exactly > 0 {
+		numCalls = w.Exactly / int64(w.NumThreads)
+		leftOver = w.Exactly % int64(w.NumThreads)
+	} else if w.QPS > 0 {
+		numCalls = int64(w.QPS*w.Duration.Seconds()) / int64(w.NumThreads)
+		if numCalls < 2 {
+			numCalls = 2
+		}
+	}
+	if log.Log(log.Warning) {
+		if w.Exactly > 0 {
+			_, _ = fmt.Fprintf(r.Out, "Warming up with %d calls\n", w.Exactly)
+		} else {
+			_, _ = fmt.Fprintf(r.Out, "Warming up for %v\n", w.Duration)
+		}
+	}
+	funcTimes := stats.NewHistogram(r.Offset.Seconds(), r.Resolution)
+	elapsed := w.runAll(runnerChan, funcTimes, stats.NewHistogram(-0.001, 0.001), numCalls, leftOver)
+	for _, runner := range r.Runners[:r.NumThreads] {
+		if rs, ok := runner.(Resetter); ok {
+			rs.ResetStats()
+		}
+	}
+	if log.Log(log.Warning) {
+		_, _ = fmt.Fprintf(r.Out, "Warmup ended after %v : %d calls\n", elapsed, funcTimes.Count)
+	}
+	return funcTimes.Count, elapsed
+}
+
 // AccessLoggerType is the possible formats of the access logger (ACCESS_JSON or ACCESS_INFLUX).
 type AccessLoggerType int
 
@@ -650,6 +801,7 @@ MainLoop:
 		if r.AccessLogger != nil {
 			r.AccessLogger.Report(id, fStart.UnixNano(), latency)
 		}
+		r.recordInterim(id, f, latency)
 		funcTimes.Record(latency)
 		// if using QPS / pre calc expected call # mode:
 		if useQPS { // nolint: nestif
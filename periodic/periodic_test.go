@@ -15,14 +15,23 @@
 package periodic
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
 )
 
 type Noop struct{}
@@ -469,3 +478,764 @@ func TestGetJitter(t *testing.T) {
 		t.Errorf("getJitter 6 got %v sum of abs value instead of expected > 60 at -1/+1", sum)
 	}
 }
+
+// ResetCount is a TestCount also counting the ResetStats calls.
+type ResetCount struct {
+	TestCount
+	resets int64
+}
+
+func (c *ResetCount) ResetStats() {
+	c.lock.Lock()
+	c.resets++
+	(*c.count) = 0
+	c.lock.Unlock()
+}
+
+func TestWarmup(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := ResetCount{TestCount: TestCount{&count, &lock}}
+	o := RunnerOptions{
+		QPS:         -1,
+		NumThreads:  3,
+		Exactly:     6,
+		WarmupCalls: 7,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	if res.WarmupCalls != 7 {
+		t.Errorf("Expected 7 warmup calls, got %d", res.WarmupCalls)
+	}
+	if res.DurationHistogram.Count != 6 || count != 6 {
+		t.Errorf("Warmup calls shouldn't be counted: %d in histogram, %d after reset, expected 6", res.DurationHistogram.Count, count)
+	}
+	if c.resets != 3 {
+		t.Errorf("Expected 1 reset per thread, got %d", c.resets)
+	}
+	// Duration based warmup, at the run's qps:
+	count = 0
+	o = RunnerOptions{
+		QPS:            20,
+		NumThreads:     1,
+		Exactly:        2,
+		WarmupDuration: 300 * time.Millisecond,
+	}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	if res.WarmupCalls < 2 || res.WarmupCalls > 4 { // 100ms per call
+		t.Errorf("Expected about 3 warmup calls in 300ms, got %d", res.WarmupCalls)
+	}
+	if res.WarmupDuration < 300*time.Millisecond || res.WarmupDuration > 600*time.Millisecond {
+		t.Errorf("Unexpected warmup duration %v", res.WarmupDuration)
+	}
+	if res.DurationHistogram.Count != 2 || count != 2 {
+		t.Errorf("Expected 2 measured calls, got %d in histogram, %d counted", res.DurationHistogram.Count, count)
+	}
+	// Fewer warmup calls than threads:
+	o = RunnerOptions{
+		QPS:         -1,
+		NumThreads:  4,
+		Exactly:     4,
+		WarmupCalls: 2,
+	}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	if res = r.Run(); res.WarmupCalls != 2 {
+		t.Errorf("Expected 2 warmup calls, got %d", res.WarmupCalls)
+	}
+}
+
+func TestParseQPSProfile(t *testing.T) {
+	stages, err := ParseQPSProfile("100:30s, 500:1m,max:2s,-3:1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Stage{{100, 30 * time.Second}, {500, time.Minute}, {-1, 2 * time.Second}, {-1, time.Second}}
+	if len(stages) != len(expected) {
+		t.Fatalf("Got %v expected %v", stages, expected)
+	}
+	for i := range stages {
+		if stages[i] != expected[i] {
+			t.Errorf("Stage %d: got %v expected %v", i, stages[i], expected[i])
+		}
+	}
+	if s := ProfileString(stages); s != "100:30s,500:1m0s,max:2s,max:1s" {
+		t.Errorf("Unexpected profile string %q", s)
+	}
+	for _, invalid := range []string{"", "100", "100:", "0:1s", "abc:1s", "100:-1s", "100:1s:2s", "100:1s,x"} {
+		if _, err = ParseQPSProfile(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParseRamp(t *testing.T) {
+	stages, err := ParseRamp("0:1000:2m", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Stage{{125, 30 * time.Second}, {375, 30 * time.Second}, {625, 30 * time.Second}, {875, 30 * time.Second}}
+	if len(stages) != len(expected) {
+		t.Fatalf("Got %v expected %v", stages, expected)
+	}
+	for i := range stages {
+		if stages[i] != expected[i] {
+			t.Errorf("Step %d: got %v expected %v", i, stages[i], expected[i])
+		}
+	}
+	if stages, err = ParseRamp("100:10:1s", 0); err != nil || len(stages) != 1 || stages[0].QPS != 55 {
+		t.Errorf("Unexpected single step ramp %v %v", stages, err)
+	}
+	for _, invalid := range []string{"", "0:100", "0:0:1m", "-1:100:1m", "0:100:0s", "0:x:1m"} {
+		if _, err = ParseRamp(invalid, 10); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestStages(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	o := RunnerOptions{
+		NumThreads: 2,
+		Exactly:    1000, // ignored
+		Stages:     []Stage{{20, 300 * time.Millisecond}, {40, 300 * time.Millisecond}},
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	if len(res.Stages) != 2 {
+		t.Fatalf("Expected 2 stages results, got %+v", res.Stages)
+	}
+	// 100ms per call: about 3 calls per thread and stage.
+	var total int64
+	for i, s := range res.Stages {
+		if s.DurationHistogram.Count < 4 || s.DurationHistogram.Count > 8 {
+			t.Errorf("Stage %d: unexpected count %d", i, s.DurationHistogram.Count)
+		}
+		total += s.DurationHistogram.Count
+	}
+	if total != res.DurationHistogram.Count || total != count {
+		t.Errorf("Stages total %d should match the overall count %d and calls %d", total, res.DurationHistogram.Count, count)
+	}
+	if res.RequestedQPS != "20:300ms,40:300ms" || res.Exactly != 0 {
+		t.Errorf("Unexpected requested qps %q / exactly %d", res.RequestedQPS, res.Exactly)
+	}
+}
+
+func TestOpenLoop(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	fast := &Noop{}
+	o := RunnerOptions{
+		QPS:        100,
+		NumThreads: 2,
+		Exactly:    10,
+		OpenLoop:   ArrivalsFixed,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(fast)
+	res := r.Run()
+	if res.OpenLoop == nil || res.DurationHistogram.Count != 10 || res.OpenLoop.DroppedCalls != 0 || res.OpenLoop.LateStarts != 0 {
+		t.Errorf("Unexpected open loop results %+v for %d calls", res.OpenLoop, res.DurationHistogram.Count)
+	}
+	// 9 intervals of 10ms
+	if res.ActualDuration < 85*time.Millisecond || res.ActualDuration > time.Second {
+		t.Errorf("Unexpected duration %v for fixed arrivals", res.ActualDuration)
+	}
+	o = RunnerOptions{
+		QPS:           1000,
+		NumThreads:    4,
+		Exactly:       50,
+		OpenLoop:      ArrivalsPoisson,
+		OpenLoopQueue: 50, // no drops even on bursts of arrivals
+	}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(fast)
+	if res = r.Run(); res.DurationHistogram.Count != 50 || res.OpenLoop.Arrivals != ArrivalsPoisson {
+		t.Errorf("Unexpected poisson results %+v for %d calls", res.OpenLoop, res.DurationHistogram.Count)
+	}
+	// Slow (100ms) calls, at 50 qps with 1 thread: most calls are dropped, the queued ones are late.
+	c := TestCount{&count, &lock}
+	o = RunnerOptions{
+		QPS:           50,
+		NumThreads:    1,
+		Duration:      500 * time.Millisecond,
+		OpenLoop:      ArrivalsFixed,
+		OpenLoopQueue: 2,
+	}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	ol := res.OpenLoop
+	scheduled := res.DurationHistogram.Count + ol.DroppedCalls
+	if scheduled < 20 || scheduled > 27 || count != res.DurationHistogram.Count {
+		t.Errorf("Expected about 25 scheduled calls, got %d made (%d counted) + %d dropped", res.DurationHistogram.Count, count, ol.DroppedCalls)
+	}
+	if ol.DroppedCalls < 5 || ol.LateStarts < 2 {
+		t.Errorf("Expected late and dropped calls, got %+v", ol)
+	}
+	if ol.ResponseTime.Max < ol.StartDelay.Max+0.1 || ol.StartDelay.Max < 0.1 {
+		t.Errorf("Response time %v should include the start delay %v", ol.ResponseTime.Max, ol.StartDelay.Max)
+	}
+	// Open loop needs a qps:
+	o = RunnerOptions{QPS: -1, Exactly: 4, OpenLoop: ArrivalsPoisson}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(fast)
+	if res = r.Run(); res.OpenLoop != nil || res.DurationHistogram.Count != 4 {
+		t.Errorf("Expected fallback to closed loop, got %+v for %d calls", res.OpenLoop, res.DurationHistogram.Count)
+	}
+}
+
+type errorResults struct {
+	RunnerResults
+	errors int64
+}
+
+func (e *errorResults) ErrorCount() int64 {
+	return e.errors
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tst := range []struct {
+		in  string
+		out float64
+		err bool
+	}{
+		{"0.001", 0.001, false},
+		{"0.1%", 0.001, false},
+		{" 5% ", 0.05, false},
+		{"0", 0, false},
+		{"100%", 1, false},
+		{"2", 0, true},
+		{"-1%", 0, true},
+		{"x%", 0, true},
+	} {
+		r, err := ParseRate(tst.in)
+		if (err != nil) != tst.err || (err == nil && math.Abs(r-tst.out) > 1e-12) {
+			t.Errorf("ParseRate(%q) got %g, %v expected %g (error %v)", tst.in, r, err, tst.out, tst.err)
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	h := stats.NewHistogram(0, 0.001)
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i) / 1000.) // 1 to 100ms
+	}
+	res := &errorResults{RunnerResults{DurationHistogram: h.Export(), ActualQPS: 50}, 2}
+	a := Assertions{MaxErrorRate: -1}
+	if !a.Empty() {
+		t.Errorf("Expected empty assertions %+v", a)
+	}
+	if f := a.Check(res); len(f) != 0 {
+		t.Errorf("Expected no failures for empty assertions, got %v", f)
+	}
+	a = Assertions{
+		MaxPercentiles: map[float64]time.Duration{50: 60 * time.Millisecond, 99: 200 * time.Millisecond},
+		MaxAvg:         60 * time.Millisecond,
+		MaxErrorRate:   0.02,
+		MinQPS:         50,
+	}
+	if f := a.Check(res); len(f) != 0 {
+		t.Errorf("Expected all assertions to pass, got %v", f)
+	}
+	a = Assertions{
+		MaxPercentiles: map[float64]time.Duration{99.9: 50 * time.Millisecond, 90: 50 * time.Millisecond, 50: time.Second},
+		MaxAvg:         10 * time.Millisecond,
+		MaxErrorRate:   0.01,
+		MinQPS:         100,
+	}
+	f := a.Check(res)
+	expected := []string{"p90 ", "p99.9 ", "avg ", "error rate 2% (2/100) > 1%", "qps 50 < 100"}
+	if len(f) != len(expected) {
+		t.Fatalf("Expected %d failures, got %v", len(expected), f)
+	}
+	for i := range f {
+		if !strings.HasPrefix(f[i], expected[i]) {
+			t.Errorf("Failure %d is %q, expected to start with %q", i, f[i], expected[i])
+		}
+	}
+	// Zero error rate with results which don't count errors:
+	a = Assertions{MaxErrorRate: 0}
+	if f := a.Check(&res.RunnerResults); len(f) != 0 {
+		t.Errorf("Expected no failures without error count, got %v", f)
+	}
+	if f := a.Check(&RunnerResults{DurationHistogram: stats.NewHistogram(0, 1).Export()}); len(f) != 1 {
+		t.Errorf("Expected failure for no calls, got %v", f)
+	}
+}
+
+// failEvery is a runner failing 1 call out of n.
+type failEvery struct {
+	n      int64
+	calls  int64
+	errors int64
+}
+
+func (f *failEvery) Run(t int) {
+	f.calls++
+	if f.calls%f.n == 0 {
+		f.errors++
+	}
+}
+
+func (f *failEvery) ErrorCount() int64 {
+	return f.errors
+}
+
+func TestSnapshots(t *testing.T) {
+	var lock sync.Mutex
+	var snaps []Snapshot
+	o := RunnerOptions{
+		QPS:              200,
+		NumThreads:       2,
+		Duration:         500 * time.Millisecond,
+		RunID:            42,
+		SnapshotInterval: 100 * time.Millisecond,
+		OnSnapshot: func(s *Snapshot) {
+			lock.Lock()
+			snaps = append(snaps, *s)
+			lock.Unlock()
+		},
+	}
+	r := NewPeriodicRunner(&o)
+	opts := r.Options()
+	for i := 0; i < opts.NumThreads; i++ {
+		opts.Runners[i] = &failEvery{n: 10}
+	}
+	res := r.Run()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(snaps) < 4 || len(snaps) > 7 {
+		t.Fatalf("Unexpected number of snapshots %d: %+v", len(snaps), snaps)
+	}
+	var sum int64
+	for i, s := range snaps {
+		sum += s.IntervalCount
+		if s.RunID != 42 || s.Final != (i == len(snaps)-1) || s.Count != sum {
+			t.Errorf("Unexpected snapshot %d: %+v", i, s)
+		}
+		if s.IntervalCount > 0 && (s.P99 <= 0 || s.P99 < s.P50) {
+			t.Errorf("Unexpected percentiles in snapshot %d: %+v", i, s)
+		}
+	}
+	last := snaps[len(snaps)-1]
+	if last.Count != res.DurationHistogram.Count || last.Errors != last.Count/10 && last.Errors != last.Count/10-1 {
+		t.Errorf("Last snapshot %+v doesn't match the results count %d", last, res.DurationHistogram.Count)
+	}
+	if last.QPS < 150 || last.QPS > 250 {
+		t.Errorf("Unexpected qps in last snapshot %+v", last)
+	}
+}
+
+func TestSnapshotsJSON(t *testing.T) {
+	var b bytes.Buffer
+	o := RunnerOptions{
+		QPS:              -1,
+		Exactly:          10,
+		Out:              &b,
+		SnapshotInterval: time.Hour, // only the final one
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	r.Run()
+	var s Snapshot
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &s); err != nil {
+				t.Errorf("Unable to parse %q: %v", line, err)
+			}
+		}
+	}
+	if !s.Final || s.Count != 10 || s.IntervalCount != 10 {
+		t.Errorf("Unexpected json snapshot %+v in %s", s, b.String())
+	}
+}
+
+func (e *errorResults) ReturnCodes() map[string]int64 {
+	return map[string]int64{"OK": e.DurationHistogram.Count - e.errors, "ERROR": e.errors}
+}
+
+func TestPrometheus(t *testing.T) {
+	h := stats.NewHistogram(0, 0.001)
+	for i := 1; i <= 10; i++ {
+		h.Record(float64(i) / 1000.)
+	}
+	res := &errorResults{RunnerResults{
+		RunType: "Test", Labels: "a \"b\"\n", RunID: 3, RequestedQPS: "100",
+		DurationHistogram: h.Export(), ActualQPS: 99.5, NumThreads: 2,
+	}, 2}
+	p := NewPrometheusExposition()
+	p.AddResults(res)
+	p.AddResults(&RunnerResults{RunID: 4, RequestedQPS: "max", DurationHistogram: stats.NewHistogram(0, 1).Export()})
+	p.AddRunning(&RunnerOptions{RunID: 5, QPS: 10}, &Snapshot{Count: 7, Errors: 1, IntervalQPS: 9.5, P50: 0.1, P99: 0.2})
+	var b bytes.Buffer
+	if _, err := p.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	l := `{run_id="3",run_type="Test",labels="a \"b\"\n"`
+	for _, expected := range []string{
+		"# TYPE fortio_actual_qps gauge\nfortio_actual_qps" + l + "} 99.5\nfortio_actual_qps{run_id=\"4\"",
+		"fortio_requested_qps" + l + "} 100\n# HELP",
+		"fortio_call_duration_seconds_bucket" + l + `,le="0.002"} 2` + "\n",
+		"fortio_call_duration_seconds_bucket" + l + `,le="+Inf"} 10` + "\n",
+		"fortio_call_duration_seconds_count" + l + "} 10\n",
+		"fortio_calls_total" + l + `,code="ERROR"} 2` + "\nfortio_calls_total" + l + `,code="OK"} 8` + "\n",
+		"fortio_errors_total" + l + "} 2\n",
+		`fortio_run_in_progress_calls_total{run_id="5",run_type="",labels=""} 7` + "\n",
+		`fortio_run_in_progress_p99_seconds{run_id="5",run_type="",labels=""} 0.2` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, out)
+		}
+	}
+	if strings.Count(out, "# TYPE fortio_actual_qps") != 1 || strings.Count(out, "fortio_requested_qps{") != 1 {
+		t.Errorf("Metrics should be grouped by name (and max qps not reported):\n%s", out)
+	}
+	var got []byte
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.Method + " " + r.URL.Path
+		got, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	if err := PushPrometheus(srv.URL+"/", "my job", res); err != nil {
+		t.Errorf("Unexpected push error: %v", err)
+	}
+	if path != "PUT /metrics/job/my job" || !strings.Contains(string(got), "fortio_errors_total"+l+"} 2\n") {
+		t.Errorf("Unexpected push %s: %s", path, got)
+	}
+	if err := PushPrometheus(srv.URL+"/notfound\x7f", "job", res); err == nil {
+		t.Errorf("Expected error for invalid url")
+	}
+}
+
+func TestOpenMetricsAndCSV(t *testing.T) {
+	h := stats.NewHistogram(0, 0.001)
+	for i := 1; i <= 10; i++ {
+		h.Record(float64(i) / 1000.)
+	}
+	res := &errorResults{RunnerResults{
+		RunType: "Test", Labels: "x,y", RunID: 3, RequestedQPS: "100",
+		DurationHistogram: h.Export().CalcPercentiles([]float64{50, 99.9}), ActualQPS: 99.5, NumThreads: 2,
+	}, 2}
+	p := NewPrometheusExposition()
+	p.AddResults(res)
+	var b bytes.Buffer
+	if _, err := p.WriteOpenMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	l := `{run_id="3",run_type="Test",labels="x,y"`
+	for _, expected := range []string{
+		"# TYPE fortio_calls counter\nfortio_calls_total" + l + `,code="ERROR"} 2` + "\n",
+		"# TYPE fortio_errors counter\nfortio_errors_total" + l + "} 2\n",
+		"# TYPE fortio_call_duration_seconds histogram\n",
+		"fortio_call_duration_percentile_seconds" + l + `,percentile="99.9"} 0.00999` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\n# EOF\n") {
+		t.Errorf("OpenMetrics output should end with # EOF:\n%s", out)
+	}
+	b.Reset()
+	if err := WriteCSV(&b, res); err != nil {
+		t.Fatal(err)
+	}
+	out = b.String()
+	for _, expected := range []string{
+		"Kind,Name,Start,End,Count,Percent,Value\nsummary,run_type,,,,,Test\nsummary,labels,,,,,\"x,y\"\n",
+		"summary,calls,,,,,10\nsummary,errors,,,,,2\n",
+		"percentile,p50,,,,,0.005\n",
+		"bucket,,0.001,0.002,1,20,\n",
+		"code,ERROR,,,2,20,\ncode,OK,,,8,80,\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in csv:\n%s", expected, out)
+		}
+	}
+}
+
+// slowingDown calls get slower as the run progresses (a "leak").
+type slowingDown struct {
+	start time.Time
+}
+
+func (s *slowingDown) Run(t int) {
+	time.Sleep(time.Since(s.start) / 50)
+}
+
+func TestSoak(t *testing.T) {
+	f, err := ioutil.TempFile("", "fortio-soak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	o := RunnerOptions{
+		QPS:          100,
+		NumThreads:   2,
+		Duration:     600 * time.Millisecond,
+		SoakInterval: 100 * time.Millisecond,
+		SoakFile:     f.Name(),
+		SoakMaxDrift: 0.5,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&slowingDown{start: time.Now()})
+	res := r.Run()
+	s := res.Soak
+	if s == nil || len(s.Windows) < 5 || len(s.Windows) > 8 || s.Interval != o.SoakInterval {
+		t.Fatalf("Unexpected soak results %+v", s)
+	}
+	var count int64
+	for _, w := range s.Windows {
+		count += w.Count
+	}
+	if count != res.DurationHistogram.Count {
+		t.Errorf("Windows count %d doesn't match the results count %d", count, res.DurationHistogram.Count)
+	}
+	if s.P99Slope <= 0 || !s.Drifting {
+		t.Errorf("Expected p99 drift to be detected: %+v", s)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var w WindowSummary
+	if len(lines) != len(s.Windows) || json.Unmarshal([]byte(lines[0]), &w) != nil || w != s.Windows[0] {
+		t.Errorf("Unexpected soak file content %q vs %+v", data, s.Windows)
+	}
+}
+
+func TestP99Trend(t *testing.T) {
+	var windows []WindowSummary
+	for i := 0; i < 10; i++ {
+		windows = append(windows, WindowSummary{Start: time.Duration(i) * time.Minute, Duration: time.Minute, Count: 100, P99: 0.010})
+	}
+	if slope, drift := p99Trend(windows); math.Abs(slope) > 1e-9 || math.Abs(drift) > 1e-9 {
+		t.Errorf("Expected no trend for stable p99, got %g %g", slope, drift)
+	}
+	for i := range windows {
+		windows[i].P99 = 0.010 + 0.001*float64(i) // +1ms per minute, 10ms -> 19ms
+	}
+	slope, drift := p99Trend(windows)
+	if slope < 0.0599 || slope > 0.0601 || drift < 0.899 || drift > 0.901 {
+		t.Errorf("Expected 60ms/h slope and 90%% drift, got %g %g", slope, drift)
+	}
+	// a short last window with few calls doesn't change the trend much
+	windows = append(windows, WindowSummary{Start: 10 * time.Minute, Duration: time.Second, Count: 1, P99: 0.001})
+	if s2, _ := p99Trend(windows); s2 < 0.055 || s2 > slope {
+		t.Errorf("Expected the last short window to have little effect, got %g vs %g", s2, slope)
+	}
+	if slope, drift = p99Trend(windows[:1]); slope != 0 || drift != 0 {
+		t.Errorf("Expected no trend for a single window, got %g %g", slope, drift)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 4, Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond,
+		RetryOn: ParseRetryOn(" 5xx, 429,UNAVAILABLE,,")}
+	if len(p.RetryOn) != 3 {
+		t.Errorf("Unexpected parsed retry on %v", p.RetryOn)
+	}
+	for _, c := range []string{"503", "500", "429", "Unavailable", "unavailable"} {
+		if !p.ShouldRetry(c) {
+			t.Errorf("%s should be retried", c)
+		}
+	}
+	for _, c := range []string{"404", "-1", "5000", "DeadlineExceeded"} {
+		if p.ShouldRetry(c) {
+			t.Errorf("%s should not be retried", c)
+		}
+	}
+	if !p.ShouldRetry("DeadlineExceeded", "503") {
+		t.Errorf("should be retried when any of the codes match")
+	}
+	for i, expected := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond} {
+		if w := p.Wait(i); w != expected {
+			t.Errorf("Wait(%d) got %v expected %v", i, w, expected)
+		}
+	}
+	p.Jitter = FullJitter
+	waits := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		w := p.Wait(1)
+		if w < 0 || w > 20*time.Millisecond {
+			t.Errorf("Full jitter Wait(1) got %v, expected between 0 and 20ms", w)
+		}
+		waits[w] = true
+	}
+	if len(waits) < 2 {
+		t.Errorf("Full jitter waits should vary, got %v", waits)
+	}
+	p.Jitter = EqualJitter
+	for i := 0; i < 20; i++ {
+		if w := p.Wait(1); w < 10*time.Millisecond || w > 20*time.Millisecond {
+			t.Errorf("Equal jitter Wait(1) got %v, expected between 10ms and 20ms", w)
+		}
+	}
+	if p.String() != "4 attempts, 10ms equal jitter backoff, on 5xx,429,UNAVAILABLE" {
+		t.Errorf("Unexpected policy string %q", p.String())
+	}
+	for _, tst := range []struct {
+		s        string
+		expected RetryJitter
+	}{{"", NoJitter}, {"none", NoJitter}, {" Full", FullJitter}, {"equal", EqualJitter}} {
+		if j, err := ParseRetryJitter(tst.s); err != nil || j != tst.expected {
+			t.Errorf("ParseRetryJitter(%q) got %q %v, expected %q", tst.s, j, err, tst.expected)
+		}
+	}
+	if _, err := ParseRetryJitter("random"); err == nil {
+		t.Errorf("Expected an error for an unknown jitter")
+	}
+	p.Jitter = NoJitter
+	p.RetryOn = nil
+	if !p.ShouldRetry("404") || p.String() != "4 attempts, 10ms backoff, on all errors" {
+		t.Errorf("Empty retry on should retry all errors: %s", p.String())
+	}
+	r := NewRetryRecorder(0, 0.001)
+	r.Record(10*time.Millisecond, false, 0, true)
+	r2 := r.Clone()
+	r2.Record(20*time.Millisecond, true, 2, true)
+	r2.Record(20*time.Millisecond, true, 3, false)
+	r2.RecordWait(10 * time.Millisecond)
+	r2.RecordWait(20 * time.Millisecond)
+	r.Transfer(r2)
+	var out bytes.Buffer
+	res := r.Results(&out, &p, []float64{50})
+	if res.FirstAttempt.Count != 3 || res.FirstAttemptErrors != 2 || res.Retries != 5 || res.RetriedCalls != 2 ||
+		res.RecoveredCalls != 1 || r2.retries != 0 || res.Waits.Count != 2 || res.Waits.Max != 0.020 {
+		t.Errorf("Unexpected retry results %+v", res)
+	}
+	if !strings.Contains(out.String(), "5 retries for 2 calls, 1 recovered, 2 first attempt errors out of 3 calls") {
+		t.Errorf("Unexpected retry summary %q", out.String())
+	}
+}
+
+type busyLoop struct{}
+
+func (b *busyLoop) Run(t int) {
+	for start := time.Now(); time.Since(start) < time.Millisecond; { // burn cpu
+	}
+}
+
+func TestSelfStats(t *testing.T) {
+	defer func(d time.Duration) { selfStatsInterval = d }(selfStatsInterval)
+	selfStatsInterval = 10 * time.Millisecond
+	o := RunnerOptions{
+		QPS:        -1,
+		NumThreads: 2,
+		Duration:   200 * time.Millisecond,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&busyLoop{})
+	res := r.Run()
+	s := res.Self
+	if s == nil || s.GOMAXPROCS != runtime.GOMAXPROCS(0) || s.MaxGoroutines < 3 || s.AvgGoroutines <= 0 ||
+		s.AvgGoroutines > float64(s.MaxGoroutines) || s.MaxHeapAlloc == 0 {
+		t.Fatalf("Unexpected self stats %+v", s)
+	}
+	// 2 busy threads: at least ~1 cpu used, unless the machine is very loaded
+	if s.CPUUsage < 0.3 || s.CPUUsage > float64(runtime.NumCPU())+0.5 {
+		t.Errorf("Unexpected cpu usage %+v", s)
+	}
+	if s.CPUPercent > SelfMaxCPUPercent && (!s.Saturated || !strings.HasPrefix(s.Reason, "cpu usage")) {
+		t.Errorf("Expected saturation flag %+v", s)
+	}
+	var out bytes.Buffer
+	s = &SelfStats{CPUUsage: 1.96, CPUPercent: 98, GOMAXPROCS: 2, Saturated: true, Reason: "cpu usage 98.0 % of 2 cpus"}
+	s.Print(&out)
+	if !strings.Contains(out.String(), "WARNING the load generator appears saturated (cpu usage 98.0 % of 2 cpus)") {
+		t.Errorf("Missing saturation warning in %q", out.String())
+	}
+}
+
+// unregisterRunnerTypes removes test runner types, so the tests can run more than once (-count).
+func unregisterRunnerTypes(names ...string) {
+	runnerTypesMutex.Lock()
+	defer runnerTypesMutex.Unlock()
+	for _, name := range names {
+		delete(runnerTypes, name)
+	}
+}
+
+type testClient struct {
+	calls  *int64
+	closed *int64
+}
+
+func (c *testClient) Call() (string, bool) {
+	if atomic.AddInt64(c.calls, 1)%5 == 0 {
+		return "BUSY", false
+	}
+	return "OK", true
+}
+
+func (c *testClient) Close() error {
+	atomic.AddInt64(c.closed, 1)
+	return nil
+}
+
+func TestRunnerTypeRegistry(t *testing.T) {
+	var calls, closed int64
+	defer unregisterRunnerTypes("fortio-test", "fortio-test-err")
+	RegisterRunnerType("fortio-test", func(o *ClientOptions, tid int) (Client, error) {
+		if o.Target != "fortio-test://somewhere" || string(o.Payload) != "abc" {
+			t.Errorf("Unexpected client options %+v", o)
+		}
+		return &testClient{&calls, &closed}, nil
+	})
+	RegisterRunnerType("fortio-test-err", func(o *ClientOptions, tid int) (Client, error) {
+		if tid == 1 {
+			return nil, fmt.Errorf("test error")
+		}
+		return &testClient{&calls, &closed}, nil
+	})
+	for _, name := range []string{"fortio-test", "http", "", "a/b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected panic for registration of %q", name)
+				}
+			}()
+			RegisterRunnerType(name, func(o *ClientOptions, tid int) (Client, error) { return nil, nil })
+		}()
+	}
+	if types := RunnerTypes(); len(types) != 2 || types[0] != "fortio-test" {
+		t.Errorf("Unexpected runner types %v", types)
+	}
+	if _, _, found := LookupRunnerType("http://fortio-test://"); found {
+		t.Errorf("Unexpected runner type found for http url")
+	}
+	o := CustomRunnerOptions{
+		RunnerOptions: RunnerOptions{QPS: -1, NumThreads: 2, Exactly: 20, WarmupCalls: 2},
+	}
+	o.Target = "fortio-test://somewhere"
+	o.Payload = []byte("abc")
+	res, err := RunCustomTest(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RunType != "FORTIO-TEST" || res.DurationHistogram.Count != 20 || res.RetCodes["OK"] != 16 ||
+		res.RetCodes["BUSY"] != 4 || res.ErrorCount() != 4 || atomic.LoadInt64(&closed) != 2 {
+		t.Errorf("Unexpected results %s %d %v %d, %d closed", res.RunType, res.DurationHistogram.Count, res.RetCodes, res.Errors, closed)
+	}
+	atomic.StoreInt64(&closed, 0)
+	o.Target = "fortio-test-err://somewhere"
+	if _, err = RunCustomTest(&o); err == nil || !strings.Contains(err.Error(), "test error") || atomic.LoadInt64(&closed) != 1 {
+		t.Errorf("Expected client creation error and cleanup, got %v, %d closed", err, closed)
+	}
+	o.Target = "fortio-unknown://somewhere"
+	if _, err = RunCustomTest(&o); err == nil {
+		t.Errorf("Expected error for unregistered runner type")
+	}
+}
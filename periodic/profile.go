@@ -0,0 +1,230 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Stage is one step of a load profile: a target qps (negative for max speed) for a duration.
+type Stage struct {
+	QPS      float64
+	Duration time.Duration
+}
+
+func (s Stage) String() string {
+	qps := "max"
+	if s.QPS > 0 {
+		qps = strconv.FormatFloat(s.QPS, 'g', -1, 64)
+	}
+	return qps + ":" + s.Duration.String()
+}
+
+// StageResults are the results of one stage of a load profile.
+type StageResults struct {
+	Stage
+	ActualQPS         float64
+	ActualDuration    time.Duration
+	DurationHistogram *stats.HistogramData
+}
+
+// ProfileString returns the stages in the format parsed by ParseQPSProfile.
+func ProfileString(stages []Stage) string {
+	s := make([]string, len(stages))
+	for i, st := range stages {
+		s[i] = st.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// ParseQPSProfile parses a load profile in the "qps:duration,qps:duration,..." format,
+// e.g. "100:30s,500:30s,1000:1m". qps can be "max" (or negative) for max speed.
+func ParseQPSProfile(profile string) ([]Stage, error) {
+	var stages []Stage
+	for _, s := range strings.Split(profile, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.Split(s, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stage %q, should be qps:duration", s)
+		}
+		qps, err := parseStageQPS(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration in stage %q: %v", s, err)
+		}
+		stages = append(stages, Stage{QPS: qps, Duration: d})
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("empty qps profile %q", profile)
+	}
+	return stages, nil
+}
+
+func parseStageQPS(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return -1, nil
+	}
+	qps, err := strconv.ParseFloat(s, 64)
+	if err != nil || qps == 0 {
+		return 0, fmt.Errorf("invalid qps %q (should be a non zero number or max): %v", s, err)
+	}
+	if qps < 0 {
+		qps = -1
+	}
+	return qps, nil
+}
+
+// ParseRamp parses a linear ramp in the "startQPS:endQPS:duration" format, e.g. "0:1000:2m",
+// and returns it as the given number of steps of equal duration, each at the ramp's qps at
+// the middle of the step.
+func ParseRamp(ramp string, steps int) ([]Stage, error) {
+	parts := strings.Split(ramp, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid ramp %q, should be startQPS:endQPS:duration", ramp)
+	}
+	var qps [2]float64
+	for i := range qps {
+		var err error
+		if qps[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64); err != nil || qps[i] < 0 {
+			return nil, fmt.Errorf("invalid qps %q in ramp %q: %v", parts[i], ramp, err)
+		}
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(parts[2]))
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid duration in ramp %q: %v", ramp, err)
+	}
+	if qps[0] == 0 && qps[1] == 0 {
+		return nil, fmt.Errorf("invalid ramp %q, qps can't be 0 throughout", ramp)
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	stages := make([]Stage, steps)
+	stepDuration := d / time.Duration(steps)
+	for i := range stages {
+		stages[i] = Stage{
+			QPS:      qps[0] + (qps[1]-qps[0])*(float64(i)+0.5)/float64(steps),
+			Duration: stepDuration,
+		}
+	}
+	return stages, nil
+}
+
+func (r *periodicRunner) runStagesSetup(extra string) (requestedDuration string, requestedQPS string) {
+	if r.Exactly > 0 {
+		log.Warnf("Ignoring exactly %d calls as a qps profile is used", r.Exactly)
+		r.Exactly = 0
+	}
+	var total time.Duration
+	for _, s := range r.Stages {
+		total += s.Duration
+	}
+	requestedQPS = ProfileString(r.Stages)
+	requestedDuration = fmt.Sprint(total)
+	if log.Log(log.Warning) {
+		_, _ = fmt.Fprintf(r.Out, "Starting qps profile %s with %d thread(s) [gomax %d] for %v : %d stages%s\n",
+			requestedQPS, r.NumThreads, runtime.GOMAXPROCS(0), total, len(r.Stages), extra)
+	}
+	return
+}
+
+// runStages runs each stage in turn, recording the per stage results as well as
+// the overall ones in funcTimes and sleepTimes.
+func (r *periodicRunner) runStages(runnerChan chan struct{}, funcTimes, sleepTimes *stats.Histogram) []StageResults {
+	results := make([]StageResults, 0, len(r.Stages))
+	for i, st := range r.Stages {
+		select {
+		case <-runnerChan:
+			return results // interrupted
+		default:
+		}
+		s := &periodicRunner{r.RunnerOptions}
+		s.QPS = st.QPS
+		s.Duration = st.Duration
+		var numCalls int64
+		if s.QPS > 0 {
+			numCalls = int64(s.QPS*s.Duration.Seconds()) / int64(s.NumThreads)
+			if numCalls < 2 {
+				numCalls = 2
+			}
+		}
+		stageTimes := stats.NewHistogram(funcTimes.Offset, funcTimes.Divider)
+		elapsed := s.runAll(runnerChan, stageTimes, sleepTimes, numCalls, 0)
+		sr := StageResults{
+			Stage:             st,
+			ActualQPS:         float64(stageTimes.Count) / elapsed.Seconds(),
+			ActualDuration:    elapsed,
+			DurationHistogram: stageTimes.Export().CalcPercentiles(r.Percentiles),
+		}
+		if log.LogVerbose() {
+			sr.DurationHistogram.Print(r.Out, fmt.Sprintf("Stage %d (%s) Function Time", i+1, st))
+		} else if log.Log(log.Warning) {
+			_, _ = fmt.Fprintf(r.Out, "Stage %d (%s) ended after %v : %d calls. qps=%.5g\n",
+				i+1, st, elapsed, stageTimes.Count, sr.ActualQPS)
+		}
+		funcTimes.Transfer(stageTimes)
+		results = append(results, sr)
+	}
+	return results
+}
+
+// runAll runs the Runners in NumThreads go routines, numCalls each (plus leftOver
+// for the first one), recording in funcTimes and sleepTimes. Returns the elapsed time.
+func (r *periodicRunner) runAll(runnerChan chan struct{}, funcTimes, sleepTimes *stats.Histogram,
+	numCalls, leftOver int64) time.Duration {
+	start := time.Now()
+	var wg sync.WaitGroup
+	var fDs []*stats.Histogram
+	var sDs []*stats.Histogram
+	for t := 0; t < r.NumThreads; t++ {
+		thisNumCalls := numCalls
+		if t == 0 {
+			thisNumCalls += leftOver
+		}
+		if r.Exactly > 0 && thisNumCalls == 0 {
+			continue // fewer calls than threads
+		}
+		durP := stats.NewHistogram(funcTimes.Offset, funcTimes.Divider)
+		sleepP := stats.NewHistogram(sleepTimes.Offset, sleepTimes.Divider)
+		fDs = append(fDs, durP)
+		sDs = append(sDs, sleepP)
+		wg.Add(1)
+		go func(t int, durP *stats.Histogram, sleepP *stats.Histogram) {
+			runOne(t, runnerChan, durP, sleepP, thisNumCalls, start, r)
+			wg.Done()
+		}(t, durP, sleepP)
+	}
+	wg.Wait()
+	for i := range fDs {
+		funcTimes.Transfer(fDs[i])
+		sleepTimes.Transfer(sDs[i])
+	}
+	return time.Since(start)
+}
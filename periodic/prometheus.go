@@ -0,0 +1,218 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HasReturnCodes is implemented by the results of the runners which count
+// the calls by return code or status.
+type HasReturnCodes interface {
+	ReturnCodes() map[string]int64
+}
+
+// PrometheusExposition accumulates metrics (grouped by name, as required by
+// the format) to be written in the Prometheus text exposition format (or OpenMetrics).
+type PrometheusExposition struct {
+	names   []string
+	meta    map[string]metricMeta
+	samples map[string][]string // by metric name
+}
+
+// metricMeta is the # TYPE and # HELP of a metric.
+type metricMeta struct {
+	typ  string
+	help string
+}
+
+// NewPrometheusExposition returns an empty exposition.
+func NewPrometheusExposition() *PrometheusExposition {
+	return &PrometheusExposition{
+		meta:    make(map[string]metricMeta),
+		samples: make(map[string][]string),
+	}
+}
+
+// add appends a sample (suffix being "" or _bucket, _sum, _count for histograms) of
+// the metric name.
+func (p *PrometheusExposition) add(name, typ, help, suffix, labels string, value float64) {
+	if _, found := p.meta[name]; !found {
+		p.names = append(p.names, name)
+		p.meta[name] = metricMeta{typ, help}
+	}
+	p.samples[name] = append(p.samples[name],
+		name+suffix+"{"+labels+"} "+strconv.FormatFloat(value, 'g', -1, 64)+"\n")
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PromLabels formats the label pairs (name, value, name, value,...), escaping the values.
+func PromLabels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kv[i])
+		b.WriteString(`="`)
+		b.WriteString(promEscaper.Replace(kv[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func resultLabels(rr *RunnerResults) string {
+	return PromLabels("run_id", strconv.FormatInt(rr.RunID, 10), "run_type", rr.RunType, "labels", rr.Labels)
+}
+
+// AddResults adds the metrics of the results of a finished run.
+func (p *PrometheusExposition) AddResults(res HasRunnerResult) {
+	rr := res.Result()
+	l := resultLabels(rr)
+	if qps, err := strconv.ParseFloat(rr.RequestedQPS, 64); err == nil {
+		p.add("fortio_requested_qps", "gauge", "Target qps of the run (not set for max qps and load profiles).", "", l, qps)
+	}
+	p.add("fortio_actual_qps", "gauge", "Achieved qps of the run.", "", l, rr.ActualQPS)
+	p.add("fortio_threads", "gauge", "Number of concurrent clients of the run.", "", l, float64(rr.NumThreads))
+	p.add("fortio_run_duration_seconds", "gauge", "Actual duration of the run.", "", l, rr.ActualDuration.Seconds())
+	p.add("fortio_run_start_time_seconds", "gauge", "Start time of the run, as a unix timestamp.", "", l,
+		float64(rr.StartTime.UnixNano())/float64(time.Second))
+	h := rr.DurationHistogram
+	if h != nil {
+		const name, help = "fortio_call_duration_seconds", "Duration of the calls of the run."
+		var cumulative int64
+		for _, b := range h.Data {
+			cumulative += b.Count
+			p.add(name, "histogram", help, "_bucket", l+`,le="`+strconv.FormatFloat(b.End, 'g', -1, 64)+`"`, float64(cumulative))
+		}
+		p.add(name, "histogram", help, "_bucket", l+`,le="+Inf"`, float64(h.Count))
+		p.add(name, "histogram", help, "_sum", l, h.Sum)
+		p.add(name, "histogram", help, "_count", l, float64(h.Count))
+		for _, pp := range h.Percentiles {
+			p.add("fortio_call_duration_percentile_seconds", "gauge", "Duration of the calls of the run at the percentile.", "",
+				l+","+PromLabels("percentile", PercentileString(pp.Percentile)), pp.Value)
+		}
+	}
+	if rc, ok := res.(HasReturnCodes); ok {
+		codes := rc.ReturnCodes()
+		keys := make([]string, 0, len(codes))
+		for k := range codes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p.add("fortio_calls_total", "counter", "Calls of the run by return code.", "", l+","+PromLabels("code", k), float64(codes[k]))
+		}
+	}
+	if e, ok := res.(HasErrorCount); ok {
+		p.add("fortio_errors_total", "counter", "Failed calls of the run.", "", l, float64(e.ErrorCount()))
+	}
+}
+
+// AddRunning adds the metrics of a run in progress with its options and latest snapshot
+// (which can be nil if the run doesn't have a SnapshotInterval or hasn't emitted one yet).
+func (p *PrometheusExposition) AddRunning(o *RunnerOptions, s *Snapshot) {
+	l := PromLabels("run_id", strconv.FormatInt(o.RunID, 10), "run_type", o.RunType, "labels", o.Labels)
+	p.add("fortio_run_in_progress", "gauge", "Runs in progress.", "", l, 1)
+	if o.QPS > 0 {
+		p.add("fortio_run_in_progress_requested_qps", "gauge", "Target qps of the run in progress.", "", l, o.QPS)
+	}
+	if s == nil {
+		return
+	}
+	p.add("fortio_run_in_progress_calls_total", "counter", "Calls so far of the run in progress.", "", l, float64(s.Count))
+	p.add("fortio_run_in_progress_errors_total", "counter", "Failed calls so far of the run in progress.", "", l, float64(s.Errors))
+	p.add("fortio_run_in_progress_qps", "gauge", "Qps of the last interval of the run in progress.", "", l, s.IntervalQPS)
+	p.add("fortio_run_in_progress_p50_seconds", "gauge", "Median call duration of the last interval of the run in progress.",
+		"", l, s.P50)
+	p.add("fortio_run_in_progress_p99_seconds", "gauge", "99th percentile call duration of the last interval of the run in progress.",
+		"", l, s.P99)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (p *PrometheusExposition) WriteTo(w io.Writer) (int64, error) {
+	return p.write(w, false)
+}
+
+// WriteOpenMetrics writes the metrics in the OpenMetrics text format: same samples
+// but the counters families are named without their _total suffix and the
+// exposition ends with # EOF.
+func (p *PrometheusExposition) WriteOpenMetrics(w io.Writer) (int64, error) {
+	return p.write(w, true)
+}
+
+func (p *PrometheusExposition) write(w io.Writer, openMetrics bool) (int64, error) {
+	var total int64
+	for _, name := range p.names {
+		m := p.meta[name]
+		family := name
+		if openMetrics && m.typ == "counter" {
+			family = strings.TrimSuffix(name, "_total")
+		}
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, m.help, family, m.typ)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		for _, s := range p.samples[name] {
+			n, err = io.WriteString(w, s)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	if openMetrics {
+		n, err := io.WriteString(w, "# EOF\n")
+		total += int64(n)
+		return total, err
+	}
+	return total, nil
+}
+
+// PushPrometheus sends the results to a Prometheus push gateway (base url, e.g.
+// http://pushgateway:9091), replacing the metrics of the job.
+func PushPrometheus(gateway, job string, res HasRunnerResult) error {
+	p := NewPrometheusExposition()
+	p.AddResults(res)
+	var b bytes.Buffer
+	if _, err := p.WriteTo(&b); err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest(http.MethodPut, u, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("push gateway %s replied %s", u, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// Client is the per thread client of a runner type registered with RegisterRunnerType.
+type Client interface {
+	// Call makes one call to the target and returns its return code (e.g. "OK", a protocol
+	// status or error name) and whether the call succeeded.
+	Call() (code string, ok bool)
+	// Close releases the client's resources (connections...) at the end of the run.
+	Close() error
+}
+
+// ClientOptions are the options given to the registered runner types clients.
+type ClientOptions struct {
+	Target  string        // url of the target, starting with the runner type name and ://
+	Payload []byte        // from the -payload* flags or REST params
+	Timeout time.Duration // per call timeout (-timeout)
+	// Parameters of the REST api run, nil for command line runs: runner types can then
+	// use their own flags, defined with the standard flag package (before fortio parses them).
+	Params url.Values
+}
+
+// ClientFactory returns a new client for the thread tid of a run.
+type ClientFactory func(o *ClientOptions, tid int) (Client, error)
+
+var (
+	runnerTypesMutex sync.Mutex
+	runnerTypes      = make(map[string]ClientFactory)
+	// builtinSchemes can't be registered as they are handled by fortio's own runners.
+	builtinSchemes = map[string]bool{"http": true, "https": true, "tcp": true, "udp": true, "ws": true, "wss": true}
+)
+
+// RegisterRunnerType adds a runner for a custom protocol (kafka, redis...): the load tests
+// of the urls starting with name:// (e.g. "fortio load redis://localhost:6379") then use
+// the clients made by factory, with the periodic scheduling, histograms, return codes and
+// reports of the builtin runners. Meant to be called from init() of the module adding the
+// protocol, panics if the name is invalid or already registered.
+func RegisterRunnerType(name string, factory ClientFactory) {
+	if name == "" || strings.ContainsAny(name, ":/") || builtinSchemes[name] || factory == nil {
+		log.Fatalf("Invalid runner type %q registration", name)
+	}
+	runnerTypesMutex.Lock()
+	defer runnerTypesMutex.Unlock()
+	if _, dup := runnerTypes[name]; dup {
+		log.Fatalf("Runner type %q registered twice", name)
+	}
+	runnerTypes[name] = factory
+}
+
+// RunnerTypes returns the sorted names of the registered runner types.
+func RunnerTypes() []string {
+	runnerTypesMutex.Lock()
+	defer runnerTypesMutex.Unlock()
+	res := make([]string, 0, len(runnerTypes))
+	for name := range runnerTypes {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// LookupRunnerType returns the name and factory of the registered runner type for the
+// target url, if any.
+func LookupRunnerType(target string) (string, ClientFactory, bool) {
+	i := strings.Index(target, "://")
+	if i <= 0 {
+		return "", nil, false
+	}
+	name := target[:i]
+	runnerTypesMutex.Lock()
+	defer runnerTypesMutex.Unlock()
+	f, found := runnerTypes[name]
+	return name, f, found
+}
+
+// CustomRunnerOptions are the options of a registered runner type run.
+type CustomRunnerOptions struct {
+	RunnerOptions
+	ClientOptions
+}
+
+// CustomRunnerResults is the aggregated result of a registered runner type run.
+// Also is the internal type used per thread/goroutine.
+type CustomRunnerResults struct {
+	RunnerResults
+	Target   string
+	RetCodes map[string]int64
+	Errors   int64
+	client   Client
+}
+
+// Run calls the client. Main call being run at the target QPS.
+func (c *CustomRunnerResults) Run(t int) {
+	code, ok := c.client.Call()
+	c.RetCodes[code]++
+	if !ok {
+		c.Errors++
+	}
+}
+
+// ResetStats clears the return codes, after the warmup (implements Resetter).
+func (c *CustomRunnerResults) ResetStats() {
+	c.RetCodes = make(map[string]int64)
+	c.Errors = 0
+}
+
+// ErrorCount returns the number of failed calls (implements HasErrorCount).
+func (c *CustomRunnerResults) ErrorCount() int64 {
+	return c.Errors
+}
+
+// ReturnCodes returns the number of calls by code (implements HasReturnCodes).
+func (c *CustomRunnerResults) ReturnCodes() map[string]int64 {
+	return c.RetCodes
+}
+
+// RunCustomTest runs the load test of o.Target with its registered runner type and
+// returns the aggregated stats.
+func RunCustomTest(o *CustomRunnerOptions) (*CustomRunnerResults, error) {
+	name, factory, found := LookupRunnerType(o.Target)
+	if !found {
+		return nil, fmt.Errorf("no runner type registered for %s", o.Target)
+	}
+	o.RunType = strings.ToUpper(name)
+	log.Infof("Starting %s test for %s with %d threads at %.1f qps", name, o.Target, o.NumThreads, o.QPS)
+	r := NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := CustomRunnerResults{
+		Target:   o.Target,
+		RetCodes: make(map[string]int64),
+	}
+	state := make([]CustomRunnerResults, numThreads)
+	closeClients := func() {
+		for i := range state {
+			if state[i].client == nil {
+				continue
+			}
+			if err := state[i].client.Close(); err != nil {
+				log.Warnf("Error closing %s client %d: %v", name, i, err)
+			}
+		}
+	}
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &state[i]
+		client, err := factory(&o.ClientOptions, i)
+		if err != nil {
+			closeClients()
+			return nil, fmt.Errorf("unable to create %s client %d for %s: %w", name, i, o.Target, err)
+		}
+		state[i].client = client
+		state[i].RetCodes = make(map[string]int64)
+	}
+	total.RunnerResults = r.Run()
+	closeClients()
+	keys := []string{}
+	for i := 0; i < numThreads; i++ {
+		total.Errors += state[i].Errors
+		for k, count := range state[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += count
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	total.printCodes(out, name, keys)
+	return &total, nil
+}
+
+func (c *CustomRunnerResults) printCodes(out io.Writer, name string, keys []string) {
+	totalCount := float64(c.DurationHistogram.Count)
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "%s %s : %d (%.1f %%)\n", name, k, c.RetCodes[k], 100.*float64(c.RetCodes[k])/totalCount)
+	}
+}
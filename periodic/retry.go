@@ -0,0 +1,234 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// RetryPolicy is the optional client side retry of the failed calls, applied to each
+// call by the runners supporting it (http and grpc). The calls duration histogram is
+// then the effective latency, including the retries and backoffs.
+type RetryPolicy struct {
+	MaxAttempts int           // total number of attempts of a call, including the first one (<= 1 is no retry)
+	Backoff     time.Duration // wait before the first retry, doubled for each following one
+	MaxBackoff  time.Duration // maximum wait between attempts, 0 is no maximum
+	Jitter      RetryJitter   // randomization of the waits, to not retry in sync across connections
+	// Codes of the failed calls to retry, all of them when empty: http codes ("503", -1 for
+	// socket errors) or classes ("5xx"), grpc codes by name ("UNAVAILABLE") or number.
+	RetryOn []string
+}
+
+// RetryJitter is the randomization mode of the retry backoffs.
+type RetryJitter string
+
+const (
+	// NoJitter waits exactly the exponential backoff.
+	NoJitter RetryJitter = ""
+	// FullJitter waits a random duration between 0 and the backoff.
+	FullJitter RetryJitter = "full"
+	// EqualJitter waits half the backoff plus a random duration up to the other half.
+	EqualJitter RetryJitter = "equal"
+)
+
+// ParseRetryJitter returns the jitter mode from its name: none (or empty), full or equal.
+func ParseRetryJitter(s string) (RetryJitter, error) {
+	switch j := RetryJitter(strings.ToLower(strings.TrimSpace(s))); j {
+	case NoJitter, "none":
+		return NoJitter, nil
+	case FullJitter, EqualJitter:
+		return j, nil
+	}
+	return NoJitter, fmt.Errorf("unknown retry jitter %q, expecting none, full or equal", s)
+}
+
+// ParseRetryOn returns the codes of the comma separated list, for RetryPolicy.RetryOn.
+func ParseRetryOn(s string) []string {
+	var res []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// normalizeCode makes grpc code names comparable (UNAVAILABLE, Unavailable, DEADLINE_EXCEEDED vs DeadlineExceeded).
+func normalizeCode(c string) string {
+	return strings.ToLower(strings.ReplaceAll(c, "_", ""))
+}
+
+// ShouldRetry returns true if a failed call with one of the codes (e.g. the grpc code
+// name and number) is to be retried.
+func (p *RetryPolicy) ShouldRetry(codes ...string) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, r := range p.RetryOn {
+		r = normalizeCode(r)
+		for _, c := range codes {
+			c = normalizeCode(c)
+			if r == c || (len(r) == 3 && strings.HasSuffix(r, "xx") && len(c) == 3 && r[0] == c[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wait returns the backoff before the retry number retry (starting at 0), randomized
+// as per the Jitter mode.
+func (p *RetryPolicy) Wait(retry int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return d
+	}
+	switch p.Jitter {
+	case FullJitter:
+		d = time.Duration(rand.Int63n(int64(d) + 1)) // nolint:gosec // not for crypto
+	case EqualJitter:
+		d = d/2 + time.Duration(rand.Int63n(int64(d-d/2)+1)) // nolint:gosec // not for crypto
+	case NoJitter:
+	}
+	return d
+}
+
+// String returns a summary of the policy, for the run type/logs.
+func (p *RetryPolicy) String() string {
+	on := "all errors"
+	if len(p.RetryOn) > 0 {
+		on = strings.Join(p.RetryOn, ",")
+	}
+	jitter := ""
+	if p.Jitter != NoJitter {
+		jitter = " " + string(p.Jitter) + " jitter"
+	}
+	return fmt.Sprintf("%d attempts, %v%s backoff, on %s", p.MaxAttempts, p.Backoff, jitter, on)
+}
+
+// RetryRecorder records the first attempt latency and outcome of the calls and their
+// retries, and the backoff waits. One per 'thread', merged with Transfer.
+type RetryRecorder struct {
+	firstAttempt       *stats.Histogram
+	waits              *stats.Histogram
+	firstAttemptErrors int64
+	retries            int64
+	retriedCalls       int64
+	recoveredCalls     int64
+}
+
+// RetryResults are the exported RetryRecorder data.
+type RetryResults struct {
+	Policy RetryPolicy
+	// Latency of the first attempt of each call, i.e without the retries.
+	FirstAttempt *stats.HistogramData
+	// Backoff waits before the retries, in seconds.
+	Waits *stats.HistogramData
+	// Calls whose first attempt failed: the raw failure count, while the return codes
+	// are the ones of the last attempts.
+	FirstAttemptErrors int64
+	Retries            int64 // total number of attempts after the first ones
+	RetriedCalls       int64 // calls with at least one retry
+	RecoveredCalls     int64 // retried calls which eventually succeeded
+}
+
+// NewRetryRecorder returns a recorder with histograms of the given offset and resolution.
+func NewRetryRecorder(offset, resolution float64) *RetryRecorder {
+	return &RetryRecorder{firstAttempt: stats.NewHistogram(offset, resolution), waits: stats.NewHistogram(0, resolution)}
+}
+
+// RecordWait records a backoff wait before a retry.
+func (r *RetryRecorder) RecordWait(d time.Duration) {
+	r.waits.Record(d.Seconds())
+}
+
+// Record records a call whose first attempt took first, failed or not, followed by
+// retries attempts, the last one having succeeded or not.
+func (r *RetryRecorder) Record(first time.Duration, firstFailed bool, retries int, succeeded bool) {
+	r.firstAttempt.Record(first.Seconds())
+	if firstFailed {
+		r.firstAttemptErrors++
+	}
+	if retries == 0 {
+		return
+	}
+	r.retries += int64(retries)
+	r.retriedCalls++
+	if succeeded {
+		r.recoveredCalls++
+	}
+}
+
+// Clone returns an empty recorder with the same histogram parameters.
+func (r *RetryRecorder) Clone() *RetryRecorder {
+	return &RetryRecorder{
+		firstAttempt: stats.NewHistogram(r.firstAttempt.Offset, r.firstAttempt.Divider),
+		waits:        stats.NewHistogram(r.waits.Offset, r.waits.Divider),
+	}
+}
+
+// Reset clears the recorded data.
+func (r *RetryRecorder) Reset() {
+	r.firstAttempt.Reset()
+	r.waits.Reset()
+	r.firstAttemptErrors, r.retries, r.retriedCalls, r.recoveredCalls = 0, 0, 0, 0
+}
+
+// Transfer merges the data of src into r and resets src.
+func (r *RetryRecorder) Transfer(src *RetryRecorder) {
+	r.firstAttempt.Transfer(src.firstAttempt)
+	r.waits.Transfer(src.waits)
+	r.firstAttemptErrors += src.firstAttemptErrors
+	r.retries += src.retries
+	r.retriedCalls += src.retriedCalls
+	r.recoveredCalls += src.recoveredCalls
+	src.Reset()
+}
+
+// Results exports the data, with the given percentiles, and prints its summary to out.
+func (r *RetryRecorder) Results(out io.Writer, p *RetryPolicy, percentiles []float64) *RetryResults {
+	res := &RetryResults{
+		Policy:             *p,
+		FirstAttempt:       r.firstAttempt.Export().CalcPercentiles(percentiles),
+		Waits:              r.waits.Export().CalcPercentiles(percentiles),
+		FirstAttemptErrors: r.firstAttemptErrors,
+		Retries:            r.retries,
+		RetriedCalls:       r.retriedCalls,
+		RecoveredCalls:     r.recoveredCalls,
+	}
+	_, _ = fmt.Fprintf(out, "Retries (%s): %d retries for %d calls, %d recovered, %d first attempt errors out of %d calls\n",
+		p, r.retries, r.retriedCalls, r.recoveredCalls, r.firstAttemptErrors, res.FirstAttempt.Count)
+	if log.LogVerbose() {
+		res.FirstAttempt.Print(out, "First Attempt Histogram")
+		res.Waits.Print(out, "Retry Backoff Histogram")
+	} else if log.Log(log.Warning) {
+		r.firstAttempt.Counter.Print(out, "First attempt")
+		r.waits.Counter.Print(out, "Retry backoff")
+	}
+	return res
+}
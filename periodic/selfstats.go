@@ -0,0 +1,135 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Thresholds above which the load generator itself is flagged as saturated.
+const (
+	SelfMaxCPUPercent     = 90. // process cpu usage, in percent of GOMAXPROCS
+	SelfMaxGCPausePercent = 5.  // total gc stop the world pauses, in percent of the run duration
+)
+
+// selfStatsInterval is how often the goroutines count and heap size are sampled.
+var selfStatsInterval = time.Second
+
+// SelfStats is the resource usage of the fortio process itself during the run, to tell
+// a client side bottleneck (e.g. a latency plateau because fortio is out of cpu) from
+// the target's.
+type SelfStats struct {
+	// Process cpu time (user + system) over the run duration, in cpus (1 is one fully used cpu).
+	// 0 when unavailable on the platform.
+	CPUUsage   float64
+	CPUPercent float64 // CPUUsage in percent of the GOMAXPROCS usable cpus
+	GOMAXPROCS int
+	NumGC      uint32        // garbage collections during the run
+	GCPause    time.Duration // total of their stop the world pauses
+	// Sampled number of goroutines and heap in use.
+	MaxGoroutines int
+	AvgGoroutines float64
+	MaxHeapAlloc  uint64
+	// The cpu or gc pauses usage is above the SelfMaxCPUPercent or SelfMaxGCPausePercent
+	// thresholds: the results are probably limited by the load generator rather than the target.
+	Saturated bool
+	Reason    string `json:",omitempty"`
+}
+
+type selfSampler struct {
+	sync.Mutex
+	samples    int
+	goroutines int
+	stats      SelfStats
+}
+
+func (s *selfSampler) sample() *runtime.MemStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	g := runtime.NumGoroutine()
+	s.Lock()
+	s.samples++
+	s.goroutines += g
+	if g > s.stats.MaxGoroutines {
+		s.stats.MaxGoroutines = g
+	}
+	if m.HeapAlloc > s.stats.MaxHeapAlloc {
+		s.stats.MaxHeapAlloc = m.HeapAlloc
+	}
+	s.Unlock()
+	return &m
+}
+
+// startSelfStats samples the process resources every selfStatsInterval until the
+// returned function is called, which returns the usage since start.
+func startSelfStats() func() *SelfStats {
+	s := &selfSampler{}
+	start := time.Now()
+	startCPU, cpuOk := processCPUTime()
+	m0 := s.sample()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(selfStatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.sample()
+			}
+		}
+	}()
+	return func() *SelfStats {
+		close(done)
+		wg.Wait()
+		m1 := s.sample()
+		elapsed := time.Since(start)
+		res := &s.stats
+		res.GOMAXPROCS = runtime.GOMAXPROCS(0)
+		res.AvgGoroutines = float64(s.goroutines) / float64(s.samples)
+		res.NumGC = m1.NumGC - m0.NumGC
+		res.GCPause = time.Duration(m1.PauseTotalNs - m0.PauseTotalNs)
+		if endCPU, ok := processCPUTime(); ok && cpuOk && elapsed > 0 {
+			res.CPUUsage = (endCPU - startCPU).Seconds() / elapsed.Seconds()
+			res.CPUPercent = 100. * res.CPUUsage / float64(res.GOMAXPROCS)
+		}
+		if res.CPUPercent > SelfMaxCPUPercent {
+			res.Saturated = true
+			res.Reason = fmt.Sprintf("cpu usage %.1f %% of %d cpus", res.CPUPercent, res.GOMAXPROCS)
+		} else if gcPct := 100. * res.GCPause.Seconds() / elapsed.Seconds(); gcPct > SelfMaxGCPausePercent {
+			res.Saturated = true
+			res.Reason = fmt.Sprintf("gc pauses %.1f %% of the run", gcPct)
+		}
+		return res
+	}
+}
+
+// Print writes the load generator resources usage summary.
+func (s *SelfStats) Print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Fortio self usage: cpu %.3g (%.1f %% of %d), %d gc (%v pauses), goroutines max %d avg %.1f, max heap %d\n",
+		s.CPUUsage, s.CPUPercent, s.GOMAXPROCS, s.NumGC, s.GCPause, s.MaxGoroutines, s.AvgGoroutines, s.MaxHeapAlloc)
+	if s.Saturated {
+		_, _ = fmt.Fprintf(out, "WARNING the load generator appears saturated (%s): the results may be limited by fortio, "+
+			"not the target\n", s.Reason)
+	}
+}
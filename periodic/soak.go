@@ -0,0 +1,183 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// WindowSummary is the summary of the calls of one SoakInterval window of a soak run.
+type WindowSummary struct {
+	Start    time.Duration // since the start of the run (after the warmup)
+	Duration time.Duration
+	Count    int64
+	QPS      float64
+	Errors   int64 // calls which failed during (about) the window, for the runners implementing HasErrorCount
+	// Latencies of the calls of the window, in seconds.
+	Avg float64
+	P50 float64
+	P90 float64
+	P99 float64
+	Max float64
+}
+
+// SoakResults are the windows of a soak run and the latency trend over the run.
+type SoakResults struct {
+	Interval time.Duration
+	Windows  []WindowSummary
+	// Least squares fit of the windows p99: slope, in seconds per hour, and relative
+	// increase over the run (fitted p99 at the end vs at the start).
+	P99Slope float64
+	P99Drift float64
+	// The P99Drift is above the SoakMaxDrift.
+	Drifting bool
+}
+
+// soakWindows accumulates the calls of the current window and the summaries of the
+// previous ones.
+type soakWindows struct {
+	*interimStats
+	out        io.Writer // optional, each window summary is written as a json line
+	lastErrors int64
+	results    SoakResults
+}
+
+// startSoak rotates the soak window every SoakInterval until the returned function
+// is called, which closes the last (partial) window and returns the results.
+func (r *periodicRunner) startSoak(start time.Time) func() *SoakResults {
+	s := &soakWindows{interimStats: newInterimStats(r.NumThreads, r.Offset.Seconds(), r.Resolution)}
+	s.start = start
+	s.last = start
+	s.results.Interval = r.SoakInterval
+	var f *os.File
+	if r.SoakFile != "" {
+		var err error
+		if f, err = os.Create(r.SoakFile); err != nil {
+			log.Errf("Unable to create soak windows file %s: %v", r.SoakFile, err)
+		} else {
+			s.out = f
+		}
+	}
+	r.soak = s
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(r.SoakInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				s.rotate(now, nil)
+			}
+		}
+	}()
+	return func() *SoakResults {
+		close(done)
+		wg.Wait()
+		s.rotate(time.Now(), r.Runners)
+		if f != nil {
+			if err := f.Close(); err != nil {
+				log.Errf("Close error for soak windows file %s: %v", r.SoakFile, err)
+			}
+		}
+		s.results.P99Slope, s.results.P99Drift = p99Trend(s.results.Windows)
+		s.results.Drifting = r.SoakMaxDrift > 0 && s.results.P99Drift > r.SoakMaxDrift
+		return &s.results
+	}
+}
+
+// rotate closes the current window (if it has calls) and starts a new one. runners
+// is passed for the last one, once the threads are done.
+func (s *soakWindows) rotate(now time.Time, runners []Runnable) {
+	h, errors := s.collect(runners)
+	w := WindowSummary{Start: s.last.Sub(s.start), Duration: now.Sub(s.last), Count: h.Count}
+	s.last = now
+	w.Errors = errors - s.lastErrors
+	s.lastErrors = errors
+	if w.Count == 0 {
+		return
+	}
+	w.QPS = float64(w.Count) / w.Duration.Seconds()
+	w.Avg = h.Avg
+	w.P50 = h.CalcPercentile(50)
+	w.P90 = h.CalcPercentile(90)
+	w.P99 = h.CalcPercentile(99)
+	w.Max = h.Max
+	s.results.Windows = append(s.results.Windows, w)
+	if s.out == nil {
+		return
+	}
+	j, err := json.Marshal(&w)
+	if err != nil {
+		log.Errf("Unable to json serialize soak window: %v", err)
+		return
+	}
+	if _, err = s.out.Write(append(j, '\n')); err != nil {
+		log.Errf("Unable to write soak window: %v", err)
+	}
+}
+
+// p99Trend returns the slope, in seconds per hour, of the least squares fit of the
+// windows p99 (as a function of the windows middle time, weighted by their calls
+// count so the last partial window doesn't skew it) and the relative increase of
+// the fitted p99 from the first to the last window.
+func p99Trend(windows []WindowSummary) (slope float64, drift float64) {
+	if len(windows) < 2 {
+		return 0, 0
+	}
+	var n, sx, sy, sxx, sxy float64
+	for _, w := range windows {
+		c := float64(w.Count)
+		x := (w.Start + w.Duration/2).Hours()
+		n += c
+		sx += c * x
+		sy += c * w.P99
+		sxx += c * x * x
+		sxy += c * x * w.P99
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0, 0
+	}
+	slope = (n*sxy - sx*sy) / d
+	intercept := (sy - slope*sx) / n
+	first, last := windows[0], windows[len(windows)-1]
+	startFit := intercept + slope*(first.Start+first.Duration/2).Hours()
+	endFit := intercept + slope*(last.Start+last.Duration/2).Hours()
+	if startFit <= 0 {
+		return slope, 0
+	}
+	return slope, (endFit - startFit) / startFit
+}
+
+// Print writes the soak windows count and latency trend.
+func (s *SoakResults) Print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Soak: %d windows of %v, p99 trend %+.3f ms/hour (%+.1f %% over the run)\n",
+		len(s.Windows), s.Interval, 1000.*s.P99Slope, 100.*s.P99Drift)
+	if s.Drifting {
+		_, _ = fmt.Fprintf(out, "WARNING latency drift detected: p99 increased by %.1f %% over the run\n", 100.*s.P99Drift)
+	}
+}
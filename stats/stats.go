@@ -497,6 +497,28 @@ func (h *Histogram) Transfer(src *Histogram) {
 	src.Reset()
 }
 
+// MergeData adds exported data, for instance from another process, to the histogram.
+// The merge is at the bucket level so the data must come from a Histogram with the
+// same Offset and Divider. The percentiles of d are ignored.
+func (h *Histogram) MergeData(d *HistogramData) {
+	if d.Count == 0 {
+		return
+	}
+	for _, b := range d.Data {
+		// the End of each bucket is included in it (and is Max for the last one)
+		h.record(b.End, int(b.Count))
+	}
+	fC := float64(d.Count)
+	c := Counter{
+		Count:        d.Count,
+		Min:          d.Min,
+		Max:          d.Max,
+		Sum:          d.Sum,
+		sumOfSquares: fC*d.StdDev*d.StdDev + d.Sum*d.Sum/fC,
+	}
+	h.Counter.Transfer(&c)
+}
+
 // ParsePercentiles extracts the percentiles from string (flag).
 func ParsePercentiles(percentiles string) ([]float64, error) {
 	percs := strings.Split(percentiles, ",") // will make a size 1 array for empty input!
@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"reflect"
@@ -795,6 +796,42 @@ func TestAllBucketBoundaries(t *testing.T) {
 	}
 }
 
+func TestMergeData(t *testing.T) {
+	for _, offset := range []float64{0, 0.0005} {
+		all := NewHistogram(offset, 0.001)
+		h1 := NewHistogram(offset, 0.001)
+		h2 := NewHistogram(offset, 0.001)
+		for i := 0; i < 200; i++ {
+			v := 0.0003 * float64(i*i%97)
+			all.Record(v)
+			if i%3 == 0 {
+				h1.Record(v)
+			} else {
+				h2.Record(v)
+			}
+		}
+		merged := NewHistogram(offset, 0.001)
+		merged.MergeData(h1.Export())
+		merged.MergeData(h2.Export())
+		merged.MergeData(&HistogramData{}) // no-op
+		expected := all.Export().CalcPercentiles([]float64{50, 99})
+		got := merged.Export().CalcPercentiles([]float64{50, 99})
+		if len(got.Data) != len(expected.Data) {
+			t.Fatalf("Merged buckets %+v don't match %+v", got.Data, expected.Data)
+		}
+		for i := range got.Data {
+			if got.Data[i] != expected.Data[i] {
+				t.Errorf("Merged bucket %d %+v doesn't match %+v", i, got.Data[i], expected.Data[i])
+			}
+		}
+		if got.Count != expected.Count || got.Min != expected.Min || got.Max != expected.Max ||
+			math.Abs(got.Sum-expected.Sum) > 1e-9 || math.Abs(got.StdDev-expected.StdDev) > 1e-9 ||
+			got.Percentiles[0] != expected.Percentiles[0] {
+			t.Errorf("Merged %+v doesn't match %+v", got, expected)
+		}
+	}
+}
+
 // TODO: add test with data 1.0 1.0001 1.999 2.0 2.5
 // should get 3 buckets 0-1 with count 1
 // 1-2 with count 3
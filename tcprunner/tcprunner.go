@@ -57,6 +57,27 @@ func (tcpstate *RunnerResults) Run(t int) {
 	}
 }
 
+// ResetStats clears the return codes, after the warmup (implements periodic.Resetter).
+func (tcpstate *RunnerResults) ResetStats() {
+	tcpstate.RetCodes = make(TCPResultMap)
+}
+
+// ErrorCount returns the number of failed calls (implements periodic.HasErrorCount).
+func (tcpstate *RunnerResults) ErrorCount() int64 {
+	var n int64
+	for k, count := range tcpstate.RetCodes {
+		if k != TCPStatusOK {
+			n += count
+		}
+	}
+	return n
+}
+
+// ReturnCodes returns the number of calls by status (implements periodic.HasReturnCodes).
+func (tcpstate *RunnerResults) ReturnCodes() map[string]int64 {
+	return tcpstate.RetCodes
+}
+
 // TCPOptions are options to the TCPClient.
 type TCPOptions struct {
 	Destination      string
@@ -0,0 +1,252 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing generates W3C trace context (traceparent) for the load test
+// calls and optionally exports them as client spans to an OpenTelemetry
+// collector, using OTLP/HTTP with the json encoding (so without any dependency).
+package tracing // import "fortio.org/fortio/tracing"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// TraceparentHeader is the W3C trace context header (and grpc metadata key).
+const TraceparentHeader = "traceparent"
+
+// TraceparentLen is the length of the traceparent values generated.
+const TraceparentLen = 55
+
+const (
+	// Maximum number of spans waiting to be exported, the ones beyond are dropped.
+	maxQueuedSpans = 8192
+	// Spans are exported in batches of up to maxBatch or every exportInterval.
+	maxBatch       = 512
+	exportInterval = time.Second
+)
+
+// Options for the Tracer.
+type Options struct {
+	// Fraction of the calls which are sampled (marked as such in traceparent and exported).
+	SampleRatio float64
+	// OTLP/HTTP collector base url (e.g. http://localhost:4318), spans are only exported when set.
+	Endpoint    string
+	ServiceName string // defaults to "fortio"
+}
+
+// SpanContext identifies the span of one call.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Traceparent returns the W3C traceparent header value for the span.
+func (sc *SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Attribute is a span attribute, Value being a string or an int.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Tracer creates the span contexts and exports the sampled spans. It is safe for
+// concurrent use. Close() must be called to flush the spans still queued.
+type Tracer struct {
+	Options
+	lock   sync.Mutex
+	rng    *rand.Rand
+	spans  chan *span
+	done   chan struct{}
+	wg     sync.WaitGroup
+	client *http.Client
+}
+
+// NewTracer returns a Tracer, starting the exporter if o.Endpoint is set.
+func NewTracer(o *Options) *Tracer {
+	t := &Tracer{
+		Options: *o,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())), // nolint: gosec // ids, not crypto
+	}
+	if t.ServiceName == "" {
+		t.ServiceName = "fortio"
+	}
+	if t.Endpoint != "" {
+		t.Endpoint = strings.TrimSuffix(t.Endpoint, "/") + "/v1/traces"
+		t.spans = make(chan *span, maxQueuedSpans)
+		t.done = make(chan struct{})
+		t.client = &http.Client{Timeout: 10 * time.Second}
+		t.wg.Add(1)
+		go t.export()
+		log.Infof("Exporting %g of the call spans to %s", t.SampleRatio, t.Endpoint)
+	}
+	return t
+}
+
+// NewSpanContext returns a new random span context, sampled according to SampleRatio.
+func (t *Tracer) NewSpanContext() SpanContext {
+	var sc SpanContext
+	t.lock.Lock()
+	binary.BigEndian.PutUint64(sc.TraceID[:8], t.rng.Uint64())
+	binary.BigEndian.PutUint64(sc.TraceID[8:], t.rng.Uint64())
+	binary.BigEndian.PutUint64(sc.SpanID[:], t.rng.Uint64())
+	sc.Sampled = t.SampleRatio >= 1 || (t.SampleRatio > 0 && t.rng.Float64() < t.SampleRatio)
+	t.lock.Unlock()
+	return sc
+}
+
+// span is the OTLP json representation of a span.
+type span struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"` // 0 unset, 2 error
+}
+
+const spanKindClient = 3
+
+// End records the end of the call of sc (if sampled and exported), failed being
+// true if the call was unsuccessful.
+func (t *Tracer) End(sc *SpanContext, name string, start, end time.Time, failed bool, attrs ...Attribute) {
+	if t.spans == nil || !sc.Sampled {
+		return
+	}
+	s := &span{
+		TraceID:           hex.EncodeToString(sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(sc.SpanID[:]),
+		Name:              name,
+		Kind:              spanKindClient,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if failed {
+		s.Status.Code = 2
+	}
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case int:
+			s.Attributes = append(s.Attributes, otlpAttribute{a.Key, map[string]string{"intValue": strconv.Itoa(v)}})
+		default:
+			s.Attributes = append(s.Attributes, otlpAttribute{a.Key, map[string]string{"stringValue": fmt.Sprint(v)}})
+		}
+	}
+	select {
+	case t.spans <- s:
+	default:
+		log.Debugf("Span export queue full, dropping span")
+	}
+}
+
+// Close flushes the queued spans and stops the exporter.
+func (t *Tracer) Close() {
+	if t.done == nil {
+		return
+	}
+	close(t.done)
+	t.wg.Wait()
+	t.done = nil
+}
+
+func (t *Tracer) export() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, maxBatch)
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < maxBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.done:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+				if len(batch) == maxBatch {
+					t.send(batch)
+					batch = batch[:0]
+				}
+			}
+			t.send(batch)
+			return
+		}
+		t.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send posts the spans to the collector in an OTLP ExportTraceServiceRequest.
+func (t *Tracer) send(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpAttribute{
+				{"service.name", map[string]string{"stringValue": t.ServiceName}},
+			}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "fortio"},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		log.Errf("Unable to json serialize spans: %v", err)
+		return
+	}
+	resp, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Errf("Unable to export %d spans to %s: %v", len(spans), t.Endpoint, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Errf("Exporting %d spans to %s failed: %s", len(spans), t.Endpoint, resp.Status)
+		return
+	}
+	log.LogVf("Exported %d spans to %s", len(spans), t.Endpoint)
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+var traceparentRegexp = regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-0[01]$`)
+
+func TestTraceparent(t *testing.T) {
+	tr := NewTracer(&Options{SampleRatio: 1})
+	defer tr.Close()
+	sc1 := tr.NewSpanContext()
+	sc2 := tr.NewSpanContext()
+	tp1, tp2 := sc1.Traceparent(), sc2.Traceparent()
+	if !traceparentRegexp.MatchString(tp1) || len(tp1) != TraceparentLen || tp1[53:] != "01" {
+		t.Errorf("Invalid traceparent %q", tp1)
+	}
+	if tp1[3:35] == tp2[3:35] || tp1[36:52] == tp2[36:52] {
+		t.Errorf("Expected different trace and span ids, got %q and %q", tp1, tp2)
+	}
+	tr = NewTracer(&Options{SampleRatio: 0})
+	if sc := tr.NewSpanContext(); sc.Sampled || sc.Traceparent()[53:] != "00" {
+		t.Errorf("Expected not sampled span context, got %q", sc.Traceparent())
+	}
+	tr = NewTracer(&Options{SampleRatio: 0.25})
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		if sc := tr.NewSpanContext(); sc.Sampled {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("Expected about 1000 sampled out of 4000 at 0.25, got %d", sampled)
+	}
+}
+
+func TestExport(t *testing.T) {
+	var lock sync.Mutex
+	var spans []map[string]interface{}
+	var service interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export request %s %v", r.URL.Path, r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Value map[string]interface{}
+					}
+				}
+				ScopeSpans []struct {
+					Spans []map[string]interface{}
+				}
+			}
+		}
+		if err := json.Unmarshal(b, &req); err != nil {
+			t.Errorf("Invalid json %s: %v", b, err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, rs := range req.ResourceSpans {
+			service = rs.Resource.Attributes[0].Value["stringValue"]
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer srv.Close()
+	tr := NewTracer(&Options{SampleRatio: 1, Endpoint: srv.URL + "/", ServiceName: "test"})
+	start := time.Unix(1, 5)
+	for i := 0; i < 600; i++ {
+		sc := tr.NewSpanContext()
+		tr.End(&sc, "HTTP GET", start, start.Add(time.Millisecond), i == 0,
+			Attribute{"http.status_code", 200}, Attribute{"http.method", "GET"})
+	}
+	notSampled := SpanContext{}
+	tr.End(&notSampled, "not exported", start, start, false)
+	tr.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(spans) != 600 || service != "test" {
+		t.Fatalf("Expected 600 spans for service test, got %d for %v", len(spans), service)
+	}
+	s := spans[0]
+	if s["name"] != "HTTP GET" || s["kind"] != 3. || s["startTimeUnixNano"] != "1000000005" ||
+		s["endTimeUnixNano"] != "1001000005" || len(s["traceId"].(string)) != 32 {
+		t.Errorf("Unexpected span %v", s)
+	}
+	attrs := s["attributes"].([]interface{})
+	if a := attrs[0].(map[string]interface{}); a["key"] != "http.status_code" ||
+		a["value"].(map[string]interface{})["intValue"] != "200" {
+		t.Errorf("Unexpected attribute %v", a)
+	}
+	if s["status"].(map[string]interface{})["code"] != 2. || len(spans[1]["status"].(map[string]interface{})) != 0 {
+		t.Errorf("Expected error status only for the first span: %v %v", s["status"], spans[1]["status"])
+	}
+}
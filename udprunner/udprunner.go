@@ -21,6 +21,7 @@ import (
 	"net"
 	"os"
 	"sort"
+	"strconv"
 	"time"
 
 	"fortio.org/fortio/fnet"
@@ -44,8 +45,12 @@ type RunnerResults struct {
 	SocketCount   int
 	BytesSent     int64
 	BytesReceived int64
-	client        *UDPClient
-	aborter       *periodic.Aborter
+	// Timeouts counts the requests without reply in time (i.e the packet loss).
+	Timeouts int64
+	// Mismatches counts the replies received which didn't echo the request.
+	Mismatches int64
+	client     *UDPClient
+	aborter    *periodic.Aborter
 }
 
 // Run tests udp request fetching. Main call being run at the target QPS.
@@ -60,11 +65,35 @@ func (udpstate *RunnerResults) Run(t int) {
 	}
 }
 
+// ResetStats clears the return codes, after the warmup (implements periodic.Resetter).
+func (udpstate *RunnerResults) ResetStats() {
+	udpstate.RetCodes = make(UDPResultMap)
+}
+
+// ErrorCount returns the number of failed calls (implements periodic.HasErrorCount).
+func (udpstate *RunnerResults) ErrorCount() int64 {
+	var n int64
+	for k, count := range udpstate.RetCodes {
+		if k != UDPStatusOK {
+			n += count
+		}
+	}
+	return n
+}
+
+// ReturnCodes returns the number of calls by status (implements periodic.HasReturnCodes).
+func (udpstate *RunnerResults) ReturnCodes() map[string]int64 {
+	return udpstate.RetCodes
+}
+
 // UDPOptions are options to the UDPClient.
 type UDPOptions struct {
 	Destination string
 	Payload     []byte // what to send (and check)
-	ReqTimeout  time.Duration
+	// PayloadTemplate is true when the Payload is a template, see ExpandPayload, generating
+	// a different payload for each request.
+	PayloadTemplate bool
+	ReqTimeout      time.Duration
 }
 
 // RunnerOptions includes the base RunnerOptions plus udp specific
@@ -78,6 +107,7 @@ type RunnerOptions struct {
 type UDPClient struct {
 	buffer        []byte
 	req           []byte
+	template      []byte
 	dest          net.Addr
 	socket        net.Conn
 	connID        int // 0-9999
@@ -101,6 +131,21 @@ var (
 	errMismatch  = fmt.Errorf("read not echoing writes")
 )
 
+// Placeholders replaced in the payload templates.
+var (
+	templateConn = []byte("{conn}") // connection/thread id
+	templateSeq  = []byte("{seq}")  // request number on that connection
+	templateTime = []byte("{time}") // current time in nanoseconds since epoch
+)
+
+// ExpandPayload returns the payload for the seq-th request of connection connID
+// by replacing the {conn}, {seq} and {time} placeholders of the template.
+func ExpandPayload(template []byte, connID int, seq int64) []byte {
+	res := bytes.ReplaceAll(template, templateConn, []byte(strconv.Itoa(connID)))
+	res = bytes.ReplaceAll(res, templateSeq, []byte(strconv.FormatInt(seq, 10)))
+	return bytes.ReplaceAll(res, templateTime, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
+}
+
 // NewUDPClient creates and initialize and returns a client based on the UDPOptions.
 func NewUDPClient(o *UDPOptions) (*UDPClient, error) {
 	c := UDPClient{}
@@ -115,6 +160,9 @@ func NewUDPClient(o *UDPOptions) (*UDPClient, error) {
 	if len(c.req) == 0 { // len(nil) array is also valid and 0
 		c.doGenerate = true
 		c.req = tcprunner.GeneratePayload(0, 0)
+	} else if o.PayloadTemplate {
+		c.template = c.req
+		c.req = ExpandPayload(c.template, 0, 0)
 	}
 	c.buffer = make([]byte, len(c.req))
 	c.reqTimeout = o.ReqTimeout
@@ -160,6 +208,12 @@ func (c *UDPClient) Fetch() ([]byte, error) {
 	if c.doGenerate {
 		// TODO write directly in buffer to avoid generating garbage for GC to clean
 		c.req = tcprunner.GeneratePayload(c.connID, c.messageCount)
+	} else if c.template != nil {
+		c.req = ExpandPayload(c.template, c.connID, c.messageCount)
+		if len(c.req) > cap(c.buffer) {
+			c.buffer = make([]byte, len(c.req))
+		}
+		c.buffer = c.buffer[:len(c.req)]
 	}
 	n, err := conn.Write(c.req)
 	c.bytesSent = c.bytesSent + int64(n)
@@ -186,6 +240,10 @@ func (c *UDPClient) Fetch() ([]byte, error) {
 	if log.LogDebug() {
 		log.Debugf("read %d (%q): %v", n, string(c.buffer[:n]), err)
 	}
+	if err != nil || n != len(c.req) || !bytes.Equal(c.buffer, c.req) {
+		// Don't reuse the socket, a late reply could otherwise be read as the next one.
+		conn.Close()
+	}
 	if os.IsTimeout(err) {
 		return c.buffer[:n], errTimeout
 	}
@@ -266,6 +324,9 @@ func RunUDPTest(o *RunnerOptions) (*RunnerResults, error) {
 			total.RetCodes[k] += udpstate[i].RetCodes[k]
 		}
 	}
+	total.Timeouts = total.RetCodes[errTimeout.Error()]
+	total.Mismatches = total.RetCodes[errMismatch.Error()] + total.RetCodes[errShortRead.Error()] +
+		total.RetCodes[errLongRead.Error()]
 	// Cleanup state:
 	r.Options().ReleaseRunners()
 	totalCount := float64(total.DurationHistogram.Count)
@@ -275,5 +336,8 @@ func RunUDPTest(o *RunnerOptions) (*RunnerResults, error) {
 	for _, k := range keys {
 		_, _ = fmt.Fprintf(out, "udp %s : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
 	}
+	_, _ = fmt.Fprintf(out, "Packet loss (timeouts after %v): %d (%.1f %%), mismatched replies: %d (%.1f %%)\n",
+		udpstate[0].client.reqTimeout, total.Timeouts, 100.*float64(total.Timeouts)/totalCount,
+		total.Mismatches, 100.*float64(total.Mismatches)/totalCount)
 	return &total, nil
 }
@@ -19,7 +19,9 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"fortio.org/fortio/fnet"
 )
@@ -95,3 +97,73 @@ func TestUDPNotLeaking(t *testing.T) {
 		t.Errorf("%d socket used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
 	}
 }
+
+func TestExpandPayload(t *testing.T) {
+	p := string(ExpandPayload([]byte("c={conn} s={seq} {seq} t={time}"), 3, 42))
+	var c, s1, s2 int
+	var ts int64
+	if n, err := fmt.Sscanf(p, "c=%d s=%d %d t=%d", &c, &s1, &s2, &ts); n != 4 || err != nil {
+		t.Fatalf("Unexpected expanded payload %q: %v", p, err)
+	}
+	if c != 3 || s1 != 42 || s2 != 42 || ts <= 0 {
+		t.Errorf("Unexpected expanded payload %q", p)
+	}
+	if p = string(ExpandPayload([]byte("no placeholder"), 1, 2)); p != "no placeholder" {
+		t.Errorf("Unexpected expanded payload %q", p)
+	}
+}
+
+func TestUDPRunnerTemplate(t *testing.T) {
+	addr := fnet.UDPEchoServer("test-echo-template", ":0", false)
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 20
+	opts.Destination = fmt.Sprintf("udp://localhost:%d/", addr.(*net.UDPAddr).Port)
+	opts.Payload = []byte("req {conn}-{seq}")
+	opts.PayloadTemplate = true
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[UDPStatusOK] != 20 || res.Timeouts != 0 || res.Mismatches != 0 {
+		t.Errorf("Unexpected results %v timeouts %d mismatches %d", res.RetCodes, res.Timeouts, res.Mismatches)
+	}
+	// "req 0-1" to "req 3-5"
+	if res.BytesSent < 20*7 || res.BytesSent != res.BytesReceived {
+		t.Errorf("Unexpected bytes sent %d received %d", res.BytesSent, res.BytesReceived)
+	}
+}
+
+func TestUDPRunnerLossAndMismatch(t *testing.T) {
+	// Server not replying to odd requests and replying something else to the others.
+	conn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for i := 0; ; i++ {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if i%2 == 0 {
+				_, _ = conn.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), from)
+			}
+		}
+	}()
+	opts := RunnerOptions{}
+	opts.QPS = -1
+	opts.NumThreads = 1
+	opts.Exactly = 10
+	opts.ReqTimeout = 50 * time.Millisecond
+	opts.Destination = "udp://" + conn.LocalAddr().String()
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Timeouts != 5 || res.Mismatches != 5 || res.ErrorCount() != 10 {
+		t.Errorf("Unexpected results %v timeouts %d mismatches %d", res.RetCodes, res.Timeouts, res.Mismatches)
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"fortio.org/fortio/compare"
+	"fortio.org/fortio/distributed"
 	"fortio.org/fortio/fgrpc"
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/log"
@@ -18,6 +23,7 @@ import (
 	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
 	"fortio.org/fortio/udprunner"
+	"fortio.org/fortio/wsrunner"
 )
 
 // ErrorReply is returned on errors.
@@ -141,6 +147,7 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 	sequentialWarmup := (FormValue(r, jd, "sequential-warmup") == "on")
 	httpsInsecure := (FormValue(r, jd, "https-insecure") == "on")
 	resolve := FormValue(r, jd, "resolve")
+	sni := FormValue(r, jd, "sni")
 	timeoutStr := strings.TrimSpace(FormValue(r, jd, "timeout"))
 	timeout, _ := time.ParseDuration(timeoutStr) // will be 0 if empty, which is handled by runner and opts
 	var dur time.Duration
@@ -159,10 +166,36 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 		percList = defaultPercentileList
 	}
 	n, _ := strconv.ParseInt(FormValue(r, jd, "n"), 10, 64)
+	warmupCalls, _ := strconv.ParseInt(FormValue(r, jd, "warmup-calls"), 10, 64)
+	warmupDuration, _ := time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "warmup-duration"))) // 0 if empty: no warmup
 	if strings.TrimSpace(url) == "" {
 		Error(w, ErrorReply{"URL is required", nil})
 		return
 	}
+	openLoopQueue, _ := strconv.Atoi(FormValue(r, jd, "open-loop-queue"))
+	snapshotInterval, _ := time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "snapshot-interval")))
+	soakInterval, _ := time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "soak-interval")))
+	soakMaxDrift := 0.2
+	if drift := FormValue(r, jd, "soak-max-drift"); drift != "" {
+		if soakMaxDrift, err = compare.ParseThreshold(drift); err != nil {
+			Error(w, ErrorReply{"invalid soak-max-drift: " + err.Error(), err})
+			return
+		}
+	}
+	var stages []periodic.Stage
+	if profile := FormValue(r, jd, "qps-profile"); profile != "" {
+		stages, err = periodic.ParseQPSProfile(profile)
+	} else if ramp := FormValue(r, jd, "ramp"); ramp != "" {
+		steps, _ := strconv.Atoi(FormValue(r, jd, "ramp-steps"))
+		if steps <= 0 {
+			steps = 10
+		}
+		stages, err = periodic.ParseRamp(ramp, steps)
+	}
+	if err != nil {
+		Error(w, ErrorReply{"invalid load profile: " + err.Error(), err})
+		return
+	}
 	ro := periodic.RunnerOptions{
 		QPS:         qps,
 		Duration:    dur,
@@ -175,12 +208,26 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 		Jitter:      jitter,
 		Uniform:     uniform,
 		NoCatchUp:   nocatchup,
+		// warmup
+		WarmupCalls:    warmupCalls,
+		WarmupDuration: warmupDuration,
+		Stages:         stages,
+		OpenLoop:       FormValue(r, jd, "open-loop"),
+		OpenLoopQueue:  openLoopQueue,
+		// interim results, streamed by RESTLiveHandler
+		SnapshotInterval: snapshotInterval,
+		OnSnapshot:       publishSnapshot,
+		// soak mode windows, in the results
+		SoakInterval: soakInterval,
+		SoakMaxDrift: soakMaxDrift,
 	}
 	ro.Normalize()
 	uiRunMapMutex.Lock()
 	id++ // start at 1 as 0 means interrupt all
 	runid := id
 	runs[runid] = &ro
+	runStatuses[runid] = &RunStatus{RunID: runid, Runner: runner, URL: url, Labels: labels,
+		Started: time.Now(), Async: async, Params: runParams(r, jd)}
 	uiRunMapMutex.Unlock()
 	ro.RunID = runid
 	log.Infof("New run id %d", runid)
@@ -192,6 +239,10 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 	httpopts.SequentialWarmup = sequentialWarmup
 	httpopts.Insecure = httpsInsecure
 	httpopts.Resolve = resolve
+	httpopts.DNSMethod = FormValue(r, jd, "dns-method")
+	httpopts.DNSRefresh, _ = time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "dns-refresh")))
+	httpopts.ServerName = sni
+	httpopts.RegeneratePayload = (FormValue(r, jd, "payload-regenerate") == "on")
 	if len(payload) > 0 {
 		httpopts.Payload = []byte(payload)
 	}
@@ -234,6 +285,22 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 	Run(w, r, jd, runner, url, ro, httpopts)
 }
 
+// restRetryPolicy returns the retry policy from the retry-attempts, retry-backoff (default 25ms),
+// retry-max-backoff (default 1s), retry-jitter (none, full or equal) and retry-on parameters.
+func restRetryPolicy(r *http.Request, jd map[string]interface{}) periodic.RetryPolicy {
+	p := periodic.RetryPolicy{Backoff: 25 * time.Millisecond, MaxBackoff: time.Second}
+	p.MaxAttempts, _ = strconv.Atoi(FormValue(r, jd, "retry-attempts"))
+	if d, err := time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "retry-backoff"))); err == nil {
+		p.Backoff = d
+	}
+	if d, err := time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "retry-max-backoff"))); err == nil {
+		p.MaxBackoff = d
+	}
+	p.Jitter, _ = periodic.ParseRetryJitter(FormValue(r, jd, "retry-jitter"))
+	p.RetryOn = periodic.ParseRetryOn(FormValue(r, jd, "retry-on"))
+	return p
+}
+
 // Run executes the run (can be called async or not, writer is nil for async mode).
 func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 	runner, url string, ro periodic.RunnerOptions, httpopts *fhttp.HTTPOptions) {
@@ -244,17 +311,37 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		grpcSecure := (FormValue(r, jd, "grpc-secure") == "on")
 		grpcPing := (FormValue(r, jd, "ping") == "on")
 		grpcPingDelay, _ := time.ParseDuration(FormValue(r, jd, "grpc-ping-delay"))
+		streams, _ := strconv.Atoi(FormValue(r, jd, "s"))
+		streamMessages, _ := strconv.Atoi(FormValue(r, jd, "grpc-stream-messages"))
+		maxInflight, _ := strconv.Atoi(FormValue(r, jd, "grpc-client-max-inflight"))
+		conns, _ := strconv.Atoi(FormValue(r, jd, "grpc-conns"))
+		callTimeout, _ := time.ParseDuration(strings.TrimSpace(FormValue(r, jd, "grpc-timeout")))
 		o := fgrpc.GRPCRunnerOptions{
-			RunnerOptions: ro,
-			Destination:   url,
-			UsePing:       grpcPing,
-			Delay:         grpcPingDelay,
+			RunnerOptions:      ro,
+			Destination:        url,
+			Service:            FormValue(r, jd, "healthservice"),
+			Streams:            streams,
+			AllowInitialErrors: (FormValue(r, jd, "allow-initial-errors") == "on"),
+			Payload:            httpopts.PayloadString(),
+			UsePing:            grpcPing,
+			Delay:              grpcPingDelay,
+			MaxInflightPerConn: maxInflight,
+			StreamMode:         FormValue(r, jd, "grpc-stream"),
+			StreamMessages:     streamMessages,
+			StreamReuse:        (FormValue(r, jd, "grpc-stream-reuse") == "on"),
+			Method:             FormValue(r, jd, "grpc-method"),
+			Data:               FormValue(r, jd, "grpc-data"),
+			Metadata:           FormValues(r, jd, "grpc-metadata"),
+			CallTimeout:        callTimeout,
+			Connections:        conns,
+			Expect:             FormValue(r, jd, "expect"),
+			ServerTimeMetadata: FormValue(r, jd, "server-time"),
+			Retry:              restRetryPolicy(r, jd),
 		}
 		o.TLSOptions = httpopts.TLSOptions
 		if grpcSecure {
 			o.Destination = fhttp.AddHTTPS(url)
 		}
-		// TODO: ReqTimeout: timeout
 		res, err = fgrpc.RunGRPCTest(&o)
 	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
 		// TODO: copy pasta from fortio_main
@@ -273,23 +360,48 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		o.ReqTimeout = httpopts.HTTPReqTimeOut
 		o.Destination = url
 		o.Payload = httpopts.Payload
+		o.PayloadTemplate = (FormValue(r, jd, "udp-template") == "on")
 		res, err = udprunner.RunUDPTest(&o)
+	} else if wsrunner.IsWebSocketURL(url) {
+		// TODO: copy pasta from fortio_main
+		o := wsrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.TLSOptions = httpopts.TLSOptions
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpopts.Payload
+		res, err = wsrunner.RunWSTest(&o)
+	} else if _, _, found := periodic.LookupRunnerType(url); found {
+		o := periodic.CustomRunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.Target = url
+		o.Payload = httpopts.Payload
+		o.Timeout = httpopts.HTTPReqTimeOut
+		o.Params = requestParams(r, jd)
+		res, err = periodic.RunCustomTest(&o)
 	} else {
 		o := fhttp.HTTPRunnerOptions{
 			HTTPOptions:        *httpopts,
 			RunnerOptions:      ro,
 			AllowInitialErrors: true,
+			Expect:             FormValue(r, jd, "expect"),
+			ServerTimeHeader:   FormValue(r, jd, "server-time"),
+			Retry:              restRetryPolicy(r, jd),
 		}
 		res, err = fhttp.RunHTTPTest(&o)
 	}
 	uiRunMapMutex.Lock()
 	delete(runs, ro.RunID)
+	delete(runStatuses, ro.RunID)
 	uiRunMapMutex.Unlock()
 	if err != nil {
 		log.Errf("Init error for %s mode with url %s and options %+v : %v", runner, url, ro, err)
 		Error(w, ErrorReply{"Aborting because of error", err})
 		return
 	}
+	recordResult(res)
 	json, err := json.MarshalIndent(res, "", "  ")
 	if err != nil {
 		log.Fatalf("Unable to json serialize result: %v", err)
@@ -309,12 +421,126 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 	}
 }
 
-// RESTStatusHandler will print the state of the runs.
+// RunStatus describes a run in progress, as returned by the status api.
+type RunStatus struct {
+	RunID   int64
+	Runner  string // runner parameter of the run request (http or grpc)
+	URL     string
+	Labels  string
+	Started time.Time
+	Async   bool
+	// Parameters of the run request (query arguments and json body string values),
+	// with the values of the authorization headers and metadata redacted.
+	Params url.Values
+	// Latest interim results, for the runs started with a snapshot-interval.
+	Snapshot *periodic.Snapshot `json:",omitempty"`
+}
+
+// RunsStatus is the reply of the status api.
+type RunsStatus struct {
+	Runs []*RunStatus
+}
+
+// FormValues returns all the values of the key from the query arguments (repeated
+// key) and the provided json data (string or array of strings).
+func FormValues(r *http.Request, json map[string]interface{}, key string) []string {
+	_ = r.ParseForm() // no-op if already parsed, e.g. by FormValue
+	res := append([]string{}, r.Form[key]...)
+	return append(res, jsonValues(json, key)...)
+}
+
+// jsonValues returns the string or strings array value of key in the json data.
+func jsonValues(json map[string]interface{}, key string) []string {
+	var res []string
+	switch v := json[key].(type) {
+	case string:
+		res = append(res, v)
+	case []interface{}:
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				res = append(res, str)
+			} else {
+				log.Warnf("%q element %+v / not a string, can't be used", key, e)
+			}
+		}
+	}
+	return res
+}
+
+// redactAuthorization returns the header or metadata (name: value) with its value
+// redacted if it is an authorization one.
+func redactAuthorization(kv string) string {
+	idx := strings.Index(kv, ":")
+	if idx < 0 {
+		return kv
+	}
+	name := strings.ToLower(strings.TrimSpace(kv[:idx]))
+	if name == "authorization" || name == "proxy-authorization" || strings.HasSuffix(name, "-api-token") {
+		return kv[:idx+1] + " REDACTED"
+	}
+	return kv
+}
+
+// requestParams returns all the parameters of a run request, from the json body and the query args.
+func requestParams(r *http.Request, jd map[string]interface{}) url.Values {
+	params := url.Values{}
+	for k := range jd {
+		if values := jsonValues(jd, k); len(values) > 0 {
+			params[k] = values
+		}
+	}
+	for k, v := range r.Form { // query args have priority
+		params[k] = v
+	}
+	return params
+}
+
+// runParams returns the parameters of a run request, with the credentials redacted, for the status api.
+func runParams(r *http.Request, jd map[string]interface{}) url.Values {
+	params := requestParams(r, jd)
+	for _, k := range []string{"H", "headers", "grpc-metadata"} {
+		redacted := make([]string, 0, len(params[k]))
+		for _, v := range params[k] {
+			redacted = append(redacted, redactAuthorization(v))
+		}
+		if len(redacted) > 0 {
+			params[k] = redacted
+		}
+	}
+	return params
+}
+
+// RESTStatusHandler returns the status of the runs in progress or, with a runid
+// parameter, of that run (an error if it's not found, e.g. finished or never started).
 func RESTStatusHandler(w http.ResponseWriter, r *http.Request) {
 	fhttp.LogRequest(r, "REST Status Api call")
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusServiceUnavailable)
-	w.Write([]byte("{\"error\":\"status not yet implemented\"}"))
+	runid, _ := strconv.ParseInt(r.FormValue("runid"), 10, 64)
+	status := RunsStatus{Runs: []*RunStatus{}}
+	uiRunMapMutex.Lock()
+	liveMutex.Lock()
+	for k, v := range runStatuses {
+		if runid > 0 && k != runid {
+			continue
+		}
+		rs := *v
+		rs.Snapshot = lastSnapshots[k]
+		status.Runs = append(status.Runs, &rs)
+	}
+	liveMutex.Unlock()
+	uiRunMapMutex.Unlock()
+	if runid > 0 && len(status.Runs) == 0 {
+		Error(w, ErrorReply{fmt.Sprintf("run %d not found", runid), nil})
+		return
+	}
+	sort.Slice(status.Runs, func(i, j int) bool { return status.Runs[i].RunID < status.Runs[j].RunID })
+	b, err := json.MarshalIndent(&status, "", "  ")
+	if err != nil {
+		log.Errf("Unable to json serialize status: %v", err)
+		Error(w, ErrorReply{"json serialization error", err})
+		return
+	}
+	_, _ = w.Write(b)
 }
 
 // RESTStopHandler is the api to stop a given run by runid or all the runs if unspecified/0.
@@ -326,6 +552,26 @@ func RESTStopHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprintf("{\"stopped\": %d}", i)))
 }
 
+// workers registered with this server as coordinator of distributed runs.
+var workers = distributed.NewRegistry()
+
+// RESTWorkersHandler is the coordinator api for distributed runs: POST with a url
+// parameter registers that worker, GET returns the currently registered workers.
+func RESTWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "REST Workers Api call")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		worker := strings.TrimSpace(r.FormValue("url"))
+		if worker == "" {
+			Error(w, ErrorReply{"url is required", nil})
+			return
+		}
+		workers.Register(worker)
+	}
+	b, _ := json.Marshal(distributed.Workers{Workers: workers.Workers()})
+	_, _ = w.Write(b)
+}
+
 // StopByRunID stops all the runs if passed 0 or the runid provided.
 func StopByRunID(runid int64) int {
 	uiRunMapMutex.Lock()
@@ -334,6 +580,7 @@ func StopByRunID(runid int64) int {
 		for k, v := range runs {
 			v.Abort()
 			delete(runs, k)
+			delete(runStatuses, k)
 			i++
 		}
 		uiRunMapMutex.Unlock()
@@ -344,6 +591,7 @@ func StopByRunID(runid int64) int {
 	v, found := runs[runid]
 	if found {
 		delete(runs, runid)
+		delete(runStatuses, runid)
 		uiRunMapMutex.Unlock()
 		v.Abort()
 		log.Infof("Interrupted run id %d", runid)
@@ -353,3 +601,140 @@ func StopByRunID(runid int64) int {
 	uiRunMapMutex.Unlock()
 	return 0
 }
+
+var (
+	liveMutex sync.Mutex
+	// Channels of the clients following the interim results, by run id (0 for all the runs).
+	liveSubscribers = make(map[int64][]chan *periodic.Snapshot)
+	// Latest snapshot of the runs in progress, for the metrics.
+	lastSnapshots = make(map[int64]*periodic.Snapshot)
+)
+
+// publishSnapshot sends the interim results to the clients following that run, skipping
+// the ones too slow to keep up.
+func publishSnapshot(s *periodic.Snapshot) {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	if s.Final {
+		delete(lastSnapshots, s.RunID)
+	} else {
+		lastSnapshots[s.RunID] = s
+	}
+	for _, runid := range []int64{s.RunID, 0} {
+		for _, ch := range liveSubscribers[runid] {
+			select {
+			case ch <- s:
+			default:
+				log.Warnf("Live results client for run %d too slow, dropping snapshot", runid)
+			}
+		}
+	}
+}
+
+func unsubscribeLive(runid int64, ch chan *periodic.Snapshot) {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	subs := liveSubscribers[runid]
+	for i := range subs {
+		if subs[i] == ch {
+			liveSubscribers[runid] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(liveSubscribers[runid]) == 0 {
+		delete(liveSubscribers, runid)
+	}
+}
+
+// RESTLiveHandler streams the interim results (periodic.Snapshot) of a given run by runid,
+// or of all the runs if unspecified/0, as server-sent events. The runs must be started
+// with a snapshot-interval. The stream of a given run ends with its final snapshot.
+func RESTLiveHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "REST Live Api call")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Error(w, ErrorReply{"streaming not supported", nil})
+		return
+	}
+	runid, _ := strconv.ParseInt(r.FormValue("runid"), 10, 64)
+	if runid < 0 {
+		runid = 0
+	}
+	ch := make(chan *periodic.Snapshot, 16)
+	liveMutex.Lock()
+	liveSubscribers[runid] = append(liveSubscribers[runid], ch)
+	liveMutex.Unlock()
+	defer unsubscribeLive(runid, ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case s := <-ch:
+			j, err := json.Marshal(s)
+			if err != nil {
+				log.Errf("Unable to json serialize snapshot: %v", err)
+				return
+			}
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", j); err != nil {
+				log.LogVf("Live results client %v gone: %v", r.RemoteAddr, err)
+				return
+			}
+			flusher.Flush()
+			if s.Final && runid > 0 {
+				_, _ = fmt.Fprintf(w, "event: end\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+		}
+	}
+}
+
+// Number of finished runs whose results are kept for the metrics.
+const maxMetricsResults = 20
+
+var (
+	resultsMutex  sync.Mutex
+	recentResults []periodic.HasRunnerResult
+)
+
+// recordResult keeps the results of the latest runs for the metrics.
+func recordResult(res periodic.HasRunnerResult) {
+	resultsMutex.Lock()
+	recentResults = append(recentResults, res)
+	if len(recentResults) > maxMetricsResults {
+		recentResults = recentResults[len(recentResults)-maxMetricsResults:]
+	}
+	resultsMutex.Unlock()
+}
+
+// MetricsHandler exposes, in the Prometheus text format, the metrics of the runs in progress
+// and the results of the latest finished runs of this server.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "Metrics")
+	p := periodic.NewPrometheusExposition()
+	uiRunMapMutex.Lock()
+	liveMutex.Lock()
+	ids := make([]int64, 0, len(runs))
+	for id := range runs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		p.AddRunning(runs[id], lastSnapshots[id])
+	}
+	liveMutex.Unlock()
+	uiRunMapMutex.Unlock()
+	resultsMutex.Lock()
+	for _, res := range recentResults {
+		p.AddResults(res)
+	}
+	resultsMutex.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := p.WriteTo(w); err != nil {
+		log.Errf("Unable to write metrics for %v: %v", r.RemoteAddr, err)
+	}
+}
@@ -69,6 +69,7 @@ const logYAxe = {
 let chart = {}
 let overlayChart = {}
 let mchart = {}
+let matrixChart = {}
 
 function myRound (v, digits = 6) {
   const p = Math.pow(10, digits)
@@ -224,6 +225,7 @@ function makeOverlayChart (dataA, dataB) {
   }
   deleteSingleChart()
   deleteMultiChart()
+  deleteMatrixChart()
   const ctx = chartEl.getContext('2d')
   const title = makeOverlayChartTitle(dataA.title, dataB.title)
   overlayChart = new Chart(ctx, {
@@ -306,6 +308,7 @@ function makeChart (data) {
   if (Object.keys(chart).length === 0) {
     deleteOverlayChart()
     deleteMultiChart()
+    deleteMatrixChart()
     // Creation (first or switch) time
     const ctx = chartEl.getContext('2d')
     chart = new Chart(ctx, {
@@ -543,6 +546,95 @@ function deleteSingleChart () {
   chart = {}
 }
 
+function deleteMatrixChart () {
+  if (Object.keys(matrixChart).length === 0) {
+    return
+  }
+  matrixChart.destroy()
+  matrixChart = {}
+}
+
+function matrixValue (point, metric) {
+  if (metric === 'QPS') {
+    return point.ActualQPS
+  }
+  if (metric === 'Errors') {
+    return 100.0 * point.ErrorRate
+  }
+  if (metric === 'Avg') {
+    return 1000.0 * point.Avg
+  }
+  return 1000.0 * point.Percentiles[metric]
+}
+
+// Line chart of the metric (Avg, a percentile like p99, QPS or Errors) of each
+// series of the matrix (see compare.Matrix) as a function of its x axis.
+function makeMatrixChart (matrix, metric) {
+  document.getElementById('running').style.display = 'none'
+  document.getElementById('update').style.visibility = 'hidden'
+  const chartEl = document.getElementById('chart1')
+  chartEl.style.visibility = 'visible'
+  deleteSingleChart()
+  deleteOverlayChart()
+  deleteMultiChart()
+  deleteMatrixChart()
+  const datasets = []
+  const n = matrix.Series ? matrix.Series.length : 0
+  for (let i = 0; i < n; i++) {
+    const series = matrix.Series[i]
+    const color = 'hsla(' + Math.round(360 * i / n) + ', 100%, 40%, .8)'
+    datasets.push({
+      label: series.Group === '' ? '(no labels)' : series.Group,
+      data: series.Points.map(p => ({ x: p.X, y: matrixValue(p, metric) })),
+      fill: false,
+      lineTension: 0,
+      borderColor: color,
+      backgroundColor: color
+    })
+  }
+  let yLabel = metric + ' latency in ms'
+  if (metric === 'QPS') {
+    yLabel = 'Actual QPS'
+  } else if (metric === 'Errors') {
+    yLabel = 'Error %'
+  }
+  const xLabel = matrix.X === 'qps' ? 'Requested QPS' : matrix.X
+  const ctx = chartEl.getContext('2d')
+  matrixChart = new Chart(ctx, {
+    type: 'line',
+    data: {
+      datasets: datasets
+    },
+    options: {
+      responsive: true,
+      maintainAspectRatio: false,
+      title: {
+        display: true,
+        fontStyle: 'normal',
+        text: [yLabel + ' vs ' + xLabel + ' for ' + n + ' series']
+      },
+      scales: {
+        xAxes: [{
+          type: 'linear',
+          scaleLabel: {
+            display: true,
+            labelString: xLabel
+          }
+        }],
+        yAxes: [{
+          ticks: {
+            beginAtZero: true
+          },
+          scaleLabel: {
+            display: true,
+            labelString: yLabel
+          }
+        }]
+      }
+    }
+  })
+}
+
 function makeMultiChart () {
   document.getElementById('running').style.display = 'none'
   document.getElementById('update').style.visibility = 'hidden'
@@ -553,6 +645,7 @@ function makeMultiChart () {
   }
   deleteSingleChart()
   deleteOverlayChart()
+  deleteMatrixChart()
   const ctx = chartEl.getContext('2d')
   mchart = new Chart(ctx, {
     type: 'line',
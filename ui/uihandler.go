@@ -33,12 +33,15 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"fortio.org/fortio/compare"
 	"fortio.org/fortio/dflag/endpoint"
+	"fortio.org/fortio/distributed"
 	"fortio.org/fortio/fgrpc"
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/fnet"
@@ -48,6 +51,7 @@ import (
 	"fortio.org/fortio/tcprunner"
 	"fortio.org/fortio/udprunner"
 	"fortio.org/fortio/version"
+	"fortio.org/fortio/wsrunner"
 )
 
 // TODO: move some of those in their own files/package (e.g data transfer TSV)
@@ -81,6 +85,7 @@ var (
 	uiRunMapMutex  = &sync.Mutex{}
 	id             int64
 	runs           = make(map[int64]*periodic.RunnerOptions)
+	runStatuses    = make(map[int64]*RunStatus) // for the status api, same keys as runs
 	// Base URL used for index - useful when running under an ingress with prefix.
 	baseURL string
 
@@ -93,6 +98,10 @@ const (
 	restRunURI    = "rest/run"
 	restStatusURI = "rest/status"
 	restStopURI   = "rest/stop"
+	restLiveURI   = "rest/live"
+	metricsURI    = "metrics"
+	diffURI       = "diff"
+	matrixURI     = "matrix"
 	faviconPath   = "/favicon.ico"
 	modegrpc      = "grpc"
 )
@@ -156,6 +165,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	sequentialWarmup := (r.FormValue("sequential-warmup") == "on")
 	httpsInsecure := (r.FormValue("https-insecure") == "on")
 	resolve := r.FormValue("resolve")
+	sni := r.FormValue("sni")
 	timeoutStr := strings.TrimSpace(r.FormValue("timeout"))
 	timeout, _ := time.ParseDuration(timeoutStr) // will be 0 if empty, which is handled by runner and opts
 	var dur time.Duration
@@ -203,6 +213,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		id++ // start at 1 as 0 means interrupt all
 		runid = id
 		runs[runid] = &ro
+		runStatuses[runid] = &RunStatus{RunID: runid, Runner: runner, URL: url, Labels: labels,
+			Started: time.Now(), Params: runParams(r, nil)}
 		uiRunMapMutex.Unlock()
 		log.Infof("New run id %d", runid)
 		ro.RunID = id
@@ -216,6 +228,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	httpopts.SequentialWarmup = sequentialWarmup
 	httpopts.Insecure = httpsInsecure
 	httpopts.Resolve = resolve
+	httpopts.ServerName = sni
 	if len(payload) > 0 {
 		httpopts.Payload = []byte(payload)
 	}
@@ -315,7 +328,27 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			o.ReqTimeout = timeout
 			o.Destination = url
 			o.Payload = httpopts.Payload
+			o.PayloadTemplate = (r.FormValue("udp-template") == "on")
 			res, err = udprunner.RunUDPTest(&o)
+		} else if wsrunner.IsWebSocketURL(url) {
+			// TODO: copy pasta from fortio_main
+			o := wsrunner.RunnerOptions{
+				RunnerOptions: ro,
+			}
+			o.TLSOptions = httpopts.TLSOptions
+			o.ReqTimeout = timeout
+			o.Destination = url
+			o.Payload = httpopts.Payload
+			res, err = wsrunner.RunWSTest(&o)
+		} else if _, _, found := periodic.LookupRunnerType(url); found {
+			o := periodic.CustomRunnerOptions{
+				RunnerOptions: ro,
+			}
+			o.Target = url
+			o.Payload = httpopts.Payload
+			o.Timeout = timeout
+			o.Params = requestParams(r, nil)
+			res, err = periodic.RunCustomTest(&o)
 		} else {
 			o := fhttp.HTTPRunnerOptions{
 				HTTPOptions:        *httpopts,
@@ -326,6 +359,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 		uiRunMapMutex.Lock()
 		delete(runs, ro.RunID)
+		delete(runStatuses, ro.RunID)
 		uiRunMapMutex.Unlock()
 		if err != nil {
 			log.Errf("Init error for %s mode with url %s and options %+v : %v", runner, url, ro, err)
@@ -335,6 +369,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 				html.EscapeString(err.Error()))))
 			return
 		}
+		recordResult(res)
 		json, err := json.MarshalIndent(res, "", "  ")
 		if err != nil {
 			log.Fatalf("Unable to json serialize result: %v", err)
@@ -512,6 +547,105 @@ func BrowseHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DiffHandler returns the json comparison (see compare.Diff) of the saved results
+// a and b of the data directory, with the optional max-qps-decrease, max-latency-increase
+// and max-error-rate-increase regression thresholds.
+func DiffHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "Diff")
+	var res [2]*compare.Result
+	for i, param := range []string{"a", "b"} {
+		name := r.FormValue(param)
+		if name == "" || path.Base(name) != name || !strings.HasSuffix(name, ".json") {
+			Error(w, ErrorReply{"Invalid result file name", fmt.Errorf("%s=%q", param, name)})
+			return
+		}
+		var err error
+		if res[i], err = compare.ReadFile(path.Join(dataDir, name)); err != nil {
+			Error(w, ErrorReply{"Unable to read result", err})
+			return
+		}
+	}
+	t := compare.NoThresholds
+	for _, th := range []struct {
+		param string
+		ptr   *float64
+	}{
+		{"max-qps-decrease", &t.MaxQPSDecrease},
+		{"max-latency-increase", &t.MaxLatencyIncrease},
+		{"max-error-rate-increase", &t.MaxErrorRateIncrease},
+	} {
+		var err error
+		if *th.ptr, err = compare.ParseThreshold(r.FormValue(th.param)); err != nil {
+			Error(w, ErrorReply{"Invalid " + th.param, err})
+			return
+		}
+	}
+	d := compare.Compare(res[0], res[1], defaultPercentileList, t)
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to json serialize diff: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// MatrixHandler returns the json matrix (see compare.NewMatrix) of the saved results of
+// the data directory selected with sel (names, as in browse), or matching the s regular
+// expression, or all of them. The x param is the x axis (qps by default, payload or a
+// labels key) and group the optional comma separated labels keys defining the series.
+func MatrixHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "Matrix")
+	names := r.URL.Query()["sel"]
+	if len(names) == 0 {
+		names = DataList()
+		if search := r.FormValue("s"); search != "" {
+			re, err := regexp.Compile("(?i)" + search)
+			if err != nil {
+				Error(w, ErrorReply{"Invalid search expression", err})
+				return
+			}
+			matching := names[:0]
+			for _, n := range names {
+				if re.MatchString(n) {
+					matching = append(matching, n)
+				}
+			}
+			names = matching
+		}
+	}
+	results := make([]*compare.Result, 0, len(names))
+	found := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".json")
+		if path.Base(name) != name {
+			Error(w, ErrorReply{"Invalid result file name", fmt.Errorf("sel=%q", name)})
+			return
+		}
+		res, err := compare.ReadFile(path.Join(dataDir, name+".json"))
+		if err != nil {
+			log.Warnf("Skipping %s for the matrix: %v", name, err)
+			continue
+		}
+		results = append(results, res)
+		found = append(found, name)
+	}
+	x := r.FormValue("x")
+	if x == "" {
+		x = compare.XQPS
+	}
+	var groupBy []string
+	if g := r.FormValue("group"); g != "" {
+		groupBy = strings.Split(g, ",")
+	}
+	m := compare.NewMatrix(found, results, x, groupBy, defaultPercentileList)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to json serialize matrix: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
 // LogAndAddCacheControl logs the request and wrapps an HTTP handler to add a Cache-Control header for static files.
 func LogAndAddCacheControl(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -916,6 +1050,10 @@ func Serve(baseurl, port, debugpath, uipath, datadir string, percentileList []fl
 	mux.HandleFunc(restStatusPath, RESTStatusHandler)
 	restStopPath := uiPath + restStopURI
 	mux.HandleFunc(restStopPath, RESTStopHandler)
+	restLivePath := uiPath + restLiveURI
+	mux.HandleFunc(restLivePath, RESTLiveHandler)
+	mux.HandleFunc(uiPath+distributed.RESTWorkersURI, RESTWorkersHandler)
+	mux.HandleFunc(uiPath+metricsURI, MetricsHandler)
 
 	logoPath = version.Short() + "/static/img/fortio-logo-gradient-no-bg.svg"
 	chartJSPath = version.Short() + "/static/js/Chart.min.js"
@@ -954,6 +1092,8 @@ func Serve(baseurl, port, debugpath, uipath, datadir string, percentileList []fl
 	if dataDir != "" {
 		fs := http.FileServer(http.Dir(dataDir))
 		mux.Handle(uiPath+"data/", LogAndFilterDataRequest(http.StripPrefix(uiPath+"data", fs)))
+		mux.HandleFunc(uiPath+diffURI, DiffHandler)
+		mux.HandleFunc(uiPath+matrixURI, MatrixHandler)
 		if datadir == "." {
 			var err error
 			datadir, err = os.Getwd()
@@ -1011,6 +1151,8 @@ func Report(baseurl, port, datadir string) bool {
 	} else {
 		mux.HandleFunc(uiPath, BrowseHandler)
 	}
+	mux.HandleFunc(uiPath+diffURI, DiffHandler)
+	mux.HandleFunc(uiPath+matrixURI, MatrixHandler)
 	fsd := http.FileServer(http.Dir(dataDir))
 	mux.Handle(uiPath+"data/", LogAndFilterDataRequest(http.StripPrefix(uiPath+"data", fsd)))
 	return true
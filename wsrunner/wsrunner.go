@@ -0,0 +1,294 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner // import "fortio.org/fortio/wsrunner"
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"fortio.org/fortio/auth"
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/tcprunner"
+	"golang.org/x/net/websocket"
+)
+
+type WSResultMap map[string]int64
+
+// RunnerResults is the aggregated result of a WebSocket runner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	WSOptions
+	RetCodes      WSResultMap
+	SocketCount   int
+	BytesSent     int64
+	BytesReceived int64
+	client        *WSClient
+}
+
+// Run sends a message and waits for its echo. Main call being run at the target QPS.
+// To be set as the Function in RunnerOptions.
+func (wsstate *RunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	_, err := wsstate.client.Fetch()
+	if err != nil {
+		wsstate.RetCodes[err.Error()]++
+	} else {
+		wsstate.RetCodes[WSStatusOK]++
+	}
+}
+
+// ResetStats clears the return codes, after the warmup (implements periodic.Resetter).
+func (wsstate *RunnerResults) ResetStats() {
+	wsstate.RetCodes = make(WSResultMap)
+}
+
+// ErrorCount returns the number of failed calls (implements periodic.HasErrorCount).
+func (wsstate *RunnerResults) ErrorCount() int64 {
+	var n int64
+	for k, count := range wsstate.RetCodes {
+		if k != WSStatusOK {
+			n += count
+		}
+	}
+	return n
+}
+
+// ReturnCodes returns the number of calls by status (implements periodic.HasReturnCodes).
+func (wsstate *RunnerResults) ReturnCodes() map[string]int64 {
+	return wsstate.RetCodes
+}
+
+// WSOptions are options to the WSClient.
+type WSOptions struct {
+	fhttp.TLSOptions
+	Destination string      // ws:// or wss:// url
+	Payload     []byte      // message to send (and check the echo of), sent as text if valid utf-8
+	Headers     http.Header `json:"-"` // extra headers for the handshake
+	ReqTimeout  time.Duration
+	// Optional, to set the current Authorization header of each (re)connection.
+	Auth auth.Provider `json:"-"`
+}
+
+// RunnerOptions includes the base RunnerOptions plus websocket specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	WSOptions
+}
+
+// WSClient is the client used for websocket echo testing, it keeps its connection
+// open between calls (and reconnects after errors).
+type WSClient struct {
+	config        *websocket.Config
+	conn          *websocket.Conn
+	frame         fhttp.WebSocketFrame
+	reply         fhttp.WebSocketFrame
+	connID        int
+	messageCount  int64
+	bytesSent     int64
+	bytesReceived int64
+	socketCount   int
+	doGenerate    bool
+	reqTimeout    time.Duration
+	auth          auth.Provider
+}
+
+var (
+	// WSURLPrefix is the URL prefix for triggering websocket load.
+	WSURLPrefix = "ws://"
+	// WSSURLPrefix is the URL prefix for triggering secure websocket load.
+	WSSURLPrefix = "wss://"
+	// WSStatusOK is the map key on success.
+	WSStatusOK  = "OK"
+	errMismatch = fmt.Errorf("reply not echoing the message")
+)
+
+// IsWebSocketURL returns true for ws:// and wss:// urls.
+func IsWebSocketURL(u string) bool {
+	lc := strings.ToLower(u)
+	return strings.HasPrefix(lc, WSURLPrefix) || strings.HasPrefix(lc, WSSURLPrefix)
+}
+
+// NewWSClient creates and initialize and returns a client based on the WSOptions.
+func NewWSClient(o *WSOptions) (*WSClient, error) {
+	if !IsWebSocketURL(o.Destination) {
+		return nil, fmt.Errorf("invalid websocket url %q, must start with %s or %s", o.Destination, WSURLPrefix, WSSURLPrefix)
+	}
+	origin := "http" + o.Destination[2:] // ws -> http, wss -> https
+	config, err := websocket.NewConfig(o.Destination, origin)
+	if err != nil {
+		return nil, err
+	}
+	c := WSClient{config: config}
+	for k, v := range o.Headers {
+		config.Header[k] = v
+	}
+	if strings.HasPrefix(strings.ToLower(o.Destination), WSSURLPrefix) {
+		if config.TlsConfig, err = o.TLSOptions.TLSClientConfig(); err != nil {
+			return nil, err
+		}
+	}
+	c.frame.Data = o.Payload
+	if len(c.frame.Data) == 0 {
+		c.doGenerate = true
+		c.frame.Data = tcprunner.GeneratePayload(0, 0)
+	}
+	c.frame.Type = websocket.TextFrame
+	if !utf8.Valid(c.frame.Data) {
+		c.frame.Type = websocket.BinaryFrame
+	}
+	c.auth = o.Auth
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout <= 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	config.Dialer = &net.Dialer{Timeout: c.reqTimeout}
+	return &c, nil
+}
+
+func (c *WSClient) connect() (*websocket.Conn, error) {
+	c.socketCount++
+	if c.auth != nil {
+		if v := c.auth.Authorization(); v != "" {
+			c.config.Header.Set("Authorization", v)
+		}
+	}
+	conn, err := websocket.DialConfig(c.config)
+	if err != nil {
+		log.Errf("[%d] Unable to connect to %v : %v", c.connID, c.config.Location, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Fetch sends the message and returns the echo received.
+func (c *WSClient) Fetch() ([]byte, error) {
+	conn := c.conn
+	c.messageCount++
+	if conn == nil {
+		var err error
+		if conn, err = c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	c.conn = nil // reconnect on errors
+	if c.doGenerate {
+		c.frame.Data = tcprunner.GeneratePayload(c.connID, c.messageCount)
+	}
+	_ = conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	if err := fhttp.WebSocketFrameCodec.Send(conn, &c.frame); err != nil {
+		log.Errf("[%d] Unable to send to %v: %v", c.connID, c.config.Location, err)
+		conn.Close()
+		return nil, err
+	}
+	c.bytesSent += int64(len(c.frame.Data))
+	if err := fhttp.WebSocketFrameCodec.Receive(conn, &c.reply); err != nil {
+		log.Errf("[%d] Unable to receive from %v: %v", c.connID, c.config.Location, err)
+		conn.Close()
+		return nil, err
+	}
+	c.bytesReceived += int64(len(c.reply.Data))
+	if log.LogDebug() {
+		log.Debugf("[%d] received %s", c.connID, fhttp.DebugSummary(c.reply.Data, 256))
+	}
+	if !bytes.Equal(c.reply.Data, c.frame.Data) {
+		log.Infof("Mismatch between sent %q and received %q", fhttp.DebugSummary(c.frame.Data, 256),
+			fhttp.DebugSummary(c.reply.Data, 256))
+		c.conn = conn // the connection is fine
+		return c.reply.Data, errMismatch
+	}
+	c.conn = conn // reuse on success
+	return c.reply.Data, nil
+}
+
+// Close closes the connection and returns the total number of connections used for the run.
+func (c *WSClient) Close() int {
+	log.Debugf("Closing %p: %s socket count %d", c, c.config.Location, c.socketCount)
+	if c.conn != nil {
+		if err := c.conn.Close(); err != nil {
+			log.Warnf("Error closing websocket client's connection: %v", err)
+		}
+		c.conn = nil
+	}
+	return c.socketCount
+}
+
+// RunWSTest runs a websocket test and returns the aggregated stats.
+func RunWSTest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = "WebSocket"
+	log.Infof("Starting websocket test for %s with %d connections at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		RetCodes: make(WSResultMap),
+	}
+	total.Destination = o.Destination
+	wsstate := make([]RunnerResults, numThreads)
+	var err error
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &wsstate[i]
+		// Create a client and connect once for each 'thread'
+		wsstate[i].client, err = NewWSClient(&o.WSOptions)
+		if wsstate[i].client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
+		}
+		wsstate[i].client.connID = i
+		if o.Exactly <= 0 {
+			data, err := wsstate[i].client.Fetch()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: err %v, received %d: %q", o.Destination, err, len(data), data)
+			}
+		}
+		// Setup the stats for each 'thread'
+		wsstate[i].RetCodes = make(WSResultMap)
+	}
+	total.RunnerResults = r.Run()
+	// Numthreads may have reduced but it should be ok to accumulate 0s from
+	// unused ones. We also must cleanup all the created clients.
+	keys := []string{}
+	for i := 0; i < numThreads; i++ {
+		total.SocketCount += wsstate[i].client.Close()
+		total.BytesReceived += wsstate[i].client.bytesReceived
+		total.BytesSent += wsstate[i].client.bytesSent
+		for k := range wsstate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += wsstate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	totalCount := float64(total.DurationHistogram.Count)
+	_, _ = fmt.Fprintf(out, "Connections used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "websocket %s : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+	}
+	return &total, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"fortio.org/fortio/fhttp"
+	"golang.org/x/net/websocket"
+)
+
+func TestWSRunnerBadDestination(t *testing.T) {
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Destination = "http://localhost:1111/"
+	if res, err := RunWSTest(&opts); err == nil {
+		t.Fatalf("unexpected success on non websocket url %+v", res)
+	}
+}
+
+func TestWSRunner(t *testing.T) {
+	_, addr := fhttp.ServeTCP("0", "")
+	destination := fmt.Sprintf("ws://localhost:%d/echo", addr.Port)
+	for _, payload := range []string{"", "some text", "\xff\xfe binary"} {
+		opts := RunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 20
+		opts.NumThreads = 2
+		opts.Destination = destination
+		opts.Payload = []byte(payload)
+		res, err := RunWSTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.DurationHistogram.Count != 20 || res.RetCodes[WSStatusOK] != 20 || res.ErrorCount() != 0 {
+			t.Errorf("Expected 20 ok calls for %q, got %v", payload, res.RetCodes)
+		}
+		if res.SocketCount != 2 || res.BytesReceived != res.BytesSent || res.BytesSent == 0 {
+			t.Errorf("Unexpected connections %d or bytes %d/%d", res.SocketCount, res.BytesSent, res.BytesReceived)
+		}
+	}
+}
+
+func TestWSRunnerMismatch(t *testing.T) {
+	mux, addr := fhttp.DynamicHTTPServer(false)
+	mux.Handle("/other/", websocket.Server{Handler: func(ws *websocket.Conn) {
+		var f fhttp.WebSocketFrame
+		for fhttp.WebSocketFrameCodec.Receive(ws, &f) == nil {
+			f.Data = append(f.Data, '!')
+			if fhttp.WebSocketFrameCodec.Send(ws, &f) != nil {
+				return
+			}
+		}
+	}})
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 10
+	opts.NumThreads = 1
+	opts.Destination = fmt.Sprintf("ws://localhost:%d/other/", addr.Port)
+	opts.Headers = http.Header{"X-Test": []string{"1"}}
+	res, err := RunWSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[errMismatch.Error()] != 10 || res.ErrorCount() != 10 || res.SocketCount != 1 {
+		t.Errorf("Expected 10 mismatches on 1 connection, got %v (%d connections)", res.RetCodes, res.SocketCount)
+	}
+}